@@ -0,0 +1,131 @@
+package catalyser
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/ovh/catalyst/core"
+	"github.com/spf13/viper"
+)
+
+// geoMapping names the fields, tags or labels holding the position of the datapoints of a protocol, latitude
+// and longitude being in degrees and elevation in meters
+type geoMapping struct {
+	latitude  string
+	longitude string
+	elevation string
+}
+
+// newGeoMapping read the `<protocol>.geo` configuration, the mapping being disabled when unset
+func newGeoMapping(protocol string) geoMapping {
+	return geoMapping{
+		latitude:  viper.GetString(protocol + ".geo.latitude"),
+		longitude: viper.GetString(protocol + ".geo.longitude"),
+		elevation: viper.GetString(protocol + ".geo.elevation"),
+	}
+}
+
+func (m geoMapping) enabled() bool {
+	return m.latitude != "" || m.longitude != "" || m.elevation != ""
+}
+
+// has returns whether name holds a part of the position
+func (m geoMapping) has(name string) bool {
+	return name != "" && (name == m.latitude || name == m.longitude || name == m.elevation)
+}
+
+// locate set the position of a datapoint from the values returned by get. Latitude and longitude must be set
+// together, each part being optional.
+func (m geoMapping) locate(gts *core.GTS, get func(name string) (interface{}, bool)) error {
+	values := [3]*float64{}
+	for i, name := range []string{m.latitude, m.longitude, m.elevation} {
+		if name == "" {
+			continue
+		}
+		raw, ok := get(name)
+		if !ok {
+			continue
+		}
+		v, err := geoFloat(raw)
+		if err != nil {
+			return fmt.Errorf("invalid %s '%v'", name, raw)
+		}
+		values[i] = &v
+	}
+
+	lat, lon, elev := values[0], values[1], values[2]
+	if (lat == nil) != (lon == nil) {
+		return fmt.Errorf("latitude and longitude must be set together")
+	}
+
+	if lat != nil {
+		location := &core.Location{Lat: *lat, Lon: *lon}
+		if !location.Valid() {
+			return fmt.Errorf("location %v:%v out of range", *lat, *lon)
+		}
+		gts.Location = location
+	}
+
+	if elev != nil {
+		mm := math.Round(*elev * 1000)
+		if math.IsNaN(mm) || math.Abs(mm) > math.MaxInt64/2 {
+			return fmt.Errorf("elevation %v out of range", *elev)
+		}
+		e := int64(mm)
+		gts.Elevation = &e
+	}
+
+	return nil
+}
+
+// fromLabels set the position of a datapoint from its labels, removing them. The labels are copied when
+// updated since catalysers may share them between datapoints.
+func (m geoMapping) fromLabels(gts *core.GTS) error {
+	found := false
+	for name := range gts.Labels {
+		if m.has(name) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil
+	}
+
+	err := m.locate(gts, func(name string) (interface{}, bool) {
+		v, ok := gts.Labels[name]
+		return v, ok
+	})
+	if err != nil {
+		return err
+	}
+
+	labels := make(map[string]string, len(gts.Labels))
+	for k, v := range gts.Labels {
+		if !m.has(k) {
+			labels[k] = v
+		}
+	}
+	gts.Labels = labels
+
+	return nil
+}
+
+// geoFloat read a coordinate from a decoded number or a string
+func geoFloat(v interface{}) (float64, error) {
+	switch v := v.(type) {
+	case float64:
+		return v, nil
+	case int64:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	case json.Number:
+		return v.Float64()
+	case string:
+		return strconv.ParseFloat(v, 64)
+	}
+	return 0, fmt.Errorf("not a number")
+}
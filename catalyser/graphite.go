@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"net/http"
 	"net/url"
@@ -16,13 +17,26 @@ import (
 	"github.com/ovh/catalyst/core"
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 )
 
-// GraphiteHTTP returns a Graphite catalyser.
-func GraphiteHTTP(url *url.URL, header *http.Header, r io.Reader, send func([]byte) error, dpCounter prometheus.Counter) (int, int, error) {
-	dps := 0
+// NewGraphiteHTTP returns a Graphite catalyser applying the templates.
+func NewGraphiteHTTP(templates *GraphiteTemplates) core.CatalyserFunc {
+	geo := newGeoMapping("graphite")
+	return func(url *url.URL, header *http.Header, r io.Reader, emit core.Emit) (core.Reply, error) {
+		return graphiteHTTP(url, header, r, emit, templates, geo)
+	}
+}
+
+func graphiteHTTP(url *url.URL, header *http.Header, r io.Reader, emit core.Emit, templates *GraphiteTemplates, geo geoMapping) (core.Reply, error) {
 	txn := header.Get("X-App-Txn")
 
+	// Timestamps in seconds or milliseconds are guessed without precision
+	precision, err := parsePrecision(url.Query().Get("precision"))
+	if err != nil {
+		return core.Reply{}, core.NewParsingError(err.Error(), url.Query().Get("precision"))
+	}
+
 	// Get the stream in
 	scan := bufio.NewReader(r)
 	for {
@@ -30,7 +44,7 @@ func GraphiteHTTP(url *url.URL, header *http.Header, r io.Reader, send func([]by
 
 		// End case
 		if err == io.EOF {
-			return dps, http.StatusAccepted, nil
+			return core.Reply{Code: http.StatusAccepted}, nil
 		}
 
 		if err != nil {
@@ -39,12 +53,18 @@ func GraphiteHTTP(url *url.URL, header *http.Header, r io.Reader, send func([]by
 				"error": err,
 				"buf":   buf,
 			}).Info("unable to read HTTP payload")
-			return dps, http.StatusUnprocessableEntity, core.NewParsingError("unable to read HTTP payload", string(buf))
+			return core.Reply{}, core.NewParsingError("unable to read HTTP payload", string(buf))
 		}
 
 		linePayload := strings.TrimSpace(string(buf))
+		if linePayload == "" {
+			continue
+		}
 
-		datapoint, err := parseLine(linePayload, true)
+		datapoint, err := parseLine(linePayload, true, templates, precision)
+		if err == nil {
+			err = geo.fromLabels(datapoint)
+		}
 
 		if err != nil {
 			log.WithFields(log.Fields{
@@ -52,26 +72,26 @@ func GraphiteHTTP(url *url.URL, header *http.Header, r io.Reader, send func([]by
 				"error": err,
 				"buf":   buf,
 			}).Info("Failed to parse datapoint")
-			return dps, http.StatusUnprocessableEntity, core.NewParsingError("Failed to parse datapoint", linePayload)
+			return core.Reply{}, core.NewParsingError("Failed to parse datapoint: "+err.Error(), linePayload)
 		}
 
 		// Send to Warp
-		err = send(datapoint.Encode())
+		err = emit(datapoint)
 		if err != nil {
-			return dps, http.StatusInternalServerError, err
+			return core.Reply{}, err
 		}
 
 		log.Debug(datapoint)
-
-		dpCounter.Inc()
-		dps++
 	}
 }
 
 // Graphite is a Graphite socket who parse to sensision format
 type Graphite struct {
-	Listen string
-	Parse  bool
+	Listen    string
+	Parse     bool
+	Templates *GraphiteTemplates
+	// Precision is the unit of the timestamps, 0 to guess seconds or milliseconds
+	Precision time.Duration
 
 	ReqTCPCounter       prometheus.Counter
 	ReqTCPOKCounter     prometheus.Counter
@@ -79,13 +99,30 @@ type Graphite struct {
 	ReqTCPNoAuthCounter prometheus.Counter
 	ReqTCPdp            prometheus.Counter
 	ReqTimes            prometheus.Counter
+
+	pipeline *core.Pipeline
+	geo      geoMapping
 }
 
 // NewGraphite return a new Graphite initialized with his output chan
-func NewGraphite(listen string, p bool) *Graphite {
+func NewGraphite(listen string, p bool, templates *GraphiteTemplates) *Graphite {
+	pipeline, err := core.NewPipeline("graphite_tcp")
+	if err != nil {
+		log.WithError(err).Fatal("Invalid pipeline configuration")
+	}
+
+	precision, err := parsePrecision(viper.GetString("graphite.precision"))
+	if err != nil {
+		log.WithError(err).Fatal("Invalid graphite.precision")
+	}
+
 	graphite := &Graphite{
-		Listen: listen,
-		Parse:  p,
+		Listen:    listen,
+		Parse:     p,
+		Templates: templates,
+		Precision: precision,
+		pipeline:  pipeline,
+		geo:       newGeoMapping("graphite"),
 	}
 
 	graphite.ReqTCPCounter = prometheus.NewCounter(prometheus.CounterOpts{
@@ -182,8 +219,17 @@ func (g *Graphite) handleTCPConnection(conn net.Conn) {
 	g.ReqTCPCounter.Inc()
 	txn := fmt.Sprintf("%x", sha256.New().Sum(nil))
 	warp := &core.Warp{}
+	var in *core.Ingest
+	var emit core.Emit
 	now := time.Now()
 
+	// The new series count once the connection is closed, Warp 10 having stored the datapoints
+	defer func() {
+		if in != nil {
+			in.Rollback()
+		}
+	}()
+
 	defer func(txn string) {
 		if err := conn.Close(); err != nil {
 			log.WithFields(log.Fields{
@@ -216,6 +262,7 @@ func (g *Graphite) handleTCPConnection(conn net.Conn) {
 					g.ReqTimes.Add(elapsed)
 					return
 				}
+				in.Commit()
 			}
 			g.ReqTCPdp.Add(reqDp)
 			g.ReqTCPOKCounter.Inc()
@@ -264,6 +311,13 @@ func (g *Graphite) handleTCPConnection(conn net.Conn) {
 				}).Info("unable to open warp 10 connection")
 				return
 			}
+
+			in = &core.Ingest{
+				Route: g.pipeline.Route,
+				Token: splits[0],
+				Txn:   txn,
+			}
+			emit = g.pipeline.Emitter(in, warp)
 		}
 
 		if len(linePayload) <= tokenLength {
@@ -271,7 +325,10 @@ func (g *Graphite) handleTCPConnection(conn net.Conn) {
 		}
 
 		metric = linePayload[tokenLength:]
-		datapoint, err := parseLine(metric, g.Parse)
+		datapoint, err := parseLine(metric, g.Parse, g.Templates, g.Precision)
+		if err == nil {
+			err = g.geo.fromLabels(datapoint)
+		}
 
 		if err != nil {
 			log.WithFields(log.Fields{
@@ -284,7 +341,15 @@ func (g *Graphite) handleTCPConnection(conn net.Conn) {
 
 		// Send to Warp
 		if hasToken {
-			err = warp.Send(datapoint.Encode())
+			err = emit(datapoint)
+			if _, ok := err.(core.CardinalityExceeded); ok || core.Rejected(err) {
+				log.WithFields(log.Fields{
+					"error":  err,
+					"txn":    txn,
+					"metric": metric,
+				}).Info("datapoint rejected")
+				continue
+			}
 			if err != nil {
 				g.ReqTCPErrorCounter.Inc()
 				log.WithFields(log.Fields{
@@ -311,97 +376,136 @@ func (g *Graphite) OpenWarp(token string, txn string) (*core.Warp, error) {
 	return warp, nil
 }
 
-func parseLine(metric string, parse bool) (*core.GTS, error) {
-	split := strings.Split(metric, " ")
+// parseLine parse a Graphite plaintext line `path[;tag=value...] value [timestamp]` following the Graphite 1.1
+// tags specification, fields being separated by spaces or tabs
+func parseLine(metric string, parse bool, templates *GraphiteTemplates, precision time.Duration) (*core.GTS, error) {
+	split := strings.Fields(metric)
 
 	// Expected format is : 'metrics value [timestamp]'
-	if len(split) < 2 {
-		return nil, errors.New("Bad metric format")
+	if len(split) < 2 || len(split) > 3 {
+		return nil, fmt.Errorf("expected 'path value [timestamp]', got %d fields", len(split))
 	}
 
-	ts := time.Now().UnixNano() / 1000000
-
-	if len(split) >= 3 {
+	ts := core.Timestamp(time.Now())
+	if len(split) == 3 {
 		var err error
-		ts, err = strconv.ParseInt(split[2], 10, 64)
-		if err != nil {
-			return nil, errors.New("Bad metric part: timestamp")
+		if ts, err = parseGraphiteTimestamp(split[2], precision); err != nil {
+			return nil, err
 		}
 	}
 
-	var value interface{}
-	skip := false
+	dp := &core.GTS{
+		Ts:     ts,
+		Value:  parseGraphiteValue(split[1]),
+		Labels: make(map[string]string),
+	}
 
-	// try to convert the string into a float64
-	if strings.Contains(split[1], ".") {
-		number, err := strconv.ParseFloat(split[1], 64)
-		if err == nil {
-			skip = true
-			value = number
-		}
+	subSplit := strings.Split(split[0], ";")
+	dp.Name = subSplit[0]
+	if dp.Name == "" {
+		return nil, errors.New("empty metric path")
+	}
+	if len(subSplit) > 1 && strings.ContainsAny(dp.Name, "!^=") {
+		return nil, fmt.Errorf("metric path '%s' holds one of the ';!^=' characters", dp.Name)
 	}
 
-	// try to convert the string into an integer
-	if !skip {
-		number, err := strconv.ParseInt(split[1], 10, 64)
-		if err == nil {
-			skip = true
-			value = number
+	if class, labels, ok := templates.apply(dp.Name); ok {
+		// Templates name the class and labels from the hierarchy
+		dp.Name = class
+		dp.Labels = labels
+	} else if parse {
+		// If no tags, but auto fill enabled, we map the hierarchy for later by label processing purpose
+		classPart := strings.Split(subSplit[0], ".")
+		for idx, part := range classPart {
+			dp.Labels[strconv.Itoa(idx)] = part
 		}
 	}
 
-	// try to convert the string into a boolean
-	if !skip {
-		if strings.ToLower(split[1]) == "true" {
-			skip = true
-			value = true
-		} else if strings.ToLower(split[1]) == "false" {
-			skip = true
-			value = false
+	// Parse tags
+	for _, tag := range subSplit[1:] {
+		name, value, err := parseGraphiteTag(tag)
+		if err != nil {
+			return nil, err
 		}
+		dp.Labels[name] = value
 	}
 
-	// assume that the value is a string
-	if !skip {
-		value = split[1]
+	return dp, nil
+}
+
+// parseGraphiteTag parse a `tag=value` pair: names are not empty and hold none of `;!^=`, like the path of a
+// tagged series, values are not empty and do not start with `~`, name being the metric path
+func parseGraphiteTag(tag string) (string, string, error) {
+	i := strings.IndexByte(tag, '=')
+	if i < 0 {
+		return "", "", fmt.Errorf("tag '%s' is not a 'name=value' pair", tag)
 	}
 
-	dp := &core.GTS{
-		Ts:     float64(int64toTime(ts).UnixNano()) / 1000.0,
-		Value:  value,
-		Labels: make(map[string]string),
+	name, value := tag[:i], tag[i+1:]
+	if name == "" {
+		return "", "", fmt.Errorf("tag '%s' has an empty name", tag)
+	}
+	if strings.ContainsAny(name, "!^=") {
+		return "", "", fmt.Errorf("tag name '%s' holds one of the '!^=' characters", name)
+	}
+	if name == "name" {
+		return "", "", errors.New("tag 'name' is reserved to the metric path")
+	}
+	if value == "" {
+		return "", "", fmt.Errorf("tag '%s' has an empty value", name)
+	}
+	if strings.HasPrefix(value, "~") {
+		return "", "", fmt.Errorf("value of tag '%s' starts with the reserved '~' character", name)
 	}
 
-	// Check if there are tags
-	if strings.Contains(split[0], ";") {
-		subSplit := strings.Split(split[0], ";")
-		dp.Name = subSplit[0]
+	return name, value, nil
+}
 
-		// If no tags, but auto fill enabled, we map the hierarchy for later by label processing purpose
-		if parse {
-			classPart := strings.Split(subSplit[0], ".")
-			for idx, part := range classPart {
-				dp.Labels[strconv.Itoa(idx)] = part
-			}
-		}
+// parseGraphiteTimestamp returns a timestamp in the precision unit, or without precision in seconds or milliseconds
+// from 2^32, in platform time units. Fractional timestamps are allowed, -1 and N meaning now.
+func parseGraphiteTimestamp(s string, precision time.Duration) (int64, error) {
+	if s == "-1" || s == "N" {
+		return core.Timestamp(time.Now()), nil
+	}
 
-		// Parse tags
-		for _, v := range subSplit[1:] {
-			tagSplit := strings.Split(v, "=")
-			dp.Labels[tagSplit[0]] = tagSplit[1]
+	if ts, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if ts < 0 {
+			return 0, fmt.Errorf("negative timestamp '%s'", s)
 		}
+		return core.Timestamp(unitToTime(ts, precision)), nil
+	}
 
-	} else {
-		dp.Name = split[0]
+	ts, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(ts) || math.IsInf(ts, 0) {
+		return 0, fmt.Errorf("invalid timestamp '%s'", s)
+	}
+	if ts < 0 {
+		return 0, fmt.Errorf("negative timestamp '%s'", s)
+	}
+	if precision != 0 {
+		return core.SecondsTimestamp(ts * precision.Seconds()), nil
+	}
+	if ts < 0xFFFFFFFF {
+		return core.SecondsTimestamp(ts), nil
+	}
+	return core.SecondsTimestamp(ts / 1000), nil
+}
 
-		// If no tags, but auto fill enabled, we map the hierarchy for later by label processing purpose
-		if parse {
-			classPart := strings.Split(split[0], ".")
-			for idx, part := range classPart {
-				dp.Labels[strconv.Itoa(idx)] = part
-			}
-		}
+// parseGraphiteValue returns a value as an integer, a float, a boolean or else a string
+func parseGraphiteValue(s string) interface{} {
+	// try to convert the string into a number, keeping integers as such
+	if number, err := parseNumber(s); err == nil {
+		return number
 	}
 
-	return dp, nil
+	// try to convert the string into a boolean
+	switch strings.ToLower(s) {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+
+	// assume that the value is a string
+	return s
 }
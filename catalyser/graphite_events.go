@@ -0,0 +1,231 @@
+package catalyser
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/ovh/catalyst/core"
+)
+
+// graphiteEvent is a graphite-web event, the stored value being the event without its id and time
+type graphiteEvent struct {
+	ID   int64    `json:"id,omitempty"`
+	When int64    `json:"when,omitempty"`
+	What string   `json:"what"`
+	Tags []string `json:"tags"`
+	Data string   `json:"data"`
+}
+
+// graphiteEventInput is a posted event, tags being either a list or a space separated string
+type graphiteEventInput struct {
+	What string          `json:"what"`
+	Tags json.RawMessage `json:"tags"`
+	Data string          `json:"data"`
+	When *float64        `json:"when"`
+}
+
+// GraphiteEvents returns a Graphite events catalyser.
+func GraphiteEvents(u *url.URL, header *http.Header, reader io.Reader, emit core.Emit) (core.Reply, error) {
+	var in graphiteEventInput
+	if err := json.NewDecoder(reader).Decode(&in); err != nil {
+		return core.Reply{}, core.NewParsingError("Failed to parse event", err.Error())
+	}
+
+	gts, err := in.gts(time.Now())
+	if err != nil {
+		return core.Reply{}, core.NewParsingError("Invalid event", err.Error())
+	}
+
+	if err := emit(gts); err != nil {
+		return core.Reply{}, err
+	}
+
+	return core.Reply{Code: http.StatusOK, ContentType: echo.MIMEApplicationJSONCharsetUTF8, Body: `{"success":true}`}, nil
+}
+
+// gts validate an event and returns its GTS, each tag being a label
+func (in *graphiteEventInput) gts(now time.Time) (*core.GTS, error) {
+	if in.What == "" {
+		return nil, errors.New("missing what")
+	}
+
+	tags, err := parseGraphiteEventTags(in.Tags)
+	if err != nil {
+		return nil, err
+	}
+
+	ts := now
+	if in.When != nil {
+		if *in.When <= 0 || math.IsNaN(*in.When) || math.IsInf(*in.When, 0) {
+			return nil, errors.New("invalid when")
+		}
+		ts = time.Unix(0, int64(*in.When*float64(time.Second)))
+	}
+
+	value, err := json.Marshal(graphiteEvent{What: in.What, Tags: tags, Data: in.Data})
+	if err != nil {
+		return nil, err
+	}
+
+	// Events with the same tags and time are the same datapoint, the last one posted being kept
+	labels := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		labels[tag] = "true"
+	}
+
+	return &core.GTS{
+		Ts:     core.Timestamp(ts),
+		Name:   viper.GetString("graphite.events.class"),
+		Labels: labels,
+		Value:  string(value),
+	}, nil
+}
+
+// parseGraphiteEventTags parse event tags given as a list or a space separated string
+func parseGraphiteEventTags(raw json.RawMessage) ([]string, error) {
+	tags := []string{}
+	if len(raw) == 0 || string(raw) == "null" {
+		return tags, nil
+	}
+
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return append(tags, strings.Fields(s)...), nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, errors.New("tags must be a string or a list of strings")
+	}
+
+	for _, tag := range list {
+		tags = append(tags, strings.Fields(tag)...)
+	}
+
+	return tags, nil
+}
+
+// GraphiteEventsGet handle the events/get_data API
+func GraphiteEventsGet(c echo.Context) error {
+	req := c.Request()
+	_ = req.ParseForm()
+
+	token, err := core.GetToken(req)
+	if err != nil {
+		return c.String(http.StatusUnauthorized, err.Error())
+	}
+
+	now := time.Now()
+	from, err := parseGraphiteTime(req.Form.Get("from"), now.Add(-24*time.Hour), now)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	until, err := parseGraphiteTime(req.Form.Get("until"), now, now)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	tags := []string{}
+	for _, t := range req.Form["tags"] {
+		tags = append(tags, strings.Fields(t)...)
+	}
+
+	// Intersection is a single FETCH, union fetches each tag
+	selectors := []map[string]string{{}}
+	switch req.Form.Get("set_operation") {
+	case "", "intersection":
+		for _, tag := range tags {
+			selectors[0][tag] = "=true"
+		}
+	case "union":
+		if len(tags) > 0 {
+			selectors = selectors[:0]
+		}
+		for _, tag := range tags {
+			selectors = append(selectors, map[string]string{tag: "=true"})
+		}
+	default:
+		return c.String(http.StatusBadRequest, "invalid set_operation")
+	}
+
+	script := "[\n"
+	for _, labels := range selectors {
+		script += fmt.Sprintf("{ 'token' %s 'class' %s 'labels' %s 'start' %s 'end' %s } FETCH\n",
+			core.WarpScriptString(token),
+			core.WarpScriptString("="+viper.GetString("graphite.events.class")),
+			core.WarpScriptLabels(labels),
+			core.WarpScriptString(from.UTC().Format(time.RFC3339Nano)),
+			core.WarpScriptString(until.UTC().Format(time.RFC3339Nano)),
+		)
+	}
+	script += "] FLATTEN\n"
+
+	body, err := core.Exec("graphite", token, c.Get("txn").(string), script)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"txn": c.Get("txn"),
+		}).Warn("Failed to get Graphite events")
+		return c.String(core.ExecStatus(err), err.Error())
+	}
+
+	var stack [][]core.ExecGTS
+	if err := json.Unmarshal(body, &stack); err != nil || len(stack) != 1 {
+		return c.String(http.StatusBadGateway, "unexpected WarpScript result")
+	}
+
+	// A series matching several tags of a union is fetched several times
+	seen := map[string]bool{}
+	events := []graphiteEvent{}
+	for _, gts := range stack[0] {
+		key := graphiteEventSeriesKey(gts.Labels)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		for i := range gts.Values {
+			ts, value := gts.Point(i)
+			s, ok := value.(string)
+			if !ok {
+				continue
+			}
+
+			var e graphiteEvent
+			if err := json.Unmarshal([]byte(s), &e); err != nil {
+				continue
+			}
+			e.ID = ts
+			e.When = ts / core.UnitsPerSecond()
+			events = append(events, e)
+		}
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].ID < events[j].ID
+	})
+
+	return c.JSON(http.StatusOK, events)
+}
+
+// graphiteEventSeriesKey returns a key identifying a series of the events class
+func graphiteEventSeriesKey(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k, v := range labels {
+		keys = append(keys, k+"="+v)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, "\x00")
+}
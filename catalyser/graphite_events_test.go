@@ -0,0 +1,180 @@
+package catalyser
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/spf13/viper"
+)
+
+func TestGraphiteEventGTS(t *testing.T) {
+	viper.Set("graphite.events.class", "graphite.events")
+	now := time.Unix(1500000000, 0)
+
+	tests := []struct {
+		Got    string
+		Expect string
+		Err    bool
+	}{
+		{
+			`{"what": "deploy", "tags": "deploy prod", "data": "v1"}`,
+			`1500000000000000 map[deploy:true prod:true] {"what":"deploy","tags":["deploy","prod"],"data":"v1"}`,
+			false,
+		},
+		{
+			`{"what": "deploy", "tags": ["deploy", "prod web"], "when": 1400000000.5}`,
+			`1400000000500000 map[deploy:true prod:true web:true] {"what":"deploy","tags":["deploy","prod","web"],"data":""}`,
+			false,
+		},
+		{
+			`{"what": "deploy"}`,
+			`1500000000000000 map[] {"what":"deploy","tags":[],"data":""}`,
+			false,
+		},
+		{`{"tags": "deploy"}`, "", true},
+		{`{"what": "deploy", "when": -1}`, "", true},
+		{`{"what": "deploy", "when": 0}`, "", true},
+		{`{"what": "deploy", "tags": 42}`, "", true},
+	}
+
+	for _, test := range tests {
+		var in graphiteEventInput
+		if err := json.Unmarshal([]byte(test.Got), &in); err != nil {
+			t.Fatal(err)
+		}
+
+		gts, err := in.gts(now)
+		if test.Err {
+			if err == nil {
+				t.Errorf("expected an error for %s", test.Got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("unexpected error for %s: %v", test.Got, err)
+			continue
+		}
+
+		if got := fmt.Sprintf("%d %v %s", gts.Ts, gts.Labels, gts.Value); gts.Name != "graphite.events" || got != test.Expect {
+			t.Errorf("%s: expected %s, got %s", test.Got, test.Expect, got)
+		}
+	}
+}
+
+func TestParseGraphiteEventTags(t *testing.T) {
+	tests := []struct {
+		Got    string
+		Expect []string
+		Err    bool
+	}{
+		{``, []string{}, false},
+		{`null`, []string{}, false},
+		{`"deploy  prod"`, []string{"deploy", "prod"}, false},
+		{`["deploy", "prod web", ""]`, []string{"deploy", "prod", "web"}, false},
+		{`[1, 2]`, nil, true},
+		{`{"tag": "deploy"}`, nil, true},
+	}
+
+	for _, test := range tests {
+		tags, err := parseGraphiteEventTags(json.RawMessage(test.Got))
+		if test.Err {
+			if err == nil {
+				t.Errorf("expected an error for %s", test.Got)
+			}
+			continue
+		}
+
+		if err != nil || !reflect.DeepEqual(tags, test.Expect) {
+			t.Errorf("%s: expected %q, got %q %v", test.Got, test.Expect, tags, err)
+		}
+	}
+}
+
+func TestGraphiteEventsGet(t *testing.T) {
+	viper.Set("graphite.events.class", "graphite.events")
+
+	// The union fetches the series with both tags once per tag
+	event := `{"c":"graphite.events","l":{"deploy":"true","prod":"true"},"a":{},"v":[[1500000000000000,"{\"what\":\"deploy\",\"tags\":[\"deploy\",\"prod\"],\"data\":\"\"}"]]}`
+
+	tests := []struct {
+		Query  string
+		Result string
+		Script []string
+		Events int
+		Code   int
+	}{
+		{
+			"tags=deploy+prod",
+			"[[" + event + "]]",
+			[]string{"'labels' { 'deploy' '=true' 'prod' '=true' }"},
+			1,
+			http.StatusOK,
+		},
+		{
+			"tags=deploy&tags=prod&set_operation=union",
+			"[[" + event + "," + event + "]]",
+			[]string{"'labels' { 'deploy' '=true' }", "'labels' { 'prod' '=true' }"},
+			1,
+			http.StatusOK,
+		},
+		{
+			"set_operation=union",
+			"[[]]",
+			[]string{"'labels' { }"},
+			0,
+			http.StatusOK,
+		},
+		{"set_operation=xor", "", nil, 0, http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		var script string
+		setTestWarp(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			script = string(body)
+			_, _ = w.Write([]byte(test.Result))
+		})
+
+		req := httptest.NewRequest(http.MethodGet, "/graphite/events/get_data?"+test.Query, nil)
+		req.Header.Set("X-Warp10-Token", "token")
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+		c.Set("txn", "test")
+
+		if err := GraphiteEventsGet(c); err != nil {
+			t.Fatal(err)
+		}
+
+		if rec.Code != test.Code {
+			t.Errorf("%s: expected %d, got %d %s", test.Query, test.Code, rec.Code, rec.Body.String())
+			continue
+		}
+
+		if got := strings.Count(script, "FETCH"); got != len(test.Script) {
+			t.Errorf("%s: expected %d FETCH, got %d\n%s", test.Query, len(test.Script), got, script)
+		}
+		for _, expect := range test.Script {
+			if !strings.Contains(script, expect) {
+				t.Errorf("%s: expected %q in the script\n%s", test.Query, expect, script)
+			}
+		}
+
+		if test.Code != http.StatusOK {
+			continue
+		}
+
+		var events []graphiteEvent
+		if err := json.Unmarshal(rec.Body.Bytes(), &events); err != nil || len(events) != test.Events {
+			t.Errorf("%s: expected %d events, got %s", test.Query, test.Events, rec.Body.String())
+		}
+	}
+}
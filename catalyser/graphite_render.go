@@ -0,0 +1,613 @@
+package catalyser
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ovh/catalyst/core"
+)
+
+// graphiteNode is a parsed Graphite target expression
+type graphiteNode struct {
+	// Call is the function name, empty for literals and paths
+	Call string
+	Args []*graphiteNode
+
+	Path   string
+	String *string
+	Number *float64
+
+	// Text is the raw expression, used to name the resulting series
+	Text string
+}
+
+// graphiteSeries is a series of the render API
+type graphiteSeries struct {
+	Target     string            `json:"target"`
+	Tags       map[string]string `json:"tags"`
+	Datapoints [][2]interface{}  `json:"datapoints"`
+}
+
+// graphiteFindNode is a node of the metrics/find API using the treejson format
+type graphiteFindNode struct {
+	Text          string            `json:"text"`
+	ID            string            `json:"id"`
+	Leaf          int               `json:"leaf"`
+	Expandable    int               `json:"expandable"`
+	AllowChildren int               `json:"allowChildren"`
+	Context       map[string]string `json:"context"`
+}
+
+var graphiteRelativeTime = regexp.MustCompile(`^-(\d+)(s|sec|seconds?|min|minutes?|h|hours?|d|days?|w|weeks?|mon|months?|y|years?)$`)
+
+// GraphiteRender handle the /render API
+func GraphiteRender(c echo.Context) error {
+	req := c.Request()
+	_ = req.ParseForm()
+
+	token, err := core.GetToken(req)
+	if err != nil {
+		return c.String(http.StatusUnauthorized, err.Error())
+	}
+
+	now := time.Now()
+	from, err := parseGraphiteTime(req.Form.Get("from"), now.Add(-24*time.Hour), now)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	until, err := parseGraphiteTime(req.Form.Get("until"), now, now)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	maxDataPoints := 0
+	if mdp := req.Form.Get("maxDataPoints"); mdp != "" {
+		if maxDataPoints, err = strconv.Atoi(mdp); err != nil {
+			return c.String(http.StatusBadRequest, "invalid maxDataPoints")
+		}
+	}
+
+	targets := req.Form["target"]
+	if len(targets) == 0 {
+		return c.JSON(http.StatusOK, []graphiteSeries{})
+	}
+
+	script := "[\n"
+	for _, target := range targets {
+		node, err := parseGraphiteTarget(target)
+		if err != nil {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("invalid target %s: %v", target, err))
+		}
+
+		ws, err := graphiteWarpScript(node, token, from, until)
+		if err != nil {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("invalid target %s: %v", target, err))
+		}
+
+		script += ws
+		if maxDataPoints > 0 {
+			script += fmt.Sprintf(" %d LTTB", maxDataPoints)
+		}
+		script += "\n"
+	}
+	script += "] FLATTEN\n"
+
+	body, err := core.Exec("graphite", token, c.Get("txn").(string), script)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"txn": c.Get("txn"),
+		}).Warn("Failed to render Graphite targets")
+		return c.String(core.ExecStatus(err), err.Error())
+	}
+
+	var stack [][]core.ExecGTS
+	if err := json.Unmarshal(body, &stack); err != nil || len(stack) != 1 {
+		return c.String(http.StatusBadGateway, "unexpected WarpScript result")
+	}
+
+	series := make([]graphiteSeries, 0, len(stack[0]))
+	for _, gts := range stack[0] {
+		gts.Sort()
+
+		s := graphiteSeries{
+			Target:     gts.Class,
+			Tags:       map[string]string{"name": gts.Class},
+			Datapoints: make([][2]interface{}, len(gts.Values)),
+		}
+		for k, v := range gts.Labels {
+			s.Tags[k] = v
+		}
+
+		for i := range gts.Values {
+			ts, value := gts.Point(i)
+			if f, ok := value.(float64); ok && (math.IsNaN(f) || math.IsInf(f, 0)) {
+				value = nil
+			}
+			s.Datapoints[i] = [2]interface{}{value, ts / core.UnitsPerSecond()}
+		}
+		series = append(series, s)
+	}
+
+	return c.JSON(http.StatusOK, series)
+}
+
+// GraphiteFind handle the /metrics/find API
+func GraphiteFind(c echo.Context) error {
+	req := c.Request()
+	_ = req.ParseForm()
+
+	token, err := core.GetToken(req)
+	if err != nil {
+		return c.String(http.StatusUnauthorized, err.Error())
+	}
+
+	query := req.Form.Get("query")
+	if query == "" {
+		return c.String(http.StatusBadRequest, "missing query")
+	}
+
+	parts := splitGraphitePath(query)
+	labels := map[string]string{}
+	for idx, part := range parts {
+		labels[strconv.Itoa(idx)] = graphiteLabelSelector(part)
+	}
+
+	// Match the series at the query depth and deeper
+	class := "~^" + graphitePathRegexp(parts) + `(\..*)?$`
+	script := fmt.Sprintf("[ %s %s %s ] FIND\n", core.WarpScriptString(token), core.WarpScriptString(class), core.WarpScriptLabels(labels))
+
+	body, err := core.Exec("graphite", token, c.Get("txn").(string), script)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"txn": c.Get("txn"),
+		}).Warn("Failed to find Graphite metrics")
+		return c.String(core.ExecStatus(err), err.Error())
+	}
+
+	var stack [][]core.ExecGTS
+	if err := json.Unmarshal(body, &stack); err != nil || len(stack) != 1 {
+		return c.String(http.StatusBadGateway, "unexpected WarpScript result")
+	}
+
+	nodes := map[string]*graphiteFindNode{}
+	for _, gts := range stack[0] {
+		classParts := strings.Split(gts.Class, ".")
+		if len(classParts) < len(parts) {
+			continue
+		}
+
+		id := strings.Join(classParts[:len(parts)], ".")
+		node, ok := nodes[id]
+		if !ok {
+			node = &graphiteFindNode{
+				Text:    classParts[len(parts)-1],
+				ID:      id,
+				Context: map[string]string{},
+			}
+			nodes[id] = node
+		}
+
+		if len(classParts) == len(parts) {
+			node.Leaf = 1
+		} else {
+			node.Expandable = 1
+			node.AllowChildren = 1
+		}
+	}
+
+	ids := make([]string, 0, len(nodes))
+	for id := range nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	res := make([]*graphiteFindNode, len(ids))
+	for i, id := range ids {
+		res[i] = nodes[id]
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+// graphiteWarpScript translate a target into a WarpScript pushing a list of GTS
+func graphiteWarpScript(node *graphiteNode, token string, from, until time.Time) (string, error) {
+	if node.Path != "" {
+		parts := splitGraphitePath(node.Path)
+		labels := map[string]string{}
+		for idx, part := range parts {
+			labels[strconv.Itoa(idx)] = graphiteLabelSelector(part)
+		}
+
+		return fmt.Sprintf("{ 'token' %s 'class' %s 'labels' %s 'start' %s 'end' %s } FETCH",
+			core.WarpScriptString(token),
+			core.WarpScriptString("~^"+graphitePathRegexp(parts)+"$"),
+			core.WarpScriptLabels(labels),
+			core.WarpScriptString(from.UTC().Format(time.RFC3339Nano)),
+			core.WarpScriptString(until.UTC().Format(time.RFC3339Nano)),
+		), nil
+	}
+
+	if node.Call == "" {
+		return "", errors.New("expecting a series list")
+	}
+
+	// Compile the series arguments
+	series := []string{}
+	params := []*graphiteNode{}
+	for _, arg := range node.Args {
+		if arg.Path != "" || arg.Call != "" {
+			ws, err := graphiteWarpScript(arg, token, from, until)
+			if err != nil {
+				return "", err
+			}
+			series = append(series, ws)
+			continue
+		}
+		params = append(params, arg)
+	}
+
+	if len(series) == 0 {
+		return "", fmt.Errorf("%s expects a series list", node.Call)
+	}
+
+	input := series[0]
+	if len(series) > 1 {
+		input = fmt.Sprintf("[ %s ] FLATTEN", strings.Join(series, " "))
+	}
+
+	// rename the series to `fn(name,args)`
+	rename := func(args string) string {
+		return fmt.Sprintf("<%% DROP DUP NAME %s SWAP + %s + RENAME %%> LMAP",
+			core.WarpScriptString(node.Call+"("),
+			core.WarpScriptString(args+")"),
+		)
+	}
+
+	switch node.Call {
+	case "sumSeries", "sum", "averageSeries", "avg", "minSeries", "maxSeries":
+		reducer := map[string]string{
+			"sumSeries":     "reducer.sum",
+			"sum":           "reducer.sum",
+			"averageSeries": "reducer.mean",
+			"avg":           "reducer.mean",
+			"minSeries":     "reducer.min",
+			"maxSeries":     "reducer.max",
+		}[node.Call]
+
+		return fmt.Sprintf("[ %s [] %s ] REDUCE <%% DROP %s RENAME %%> LMAP", input, reducer, core.WarpScriptString(node.Text)), nil
+
+	case "scale", "offset":
+		f, err := graphiteNumberParam(node, params, 0)
+		if err != nil {
+			return "", err
+		}
+
+		mapper := "mapper.mul"
+		if node.Call == "offset" {
+			mapper = "mapper.add"
+		}
+
+		return fmt.Sprintf("[ %s %s %s 0 0 0 ] MAP %s", input, strconv.FormatFloat(f, 'g', -1, 64), mapper, rename(","+strconv.FormatFloat(f, 'g', -1, 64))), nil
+
+	case "absolute":
+		return fmt.Sprintf("[ %s mapper.abs 0 0 0 ] MAP %s", input, rename("")), nil
+
+	case "derivative":
+		return fmt.Sprintf("[ %s mapper.delta 1 0 0 ] MAP %s", input, rename("")), nil
+
+	case "nonNegativeDerivative":
+		if len(params) > 0 {
+			return "", errors.New("nonNegativeDerivative maxValue is not supported")
+		}
+
+		return fmt.Sprintf("[ [ %s mapper.delta 1 0 0 ] MAP 0 mapper.ge 0 0 0 ] MAP %s", input, rename("")), nil
+
+	case "alias":
+		if len(params) != 1 || params[0].String == nil {
+			return "", errors.New("alias expects a name")
+		}
+
+		return fmt.Sprintf("%s <%% DROP %s RENAME %%> LMAP", input, core.WarpScriptString(*params[0].String)), nil
+
+	case "aliasByNode":
+		if len(params) == 0 {
+			return "", errors.New("aliasByNode expects at least one node")
+		}
+
+		// Use the hierarchy labels set at ingestion
+		nodes := ""
+		for idx := range params {
+			n, err := graphiteNumberParam(node, params, idx)
+			if err != nil {
+				return "", err
+			}
+			nodes += fmt.Sprintf(" $labels %s GET", core.WarpScriptString(strconv.Itoa(int(n))))
+		}
+
+		return fmt.Sprintf("%s <%% DROP DUP LABELS 'labels' STORE [%s ] '.' JOIN RENAME %%> LMAP", input, nodes), nil
+
+	case "summarize":
+		if len(params) < 1 || params[0].String == nil {
+			return "", errors.New("summarize expects an interval")
+		}
+
+		span, err := parseGraphiteInterval(*params[0].String)
+		if err != nil {
+			return "", err
+		}
+
+		fn := "sum"
+		if len(params) > 1 && params[1].String != nil {
+			fn = *params[1].String
+		}
+
+		bucketizer, ok := map[string]string{
+			"sum":     "bucketizer.sum",
+			"total":   "bucketizer.sum",
+			"avg":     "bucketizer.mean",
+			"average": "bucketizer.mean",
+			"max":     "bucketizer.max",
+			"min":     "bucketizer.min",
+			"last":    "bucketizer.last",
+			"first":   "bucketizer.first",
+			"count":   "bucketizer.count",
+		}[fn]
+		if !ok {
+			return "", fmt.Errorf("unsupported summarize function: %s", fn)
+		}
+
+		return fmt.Sprintf("[ %s %s 0 %d 0 ] BUCKETIZE %s", input, bucketizer, core.Units(span),
+			rename(fmt.Sprintf(`,"%s","%s"`, *params[0].String, fn))), nil
+	}
+
+	return "", fmt.Errorf("unsupported function: %s", node.Call)
+}
+
+func graphiteNumberParam(node *graphiteNode, params []*graphiteNode, idx int) (float64, error) {
+	if len(params) <= idx || params[idx].Number == nil {
+		return 0, fmt.Errorf("%s expects a number as argument %d", node.Call, idx+2)
+	}
+	return *params[idx].Number, nil
+}
+
+// parseGraphiteTarget parse a render target such as `alias(sumSeries(servers.*.cpu), "cpu")`
+func parseGraphiteTarget(target string) (*graphiteNode, error) {
+	node, rest, err := parseGraphiteExpr(strings.TrimSpace(target))
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.TrimSpace(rest) != "" {
+		return nil, fmt.Errorf("unexpected '%s'", rest)
+	}
+
+	return node, nil
+}
+
+func parseGraphiteExpr(s string) (*graphiteNode, string, error) {
+	s = strings.TrimLeft(s, " \t")
+	if s == "" {
+		return nil, s, errors.New("unexpected end of target")
+	}
+
+	// String literal
+	if s[0] == '"' || s[0] == '\'' {
+		end := strings.IndexByte(s[1:], s[0])
+		if end < 0 {
+			return nil, s, errors.New("unterminated string")
+		}
+		str := s[1 : end+1]
+		return &graphiteNode{String: &str, Text: s[:end+2]}, s[end+2:], nil
+	}
+
+	// Read a path or a function name, commas are part of the path inside braces
+	depth := 0
+	i := 0
+loop:
+	for ; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case '(', ')', ' ', '\t':
+			if depth == 0 {
+				break loop
+			}
+		case ',':
+			if depth == 0 {
+				break loop
+			}
+		}
+	}
+
+	token := s[:i]
+	rest := s[i:]
+	if token == "" {
+		return nil, s, fmt.Errorf("unexpected '%s'", s)
+	}
+
+	if strings.HasPrefix(strings.TrimLeft(rest, " \t"), "(") {
+		rest = strings.TrimLeft(rest, " \t")[1:]
+		node := &graphiteNode{Call: token}
+
+		for {
+			rest = strings.TrimLeft(rest, " \t")
+			if strings.HasPrefix(rest, ")") {
+				rest = rest[1:]
+				break
+			}
+
+			arg, r, err := parseGraphiteExpr(rest)
+			if err != nil {
+				return nil, r, err
+			}
+			node.Args = append(node.Args, arg)
+
+			rest = strings.TrimLeft(r, " \t")
+			if strings.HasPrefix(rest, ",") {
+				rest = rest[1:]
+				continue
+			}
+			if !strings.HasPrefix(rest, ")") {
+				return nil, rest, fmt.Errorf("expecting ',' or ')' in %s", token)
+			}
+		}
+
+		node.Text = strings.TrimSpace(s[:len(s)-len(rest)])
+		return node, rest, nil
+	}
+
+	if f, err := strconv.ParseFloat(token, 64); err == nil {
+		return &graphiteNode{Number: &f, Text: token}, rest, nil
+	}
+
+	return &graphiteNode{Path: token, Text: token}, rest, nil
+}
+
+// splitGraphitePath split a path on dots outside of braces
+func splitGraphitePath(path string) []string {
+	parts := []string{}
+	depth := 0
+	start := 0
+	for i := 0; i < len(path); i++ {
+		switch path[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case '.':
+			if depth == 0 {
+				parts = append(parts, path[start:i])
+				start = i + 1
+			}
+		}
+	}
+
+	return append(parts, path[start:])
+}
+
+// graphiteGlobRegexp translate a glob node (*, ?, [...], {a,b}) into a regular expression
+func graphiteGlobRegexp(glob string) string {
+	var b strings.Builder
+	inClass := false
+	for _, r := range glob {
+		switch {
+		case inClass:
+			if r == ']' {
+				inClass = false
+			}
+			b.WriteRune(r)
+		case r == '*':
+			b.WriteString(`[^.]*`)
+		case r == '?':
+			b.WriteString(`[^.]`)
+		case r == '[':
+			inClass = true
+			b.WriteRune(r)
+		case r == '{':
+			b.WriteString("(?:")
+		case r == '}':
+			b.WriteString(")")
+		case r == ',':
+			b.WriteString("|")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+
+	return b.String()
+}
+
+func graphitePathRegexp(parts []string) string {
+	re := make([]string, len(parts))
+	for i, part := range parts {
+		re[i] = graphiteGlobRegexp(part)
+	}
+
+	return strings.Join(re, `\.`)
+}
+
+// graphiteLabelSelector returns the selector of an hierarchy label
+func graphiteLabelSelector(part string) string {
+	if strings.ContainsAny(part, "*?[{") {
+		return "~^" + graphiteGlobRegexp(part) + "$"
+	}
+	return "=" + part
+}
+
+// parseGraphiteTime parse the from/until parameters: now, -1h, unix timestamps, HH:MM_YYYYMMDD or YYYYMMDD
+func parseGraphiteTime(s string, def, now time.Time) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	switch s {
+	case "":
+		return def, nil
+	case "now":
+		return now, nil
+	}
+
+	if parts := graphiteRelativeTime.FindStringSubmatch(s); len(parts) == 3 {
+		d, err := parseGraphiteInterval(s[1:])
+		if err != nil {
+			return def, err
+		}
+		return now.Add(-d), nil
+	}
+
+	if ts, err := strconv.ParseInt(s, 10, 64); err == nil && len(s) != 8 {
+		return time.Unix(ts, 0), nil
+	}
+
+	for _, layout := range []string{"15:04_20060102", "20060102"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+
+	return def, fmt.Errorf("invalid time: %s", s)
+}
+
+// parseGraphiteInterval parse an interval such as 10min, 1h or 1d
+func parseGraphiteInterval(s string) (time.Duration, error) {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+
+	n, err := strconv.Atoi(s[:i])
+	if err != nil {
+		return 0, fmt.Errorf("invalid interval: %s", s)
+	}
+
+	unit := s[i:]
+	switch {
+	case unit == "s" || strings.HasPrefix(unit, "sec"):
+		return time.Duration(n) * time.Second, nil
+	case unit == "min" || strings.HasPrefix(unit, "minute"):
+		return time.Duration(n) * time.Minute, nil
+	case unit == "h" || strings.HasPrefix(unit, "hour"):
+		return time.Duration(n) * time.Hour, nil
+	case unit == "d" || strings.HasPrefix(unit, "day"):
+		return time.Duration(n) * 24 * time.Hour, nil
+	case unit == "w" || strings.HasPrefix(unit, "week"):
+		return time.Duration(n) * 7 * 24 * time.Hour, nil
+	case unit == "mon" || strings.HasPrefix(unit, "month"):
+		return time.Duration(n) * 30 * 24 * time.Hour, nil
+	case unit == "y" || strings.HasPrefix(unit, "year"):
+		return time.Duration(n) * 365 * 24 * time.Hour, nil
+	}
+
+	return 0, fmt.Errorf("invalid interval unit: %s", s)
+}
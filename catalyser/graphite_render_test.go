@@ -0,0 +1,120 @@
+package catalyser
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseGraphiteTarget(t *testing.T) {
+	tests := []struct {
+		Got    string
+		Expect []string
+		Err    bool
+	}{
+		{
+			"servers.*.cpu",
+			[]string{"FETCH", `'~^servers%5C.[^.]*%5C.cpu$'`, `'1' '~^[^.]*$'`},
+			false,
+		},
+		{
+			"servers.{web1,web2}.cpu",
+			[]string{`'~^servers%5C.(?:web1|web2)%5C.cpu$'`},
+			false,
+		},
+		{
+			`alias(sumSeries(servers.*.cpu), "cpu")`,
+			[]string{"reducer.sum", "'sumSeries(servers.*.cpu)' RENAME", "'cpu' RENAME"},
+			false,
+		},
+		{
+			"scale(servers.web1.cpu, 0.5)",
+			[]string{"0.5 mapper.mul"},
+			false,
+		},
+		{
+			`summarize(nonNegativeDerivative(servers.web1.net), "1h", "max")`,
+			[]string{"mapper.delta", "mapper.ge", "bucketizer.max 0 3600000000 0 ] BUCKETIZE"},
+			false,
+		},
+		{
+			"aliasByNode(servers.*.cpu, 1)",
+			[]string{"$labels '1' GET"},
+			false,
+		},
+		{
+			"unknownFunction(servers.*.cpu)",
+			nil,
+			true,
+		},
+		{
+			"sumSeries(servers.*.cpu",
+			nil,
+			true,
+		},
+	}
+
+	for _, test := range tests {
+		node, err := parseGraphiteTarget(test.Got)
+		if err == nil {
+			_, err = graphiteWarpScript(node, "token", time.Unix(0, 0), time.Unix(3600, 0))
+		}
+
+		if test.Err {
+			if err == nil {
+				t.Errorf("expected an error for %s", test.Got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("unexpected error for %s: %v", test.Got, err)
+			continue
+		}
+
+		ws, _ := graphiteWarpScript(node, "token", time.Unix(0, 0), time.Unix(3600, 0))
+		for _, expect := range test.Expect {
+			if !strings.Contains(ws, expect) {
+				t.Errorf("%s: expected %s in %s", test.Got, expect, ws)
+			}
+		}
+	}
+}
+
+func TestGraphiteFetch(t *testing.T) {
+	tests := map[string]string{
+		"servers.web1.cpu": `{ 'token' 'token' 'class' '~^servers%5C.web1%5C.cpu$' 'labels' { '0' '=servers' '1' '=web1' '2' '=cpu' } ` +
+			`'start' '1970-01-01T00:00:00Z' 'end' '1970-01-01T01:00:00Z' } FETCH`,
+		"servers.*.cpu": `{ 'token' 'token' 'class' '~^servers%5C.[^.]*%5C.cpu$' 'labels' { '0' '=servers' '1' '~^[^.]*$' '2' '=cpu' } ` +
+			`'start' '1970-01-01T00:00:00Z' 'end' '1970-01-01T01:00:00Z' } FETCH`,
+		"servers.{web1,web2}.cpu": `{ 'token' 'token' 'class' '~^servers%5C.(?:web1|web2)%5C.cpu$' 'labels' { '0' '=servers' '1' '~^(?:web1|web2)$' '2' '=cpu' } ` +
+			`'start' '1970-01-01T00:00:00Z' 'end' '1970-01-01T01:00:00Z' } FETCH`,
+	}
+
+	for target, expected := range tests {
+		node, err := parseGraphiteTarget(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ws, err := graphiteWarpScript(node, "token", time.Unix(0, 0), time.Unix(3600, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ws != expected {
+			t.Errorf("%s: got %s", target, ws)
+		}
+	}
+
+	selectors := map[string]string{
+		"web1":    "=web1",
+		"web?":    "~^web[^.]$",
+		"web[12]": "~^web[12]$",
+		"{a,b}-*": "~^(?:a|b)-[^.]*$",
+		"cpu+":    "=cpu+",
+	}
+	for part, expected := range selectors {
+		if got := graphiteLabelSelector(part); got != expected {
+			t.Errorf("%s: got selector %s, expected %s", part, got, expected)
+		}
+	}
+}
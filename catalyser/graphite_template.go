@@ -0,0 +1,200 @@
+package catalyser
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// GraphiteTemplates derive the class and labels of dotted Graphite paths, using InfluxDB style templates:
+// `[filter] template [default tags]`, such as `servers.* .host.measurement.field*`
+type GraphiteTemplates struct {
+	templates []*graphiteTemplate
+	fallback  *graphiteTemplate
+}
+
+// graphiteTemplate is a parsed template line
+type graphiteTemplate struct {
+	filter []string
+	parts  []string
+	tags   map[string]string
+}
+
+// NewGraphiteTemplates parse template lines, it returns nil without templates
+func NewGraphiteTemplates(lines []string) (*GraphiteTemplates, error) {
+	if len(lines) == 0 {
+		return nil, nil
+	}
+
+	t := &GraphiteTemplates{}
+	for _, line := range lines {
+		template, err := parseGraphiteTemplate(line)
+		if err != nil {
+			return nil, fmt.Errorf("graphite template '%s': %v", line, err)
+		}
+
+		if template.filter == nil {
+			if t.fallback != nil {
+				return nil, fmt.Errorf("graphite template '%s': duplicated default template", line)
+			}
+			t.fallback = template
+			continue
+		}
+		t.templates = append(t.templates, template)
+	}
+
+	return t, nil
+}
+
+func parseGraphiteTemplate(line string) (*graphiteTemplate, error) {
+	fields := strings.Fields(line)
+
+	var filter, template, tags string
+	switch len(fields) {
+	case 1:
+		template = fields[0]
+	case 2:
+		// The second field is either the template or the default tags
+		if strings.Contains(fields[1], "=") {
+			template, tags = fields[0], fields[1]
+		} else {
+			filter, template = fields[0], fields[1]
+		}
+	case 3:
+		filter, template, tags = fields[0], fields[1], fields[2]
+	default:
+		return nil, fmt.Errorf("expected [filter] template [tags]")
+	}
+
+	t := &graphiteTemplate{
+		parts: strings.Split(template, "."),
+		tags:  map[string]string{},
+	}
+
+	if filter != "" {
+		t.filter = strings.Split(filter, ".")
+		for _, node := range t.filter {
+			if _, err := path.Match(node, ""); err != nil {
+				return nil, fmt.Errorf("invalid filter node '%s'", node)
+			}
+		}
+	}
+
+	empty := true
+	for i, part := range t.parts {
+		if (part == "measurement*" || part == "field*") && i != len(t.parts)-1 {
+			return nil, fmt.Errorf("'%s' must be the last part", part)
+		}
+		if part != "" {
+			empty = false
+		}
+	}
+	if empty {
+		return nil, fmt.Errorf("empty template")
+	}
+
+	if tags != "" {
+		for _, tag := range strings.Split(tags, ",") {
+			kv := strings.SplitN(tag, "=", 2)
+			if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+				return nil, fmt.Errorf("invalid default tag '%s'", tag)
+			}
+			t.tags[kv[0]] = kv[1]
+		}
+	}
+
+	return t, nil
+}
+
+// match returns whether the filter of a template match the nodes of a path
+func (t *graphiteTemplate) match(nodes []string) bool {
+	if len(t.filter) > len(nodes) {
+		return false
+	}
+	for i, node := range t.filter {
+		if ok, _ := path.Match(node, nodes[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// moreSpecific returns whether the filter of t is more specific than the one of o: from the first node, a plain
+// node wins over a pattern which wins over `*`, then the longest filter wins
+func (t *graphiteTemplate) moreSpecific(o *graphiteTemplate) bool {
+	for i := 0; i < len(t.filter) && i < len(o.filter); i++ {
+		if rank, oRank := nodeRank(t.filter[i]), nodeRank(o.filter[i]); rank != oRank {
+			return rank > oRank
+		}
+	}
+	return len(t.filter) > len(o.filter)
+}
+
+func nodeRank(node string) int {
+	switch {
+	case node == "*":
+		return 0
+	case strings.ContainsAny(node, "*?["):
+		return 1
+	}
+	return 2
+}
+
+// apply the most specific template matching a path, it returns false when none match
+func (g *GraphiteTemplates) apply(name string) (string, map[string]string, bool) {
+	if g == nil {
+		return "", nil, false
+	}
+
+	nodes := strings.Split(name, ".")
+
+	template := g.fallback
+	for _, t := range g.templates {
+		if t.match(nodes) && (template == nil || template.filter == nil || t.moreSpecific(template)) {
+			template = t
+		}
+	}
+	if template == nil {
+		return "", nil, false
+	}
+
+	labels := make(map[string]string, len(template.tags))
+	for k, v := range template.tags {
+		labels[k] = v
+	}
+
+	var measurement, field []string
+	tags := map[string][]string{}
+
+	for i, part := range template.parts {
+		if i >= len(nodes) {
+			break
+		}
+
+		switch part {
+		case "":
+		case "measurement":
+			measurement = append(measurement, nodes[i])
+		case "measurement*":
+			measurement = append(measurement, nodes[i:]...)
+		case "field":
+			field = append(field, nodes[i])
+		case "field*":
+			field = append(field, nodes[i:]...)
+		default:
+			tags[part] = append(tags[part], nodes[i])
+		}
+	}
+
+	for k, v := range tags {
+		labels[k] = strings.Join(v, ".")
+	}
+
+	// The class is the measurement followed by the field, the whole path without both as with InfluxDB
+	class := strings.Join(append(measurement, field...), ".")
+	if class == "" {
+		class = name
+	}
+
+	return class, labels, true
+}
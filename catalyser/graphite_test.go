@@ -0,0 +1,150 @@
+package catalyser
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGraphiteTemplates(t *testing.T) {
+	templates, err := NewGraphiteTemplates([]string{
+		"servers.* .host.measurement.field*",
+		"servers.db* .host.role.measurement* env=prod",
+		"stats.*.counters measurement.measurement..field",
+		"..measurement* source=graphite",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		line   string
+		name   string
+		labels map[string]string
+	}{
+		{
+			line:   "servers.web01.cpu.user.total 1",
+			name:   "cpu.user.total",
+			labels: map[string]string{"host": "web01"},
+		},
+		{
+			line:   "servers.db01.primary.disk.used 1",
+			name:   "disk.used",
+			labels: map[string]string{"host": "db01", "role": "primary", "env": "prod"},
+		},
+		{
+			line:   "stats.app.counters.requests 1",
+			name:   "stats.app.requests",
+			labels: map[string]string{},
+		},
+		{
+			line:   "a.b.c.d;dc=gra 1",
+			name:   "c.d",
+			labels: map[string]string{"source": "graphite", "dc": "gra"},
+		},
+	}
+
+	for _, test := range tests {
+		dp, err := parseLine(test.line, true, templates, 0)
+		if err != nil {
+			t.Errorf("%s: %v", test.line, err)
+			continue
+		}
+		if dp.Name != test.name || !reflect.DeepEqual(dp.Labels, test.labels) {
+			t.Errorf("%s: got %s%v, expected %s%v", test.line, dp.Name, dp.Labels, test.name, test.labels)
+		}
+	}
+
+	for _, invalid := range [][]string{
+		{"a b c d"},
+		{"measurement*.host"},
+		{"measurement", "host.measurement"},
+		{"[a .measurement"},
+		{"a.b measurement env"},
+	} {
+		if _, err := NewGraphiteTemplates(invalid); err == nil {
+			t.Errorf("%v: expected an error", invalid)
+		}
+	}
+}
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		line   string
+		name   string
+		labels map[string]string
+		value  interface{}
+		ts     int64
+	}{
+		{
+			line:   "cpu.user;host=web01;dc=gra 12 1546420308",
+			name:   "cpu.user",
+			labels: map[string]string{"host": "web01", "dc": "gra"},
+			value:  int64(12),
+			ts:     1546420308000000,
+		},
+		{
+			line:   "cpu\t 1.5   1546420308.5",
+			name:   "cpu",
+			labels: map[string]string{},
+			value:  1.5,
+			ts:     1546420308500000,
+		},
+		{
+			line:   "cpu;path=/var/log;expr=a~b 1 1546420308000",
+			name:   "cpu",
+			labels: map[string]string{"path": "/var/log", "expr": "a~b"},
+			value:  int64(1),
+			ts:     1546420308000000,
+		},
+	}
+
+	for _, test := range tests {
+		dp, err := parseLine(test.line, false, nil, 0)
+		if err != nil {
+			t.Errorf("%s: %v", test.line, err)
+			continue
+		}
+		if dp.Name != test.name || !reflect.DeepEqual(dp.Labels, test.labels) || dp.Value != test.value || dp.Ts != test.ts {
+			t.Errorf("%s: got %+v", test.line, dp)
+		}
+	}
+
+	for _, now := range []string{"cpu 1 -1", "cpu 1 N", "cpu 1"} {
+		if dp, err := parseLine(now, false, nil, 0); err != nil || dp.Ts <= 0 {
+			t.Errorf("%s: got %+v, %v", now, dp, err)
+		}
+	}
+
+	// An explicit precision is not guessed from the magnitude
+	for precision, expected := range map[time.Duration]int64{
+		time.Second:      1546420308000000,
+		time.Millisecond: 1546420308000,
+		time.Nanosecond:  1546420,
+	} {
+		if dp, err := parseLine("cpu 1 1546420308", false, nil, precision); err != nil || dp.Ts != expected {
+			t.Errorf("%v: got %+v, %v", precision, dp, err)
+		}
+	}
+
+	for _, invalid := range []string{
+		"cpu",
+		"cpu 1 2 3",
+		"cpu;host 1",
+		"cpu;=web01 1",
+		"cpu;host= 1",
+		"cpu;ho!st=web01 1",
+		"cpu;host=~web01 1",
+		"cpu;name=mem 1",
+		";host=web01 1",
+		"cp=u;host=web01 1",
+		"cpu!;host=web01 1",
+		"cpu 1 -2",
+		"cpu 1 NaN",
+		"cpu 1 yesterday",
+	} {
+		if _, err := parseLine(invalid, true, nil, 0); err == nil {
+			t.Errorf("%s: expected an error", invalid)
+		}
+	}
+}
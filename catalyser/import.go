@@ -0,0 +1,319 @@
+package catalyser
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ovh/catalyst/core"
+)
+
+const (
+	influxDDLHeader              = "# DDL"
+	influxDMLHeader              = "# DML"
+	influxContextDatabase        = "# CONTEXT-DATABASE:"
+	influxContextRetentionPolicy = "# CONTEXT-RETENTION-POLICY:"
+
+	// importProgressInterval is the number of datapoints between two progress logs
+	importProgressInterval = 100000
+)
+
+// FileImport push an exported dump file into Warp 10
+type FileImport struct {
+	// Token is the Warp 10 write token
+	Token string
+	// Rate is the maximum number of datapoints sent per second, 0 means unlimited
+	Rate int
+	// BatchSize is the number of datapoints sent in a single Warp 10 request
+	BatchSize int
+	// DatabaseLabel and RetentionPolicyLabel are the labels set from the InfluxDB export context,
+	// an empty name disable the label
+	DatabaseLabel        string
+	RetentionPolicyLabel string
+	// Precision of the InfluxDB export timestamps
+	Precision string
+	// Pipeline the datapoints go through, none by default
+	Pipeline *core.Pipeline
+	// Mapping of the InfluxDB fields, measurement.field classes by default
+	Mapping *InfluxDBMapping
+
+	in      *core.Ingest
+	emit    core.Emit
+	warp    *core.Warp
+	batch   int
+	dps     int
+	started time.Time
+}
+
+// InfluxDB import an `influx_inspect export` dump, plain or gzipped
+func (i *FileImport) InfluxDB(r io.Reader) (dps int, err error) {
+	defer i.closeImport(&dps, &err)
+
+	precision := i.Precision
+	if precision == "" {
+		precision = "n"
+	}
+
+	scan, err := importScanner(r)
+	if err != nil {
+		return 0, err
+	}
+
+	database := ""
+	retentionPolicy := ""
+	ddl := false
+	line := 0
+	for scan.Scan() {
+		line++
+		row := strings.TrimSpace(scan.Text())
+
+		switch {
+		case row == "":
+			continue
+		case row == influxDDLHeader:
+			ddl = true
+			continue
+		case row == influxDMLHeader:
+			ddl = false
+			continue
+		case strings.HasPrefix(row, influxContextDatabase):
+			database = strings.TrimSpace(strings.TrimPrefix(row, influxContextDatabase))
+			continue
+		case strings.HasPrefix(row, influxContextRetentionPolicy):
+			retentionPolicy = strings.TrimSpace(strings.TrimPrefix(row, influxContextRetentionPolicy))
+			continue
+		case strings.HasPrefix(row, "#"), ddl:
+			// Comments and DDL statements (CREATE DATABASE, ...) are not relevant for Warp 10
+			continue
+		}
+
+		points, err := parseInflux([]byte(row), precision, i.Mapping.forToken(i.Token))
+		if err != nil {
+			return i.dps, core.NewParsingError(fmt.Sprintf("Failed to parse datapoint at line %d: %v", line, err), row)
+		}
+
+		for _, point := range points {
+			if i.DatabaseLabel != "" && database != "" {
+				point.Labels[i.DatabaseLabel] = database
+			}
+			if i.RetentionPolicyLabel != "" && retentionPolicy != "" {
+				point.Labels[i.RetentionPolicyLabel] = retentionPolicy
+			}
+
+			if err := i.send(&point); err != nil {
+				return i.dps, err
+			}
+		}
+	}
+
+	if err := scan.Err(); err != nil {
+		return i.dps, err
+	}
+
+	return i.dps, nil
+}
+
+// OpenTSDB import a `tsdb scan --import` dump, plain or gzipped
+func (i *FileImport) OpenTSDB(r io.Reader) (dps int, err error) {
+	defer i.closeImport(&dps, &err)
+
+	scan, err := importScanner(r)
+	if err != nil {
+		return 0, err
+	}
+
+	line := 0
+	for scan.Scan() {
+		line++
+		row := strings.TrimSpace(scan.Text())
+		if row == "" || strings.HasPrefix(row, "#") {
+			continue
+		}
+
+		gts, err := parseOpenTSDBLine(row)
+		if err != nil {
+			return i.dps, core.NewParsingError(fmt.Sprintf("Failed to parse datapoint at line %d: %v", line, err), row)
+		}
+
+		if err := i.send(gts); err != nil {
+			return i.dps, err
+		}
+	}
+
+	if err := scan.Err(); err != nil {
+		return i.dps, err
+	}
+
+	return i.dps, nil
+}
+
+// parseOpenTSDBLine parse a line using the OpenTSDB text format
+// [put] metric timestamp value tagk=tagv [tagk=tagv ...]
+func parseOpenTSDBLine(row string) (*core.GTS, error) {
+	fields := strings.Fields(row)
+	if len(fields) > 0 && fields[0] == "put" {
+		fields = fields[1:]
+	}
+
+	if len(fields) < 3 {
+		return nil, errors.New("expecting 'metric timestamp value [tags]'")
+	}
+
+	ts, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid timestamp")
+	}
+
+	var value interface{}
+	if v, err := strconv.ParseInt(fields[2], 10, 64); err == nil {
+		value = v
+	} else if v, err := strconv.ParseFloat(fields[2], 64); err == nil {
+		value = v
+	} else {
+		return nil, errors.New("invalid value")
+	}
+
+	labels := make(map[string]string, len(fields)-3)
+	for _, tag := range fields[3:] {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid tag: %s", tag)
+		}
+		labels[kv[0]] = kv[1]
+	}
+
+	return &core.GTS{
+		Ts:     core.Timestamp(int64toTime(ts)),
+		Name:   fields[0],
+		Labels: labels,
+		Value:  value,
+	}, nil
+}
+
+// send a datapoint through the pipeline
+func (i *FileImport) send(gts *core.GTS) error {
+	if i.started.IsZero() {
+		i.started = time.Now()
+	}
+
+	if i.emit == nil {
+		pipeline := i.Pipeline
+		if pipeline == nil {
+			pipeline = &core.Pipeline{Route: "import"}
+		}
+		i.in = &core.Ingest{
+			Route: pipeline.Route,
+			Token: i.Token,
+			Txn:   fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprintf("import%x", i.started.UnixNano())))),
+		}
+		i.emit = pipeline.Emitter(i.in, core.SinkFunc(i.write))
+	}
+
+	return i.emit(gts)
+}
+
+// write an encoded datapoint, rotating the Warp 10 connection every BatchSize datapoints
+// and waiting to stay under the configured rate
+func (i *FileImport) write(b []byte) error {
+	if i.warp == nil {
+		var err error
+		txn := fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprintf("import%d%x", i.dps, time.Now().UnixNano()))))
+		i.warp, err = core.NewWarp(i.Token, txn, "")
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := i.warp.Send(b); err != nil {
+		_ = i.warp.Close()
+		i.warp = nil
+		i.emit = nil
+		i.in.Rollback()
+		return err
+	}
+
+	i.dps++
+	i.batch++
+	if i.dps%importProgressInterval == 0 {
+		log.WithFields(log.Fields{
+			"datapoints": i.dps,
+			"rate":       fmt.Sprintf("%.0f dp/s", float64(i.dps)/time.Since(i.started).Seconds()),
+		}).Info("Import progress")
+	}
+
+	batchSize := i.BatchSize
+	if batchSize <= 0 {
+		batchSize = 100000
+	}
+	if i.batch >= batchSize {
+		if err := i.close(); err != nil {
+			return err
+		}
+	}
+
+	// Throttle
+	if i.Rate > 0 {
+		expected := time.Duration(float64(i.dps) / float64(i.Rate) * float64(time.Second))
+		if wait := expected - time.Since(i.started); wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+
+	return nil
+}
+
+// closeImport flush the last Warp 10 connection, on errors too so that the datapoints sent before are stored
+func (i *FileImport) closeImport(dps *int, err *error) {
+	if cerr := i.close(); *err == nil {
+		*err = cerr
+	}
+	*dps = i.dps
+}
+
+// close flush the current Warp 10 connection
+func (i *FileImport) close() error {
+	if i.warp == nil {
+		return nil
+	}
+
+	err := i.warp.Close()
+	i.warp = nil
+	i.batch = 0
+	if err != nil {
+		i.in.Rollback()
+	} else {
+		i.in.Commit()
+	}
+
+	// The next connection starts a new payload, which must not continue the series of this one
+	i.emit = nil
+	return err
+}
+
+// importScanner returns a line scanner, transparently handling gzip
+func importScanner(r io.Reader) (*bufio.Scanner, error) {
+	br := bufio.NewReader(r)
+
+	magic, err := br.Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, errors.New("failed to read gzip file")
+		}
+		r = gr
+	} else {
+		r = br
+	}
+
+	scan := bufio.NewScanner(r)
+	scan.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	return scan, nil
+}
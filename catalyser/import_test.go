@@ -0,0 +1,98 @@
+package catalyser
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ovh/catalyst/core"
+)
+
+func TestParseOpenTSDBLine(t *testing.T) {
+	tests := []struct {
+		row      string
+		expected core.GTS
+	}{
+		{
+			row:      "put sys.cpu.user 1356998400 42 host=web01 cpu=0",
+			expected: core.GTS{Ts: 1356998400000000, Name: "sys.cpu.user", Labels: map[string]string{"host": "web01", "cpu": "0"}, Value: int64(42)},
+		},
+		{
+			row:      "sys.cpu.user 1356998400500 42.5 host=web01",
+			expected: core.GTS{Ts: 1356998400500000, Name: "sys.cpu.user", Labels: map[string]string{"host": "web01"}, Value: 42.5},
+		},
+		{
+			row:      "sys.cpu.user 1356998400 -1",
+			expected: core.GTS{Ts: 1356998400000000, Name: "sys.cpu.user", Labels: map[string]string{}, Value: int64(-1)},
+		},
+	}
+
+	for _, test := range tests {
+		gts, err := parseOpenTSDBLine(test.row)
+		if err != nil {
+			t.Errorf("%s: %v", test.row, err)
+			continue
+		}
+		if !reflect.DeepEqual(*gts, test.expected) {
+			t.Errorf("%s: got %+v", test.row, *gts)
+		}
+	}
+
+	for _, invalid := range []string{
+		"put sys.cpu.user 1356998400",
+		"sys.cpu.user now 42",
+		"sys.cpu.user 1356998400 high",
+		"sys.cpu.user 1356998400 42 host",
+		"sys.cpu.user 1356998400 42 =web01",
+	} {
+		if _, err := parseOpenTSDBLine(invalid); err == nil {
+			t.Errorf("%s: expected an error", invalid)
+		}
+	}
+}
+
+func TestInfluxDBImport(t *testing.T) {
+	export := `# INFLUXDB EXPORT: 1677-09-21T00:12:43Z - 2262-04-11T23:47:16Z
+# DDL
+CREATE DATABASE telegraf WITH NAME autogen
+# DML
+# CONTEXT-DATABASE:telegraf
+# CONTEXT-RETENTION-POLICY:autogen
+# writing tsm data
+cpu,host=a usage=1 1434055562000000000
+
+# CONTEXT-DATABASE:app
+# CONTEXT-RETENTION-POLICY:weekly
+mem,host=a free=2i 1434055562000000000
+`
+
+	// The pipeline keeps the datapoints, nothing being sent to Warp 10
+	var got []string
+	keep := core.StageFunc(func(in *core.Ingest, gts *core.GTS, next core.Emit) error {
+		got = append(got, strings.TrimSpace(string(gts.Encode())))
+		return nil
+	})
+	importer := &FileImport{
+		DatabaseLabel:        "db",
+		RetentionPolicyLabel: "rp",
+		Pipeline:             &core.Pipeline{Route: "import", Stages: []core.Stage{keep}},
+	}
+
+	if _, err := importer.InfluxDB(strings.NewReader(export)); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"1434055562000000// cpu.usage{db=telegraf,host=a,rp=autogen} 1.0",
+		"1434055562000000// mem.free{db=app,host=a,rp=weekly} 2",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %q", got)
+	}
+
+	// Parse errors give the line
+	got = nil
+	_, err := importer.InfluxDB(strings.NewReader("# DML\ncpu,host=a usage=1\ncpu,host=a usage=\n"))
+	if perr, ok := err.(core.ParsingError); !ok || !strings.Contains(perr.Msg, "line 3") || len(got) != 1 {
+		t.Errorf("got %v after %q", err, got)
+	}
+}
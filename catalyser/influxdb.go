@@ -2,15 +2,19 @@ package catalyser
 
 import (
 	"bufio"
+	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"sort"
+	"strings"
 	"time"
 
 	influxModel "github.com/influxdata/influxdb/models"
 	"github.com/labstack/echo"
 	"github.com/ovh/catalyst/core"
-	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
 )
 
 const (
@@ -19,34 +23,150 @@ const (
 	metricAndFieldsSeparator = "."
 )
 
-// InfluxDB returns an InfluxDB catalyser.
-func InfluxDB(url *url.URL, header *http.Header, r io.Reader, send func([]byte) error, dpCounter prometheus.Counter) (int, int, error) {
-	dps := 0
+// influxMapping is the way the fields of an InfluxDB point are mapped to series
+type influxMapping struct {
+	// strategy is class (measurement.field), label (measurement{field=...}) or multivalue (measurement holding all the fields)
+	strategy   string
+	separator  string
+	fieldLabel string
+	// dbLabel and rpLabel are the labels set from the db and rp write parameters, an empty name disable the label
+	dbLabel string
+	rpLabel string
+	// geo names the fields or tags holding the position of the points
+	geo geoMapping
+}
+
+var defaultInfluxMapping = influxMapping{
+	strategy:   "class",
+	separator:  metricAndFieldsSeparator,
+	fieldLabel: "field",
+}
+
+// parseInfluxMapping read the mapping of conf, unset settings defaulting to def
+func parseInfluxMapping(conf map[string]interface{}, def influxMapping) (influxMapping, error) {
+	m := def
+	for key, setting := range map[string]*string{
+		"strategy":    &m.strategy,
+		"separator":   &m.separator,
+		"field_label": &m.fieldLabel,
+		"db_label":    &m.dbLabel,
+		"rp_label":    &m.rpLabel,
+	} {
+		if v, ok := conf[key]; ok {
+			*setting = cast.ToString(v)
+		}
+	}
+
+	switch m.strategy {
+	case "class", "multivalue":
+	case "label":
+		if m.fieldLabel == "" {
+			return m, fmt.Errorf("field_label is required with the label strategy")
+		}
+	default:
+		return m, fmt.Errorf("invalid strategy '%s'", m.strategy)
+	}
+
+	return m, nil
+}
+
+// InfluxDBMapping select how the InfluxDB points of a route are mapped to series, globally or by token
+type InfluxDBMapping struct {
+	global influxMapping
+	tokens map[string]influxMapping
+}
+
+// NewInfluxDBMapping build the mapping of a route from the `influxdb.mapping` configuration, the unsigned integers
+// of the `u` suffixed fields being kept from then on
+func NewInfluxDBMapping(route string) (*InfluxDBMapping, error) {
+	influxModel.EnableUintSupport()
+
+	global, err := parseInfluxMapping(cast.ToStringMap(viper.Get("influxdb.mapping")), defaultInfluxMapping)
+	if err != nil {
+		return nil, fmt.Errorf("influxdb.mapping: %v", err)
+	}
+
+	if global, err = parseInfluxMapping(cast.ToStringMap(core.RouteConfig("influxdb.mapping", route)), global); err != nil {
+		return nil, fmt.Errorf("influxdb.mapping.routes.%s: %v", route, err)
+	}
+
+	global.geo = newGeoMapping("influxdb")
+
+	m := &InfluxDBMapping{global: global, tokens: map[string]influxMapping{}}
+	err = core.ParseTokens("influxdb.mapping", func(token string, conf map[string]interface{}) (err error) {
+		m.tokens[token], err = parseInfluxMapping(conf, global)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// forToken returns the mapping of a token
+func (m *InfluxDBMapping) forToken(token string) influxMapping {
+	if m == nil {
+		return defaultInfluxMapping
+	}
+	if mapping, ok := m.tokens[token]; ok {
+		return mapping
+	}
+	return m.global
+}
+
+// NewInfluxDB returns an InfluxDB catalyser mapping the points with mapping.
+func NewInfluxDB(mapping *InfluxDBMapping) core.CatalyserFunc {
+	return func(url *url.URL, header *http.Header, r io.Reader, emit core.Emit) (core.Reply, error) {
+		token, _ := core.GetToken(&http.Request{URL: url, Header: *header})
+		return influxDB(url, r, emit, mapping.forToken(token))
+	}
+}
+
+func influxDB(url *url.URL, r io.Reader, emit core.Emit, mapping influxMapping) (core.Reply, error) {
 	precision := "n"
 	if queryPrecision := url.Query().Get("precision"); queryPrecision != "" {
 		precision = queryPrecision
 	}
 
+	// The database and retention policy of the write are set as labels when enabled
+	labels := map[string]string{}
+	if db := url.Query().Get("db"); mapping.dbLabel != "" && db != "" {
+		labels[mapping.dbLabel] = db
+	}
+	if rp := url.Query().Get("rp"); mapping.rpLabel != "" && rp != "" {
+		labels[mapping.rpLabel] = rp
+	}
+
 	// Get the stream in
 	scan := bufio.NewScanner(r)
-	var metric string
 	for scan.Scan() {
-		dp, err := parseInflux(scan.Bytes(), precision)
+		dp, err := parseInflux(scan.Bytes(), precision, mapping)
 		if err != nil {
-			return dps, -1, core.NewParsingError("Failed to parse datapoint", metric)
+			return core.Reply{}, core.NewParsingError("Failed to parse datapoint", scan.Text())
 		}
-		for _, point := range dp {
-			err = send(point.Encode())
-			if err != nil {
-				return dps, -1, err
+		for i := range dp {
+			for k, v := range labels {
+				dp[i].Labels[k] = v
 			}
 
-			dpCounter.Inc()
-			dps++
+			err = emit(&dp[i])
+			if err != nil {
+				return core.Reply{}, err
+			}
 		}
 	}
 
-	return dps, http.StatusNoContent, nil
+	return core.Reply{Code: http.StatusNoContent}, nil
+}
+
+// InfluxDBError answer the InfluxDB JSON error of rejected datapoints.
+func InfluxDBError(err error) error {
+	if core.Rejected(err) {
+		return core.InfluxDBParseError{Err: err.Error()}
+	}
+
+	return err
 }
 
 // HandlePing handle /ping call
@@ -56,7 +176,7 @@ func HandlePing(c echo.Context) error {
 	return c.NoContent(http.StatusNoContent)
 }
 
-func parseInflux(in []byte, precision string) ([]core.GTS, error) {
+func parseInflux(in []byte, precision string, mapping influxMapping) ([]core.GTS, error) {
 	gts := []core.GTS{}
 	// Use native InfluxDB parser
 	points, err := influxModel.ParsePointsWithPrecision([]byte(in), time.Now(), precision)
@@ -69,16 +189,94 @@ func parseInflux(in []byte, precision string) ([]core.GTS, error) {
 		if err != nil {
 			return nil, err
 		}
+		ts := core.Timestamp(point.Time())
 
-		for fieldName, fieldValue := range fields {
-			gts = append(gts, core.GTS{
-				Ts:     float64(point.Time().UnixNano() / 1e3),
-				Name:   string(point.Name()) + metricAndFieldsSeparator + fieldName,
-				Value:  fieldValue,
-				Labels: point.Tags().Map(),
+		// The position is read from the fields first, then from the tags
+		tags := point.Tags().Map()
+		position := core.GTS{}
+		if mapping.geo.enabled() {
+			err := mapping.geo.locate(&position, func(name string) (interface{}, bool) {
+				if v, ok := fields[name]; ok {
+					return v, true
+				}
+				v, ok := tags[name]
+				return v, ok
 			})
+			if err != nil {
+				return nil, err
+			}
+
+			for name := range fields {
+				if mapping.geo.has(name) {
+					delete(fields, name)
+				}
+			}
+			for name := range tags {
+				if mapping.geo.has(name) {
+					delete(tags, name)
+				}
+			}
+			if len(fields) == 0 {
+				continue
+			}
+		}
+
+		if mapping.strategy == "multivalue" {
+			dp := influxMultiValue(string(point.Name()), ts, tags, fields, mapping.fieldLabel)
+			dp.Location, dp.Elevation = position.Location, position.Elevation
+			gts = append(gts, dp)
+			continue
+		}
+
+		for fieldName, fieldValue := range fields {
+			labels := make(map[string]string, len(tags)+1)
+			for k, v := range tags {
+				labels[k] = v
+			}
+
+			dp := core.GTS{
+				Ts:        ts,
+				Name:      string(point.Name()) + mapping.separator + fieldName,
+				Value:     fieldValue,
+				Labels:    labels,
+				Location:  position.Location,
+				Elevation: position.Elevation,
+			}
+
+			if mapping.strategy == "label" {
+				dp.Name = string(point.Name())
+				dp.Labels[mapping.fieldLabel] = fieldName
+			}
+
+			gts = append(gts, dp)
 		}
 	}
 
 	return gts, nil
 }
+
+// influxMultiValue returns a datapoint holding the fields as a Warp 10 multivalue, ordered by name, the names
+// being set in the field label when enabled so that the positional values stay decodable
+func influxMultiValue(name string, ts int64, labels map[string]string, fields influxModel.Fields, fieldLabel string) core.GTS {
+	names := make([]string, 0, len(fields))
+	for field := range fields {
+		names = append(names, field)
+	}
+	sort.Strings(names)
+
+	values := make([]string, len(names))
+	for i, field := range names {
+		values[i] = core.EncodeValue(fields[field])
+	}
+
+	if fieldLabel != "" {
+		labels[fieldLabel] = strings.Join(names, ",")
+	}
+
+	return core.GTS{
+		Ts:     ts,
+		Name:   name,
+		Value:  core.RawValue("[ " + strings.Join(values, " ") + " ]"),
+		Labels: labels,
+	}
+}
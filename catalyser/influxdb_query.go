@@ -0,0 +1,827 @@
+package catalyser
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxql"
+	"github.com/labstack/echo"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ovh/catalyst/core"
+)
+
+const (
+	// influxDefaultDatabase is the database reported when the client does not select one
+	influxDefaultDatabase = "catalyst"
+	// influxMaxBuckets is the maximum number of GROUP BY time() buckets of a query
+	influxMaxBuckets = 100000
+)
+
+// influxAggregators maps the supported InfluxQL aggregates to Warp 10 bucketizers
+var influxAggregators = map[string]string{
+	"count":  "bucketizer.count",
+	"first":  "bucketizer.first",
+	"last":   "bucketizer.last",
+	"max":    "bucketizer.max",
+	"mean":   "bucketizer.mean",
+	"median": "bucketizer.median",
+	"min":    "bucketizer.min",
+	"sum":    "bucketizer.sum",
+}
+
+// influxResponse is the response of the /query API
+type influxResponse struct {
+	Results []influxResult `json:"results,omitempty"`
+	Error   string         `json:"error,omitempty"`
+}
+
+// influxResult is the result of a single statement
+type influxResult struct {
+	StatementID int            `json:"statement_id"`
+	Series      []influxSeries `json:"series,omitempty"`
+	Error       string         `json:"error,omitempty"`
+}
+
+// influxSeries is a series of a statement result
+type influxSeries struct {
+	Name    string            `json:"name,omitempty"`
+	Tags    map[string]string `json:"tags,omitempty"`
+	Columns []string          `json:"columns"`
+	Values  [][]interface{}   `json:"values,omitempty"`
+}
+
+// influxField is a field of a measurement, stored as the measurement.field class
+type influxField struct {
+	Measurement string
+	Field       string
+	Labels      map[string]string
+}
+
+// influxColumn is a selected field
+type influxColumn struct {
+	Name       string
+	Field      string
+	Bucketizer string
+}
+
+// influxQuery execute the statements of a query
+type influxQuery struct {
+	c     echo.Context
+	token string
+	db    string
+	epoch string
+	now   time.Time
+}
+
+// InfluxDBQuery handle the /query API
+func InfluxDBQuery(c echo.Context) error {
+	req := c.Request()
+	_ = req.ParseForm()
+
+	c.Response().Header().Set("X-Influxdb-Version", InfluxDBVersion)
+	c.Response().Header().Set("Request-Id", c.Get("txn").(string))
+
+	q, err := influxql.ParseQuery(req.Form.Get("q"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, influxResponse{Error: "error parsing query: " + err.Error()})
+	}
+
+	e := &influxQuery{
+		c:     c,
+		db:    req.Form.Get("db"),
+		epoch: req.Form.Get("epoch"),
+		now:   time.Now(),
+	}
+
+	// Statements which do not read from Warp 10 are answered without a token
+	e.token, _ = core.GetInfluxDBQueryToken(req)
+
+	res := influxResponse{Results: make([]influxResult, 0, len(q.Statements))}
+	for i, stmt := range q.Statements {
+		series, err := e.execute(stmt)
+		result := influxResult{StatementID: i, Series: series}
+		if err != nil {
+			if core.ExecStatus(err) == http.StatusUnauthorized {
+				return c.JSON(http.StatusUnauthorized, influxResponse{Error: err.Error()})
+			}
+			result.Error = err.Error()
+		}
+		res.Results = append(res.Results, result)
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+func (e *influxQuery) execute(stmt influxql.Statement) ([]influxSeries, error) {
+	switch stmt := stmt.(type) {
+	case *influxql.CreateDatabaseStatement:
+		// Warp 10 has no databases, series are created on write
+		return nil, nil
+
+	case *influxql.ShowDatabasesStatement:
+		db := e.db
+		if db == "" {
+			db = influxDefaultDatabase
+		}
+		return []influxSeries{{Name: "databases", Columns: []string{"name"}, Values: [][]interface{}{{db}}}}, nil
+
+	case *influxql.ShowMeasurementsStatement:
+		return e.showMeasurements(stmt)
+
+	case *influxql.ShowTagKeysStatement:
+		return e.showTagKeys(stmt)
+
+	case *influxql.ShowTagValuesStatement:
+		return e.showTagValues(stmt)
+
+	case *influxql.ShowFieldKeysStatement:
+		return e.showFieldKeys(stmt)
+
+	case *influxql.SelectStatement:
+		return e.selectSeries(stmt)
+	}
+
+	return nil, fmt.Errorf("statement not supported: %s", stmt)
+}
+
+func (e *influxQuery) showMeasurements(stmt *influxql.ShowMeasurementsStatement) ([]influxSeries, error) {
+	sources := influxql.Sources{}
+	if stmt.Source != nil {
+		sources = append(sources, stmt.Source)
+	}
+
+	fields, err := e.find(sources, stmt.Condition)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	names := []string{}
+	for _, f := range fields {
+		if !seen[f.Measurement] {
+			seen[f.Measurement] = true
+			names = append(names, f.Measurement)
+		}
+	}
+	sort.Strings(names)
+
+	values := make([][]interface{}, 0, len(names))
+	for _, name := range names {
+		values = append(values, []interface{}{name})
+	}
+
+	values = influxPage(values, stmt.Limit, stmt.Offset)
+	if len(values) == 0 {
+		return nil, nil
+	}
+	return []influxSeries{{Name: "measurements", Columns: []string{"name"}, Values: values}}, nil
+}
+
+func (e *influxQuery) showTagKeys(stmt *influxql.ShowTagKeysStatement) ([]influxSeries, error) {
+	fields, err := e.find(stmt.Sources, stmt.Condition)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := influxRows{}
+	for _, f := range fields {
+		for k := range f.Labels {
+			rows.add(f.Measurement, k)
+		}
+	}
+
+	return rows.series([]string{"tagKey"}, stmt.Limit, stmt.Offset), nil
+}
+
+func (e *influxQuery) showTagValues(stmt *influxql.ShowTagValuesStatement) ([]influxSeries, error) {
+	fields, err := e.find(stmt.Sources, stmt.Condition)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := influxRows{}
+	for _, f := range fields {
+		for k, v := range f.Labels {
+			match, err := influxMatchKey(stmt.Op, stmt.TagKeyExpr, k)
+			if err != nil {
+				return nil, err
+			}
+			if match {
+				rows.add(f.Measurement, k, v)
+			}
+		}
+	}
+
+	return rows.series([]string{"key", "value"}, stmt.Limit, stmt.Offset), nil
+}
+
+func (e *influxQuery) showFieldKeys(stmt *influxql.ShowFieldKeysStatement) ([]influxSeries, error) {
+	fields, err := e.find(stmt.Sources, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Warp 10 values are not typed per series, report the InfluxDB default type
+	rows := influxRows{}
+	for _, f := range fields {
+		rows.add(f.Measurement, f.Field, "float")
+	}
+
+	return rows.series([]string{"fieldKey", "fieldType"}, stmt.Limit, stmt.Offset), nil
+}
+
+func (e *influxQuery) selectSeries(stmt *influxql.SelectStatement) ([]influxSeries, error) {
+	if len(stmt.Sources) != 1 {
+		return nil, errors.New("only a single measurement is supported in FROM")
+	}
+
+	m, ok := stmt.Sources[0].(*influxql.Measurement)
+	if !ok || m.Regex != nil {
+		return nil, errors.New("only a measurement name is supported in FROM")
+	}
+
+	cond, tr, err := influxql.ConditionExpr(stmt.Condition, &influxql.NowValuer{Now: e.now})
+	if err != nil {
+		return nil, err
+	}
+
+	labels, err := influxLabelSelectors(cond)
+	if err != nil {
+		return nil, err
+	}
+
+	interval, err := stmt.GroupByInterval()
+	if err != nil {
+		return nil, err
+	}
+
+	offset, err := stmt.GroupByOffset()
+	if err != nil {
+		return nil, err
+	}
+
+	tags := []string{}
+	for _, d := range stmt.Dimensions {
+		switch expr := d.Expr.(type) {
+		case *influxql.Call:
+			if expr.Name != "time" {
+				return nil, fmt.Errorf("unsupported GROUP BY: %s", expr)
+			}
+		case *influxql.VarRef:
+			tags = append(tags, expr.Val)
+		default:
+			return nil, fmt.Errorf("unsupported GROUP BY: %s", expr)
+		}
+	}
+
+	columns := make([]influxColumn, 0, len(stmt.Fields))
+	aggregate := false
+	for i, f := range stmt.Fields {
+		column := influxColumn{Name: f.Name()}
+
+		switch expr := f.Expr.(type) {
+		case *influxql.VarRef:
+			column.Field = expr.Val
+
+		case *influxql.Call:
+			bucketizer, ok := influxAggregators[strings.ToLower(expr.Name)]
+			if !ok {
+				return nil, fmt.Errorf("unsupported function: %s", expr.Name)
+			}
+
+			if len(expr.Args) != 1 {
+				return nil, fmt.Errorf("invalid number of arguments for %s", expr.Name)
+			}
+
+			ref, ok := expr.Args[0].(*influxql.VarRef)
+			if !ok {
+				return nil, fmt.Errorf("expected field argument in %s", expr)
+			}
+
+			column.Field = ref.Val
+			column.Bucketizer = bucketizer
+
+		default:
+			return nil, fmt.Errorf("unsupported field: %s", expr)
+		}
+
+		if i > 0 && aggregate != (column.Bucketizer != "") {
+			return nil, errors.New("mixing aggregate and non-aggregate queries is not supported")
+		}
+		aggregate = column.Bucketizer != ""
+		columns = append(columns, column)
+	}
+
+	if interval != 0 && !aggregate {
+		return nil, errors.New("GROUP BY requires at least one aggregate function")
+	}
+
+	if interval != 0 && tr.Min.IsZero() {
+		return nil, errors.New("aggregate functions with GROUP BY time require a WHERE time clause")
+	}
+
+	if stmt.Fill == influxql.LinearFill {
+		return nil, errors.New("fill(linear) is not supported")
+	}
+
+	start, end := tr.Min, tr.Max
+	if start.IsZero() {
+		start = time.Unix(0, 0)
+	}
+	if end.IsZero() {
+		end = e.now
+	}
+	if start.After(end) {
+		return nil, nil
+	}
+
+	// Buckets are aligned on the interval as in InfluxDB, their timestamp being their start in platform time units
+	var first, last, span int64
+	if aggregate {
+		startTs, endTs := core.Timestamp(start), core.Timestamp(end)
+		if interval == 0 {
+			first, last, span = startTs, startTs, endTs-startTs+1
+		} else {
+			span = core.Units(interval)
+			o := core.Units(offset)
+			first = influxFloor(startTs-o, span) + o
+			last = influxFloor(endTs-o, span) + o
+		}
+
+		if (last-first)/span+1 > influxMaxBuckets {
+			return nil, fmt.Errorf("too many buckets, the maximum is %d", influxMaxBuckets)
+		}
+	}
+
+	by := "["
+	for _, tag := range tags {
+		by += " " + core.WarpScriptString(tag)
+	}
+	by += " ]"
+
+	script := "[\n"
+	for _, column := range columns {
+		// Merge the series of each group before aggregating them, as InfluxDB does
+		script += fmt.Sprintf("{ 'token' %s 'class' %s 'labels' %s 'start' %s 'end' %s } FETCH %s PARTITION VALUES <%% DROP MERGE DUP LABELS %s SUBMAP 'labels' STORE { NULL NULL } RELABEL $labels RELABEL %%> LMAP",
+			core.WarpScriptString(e.token),
+			core.WarpScriptString("="+m.Name+metricAndFieldsSeparator+column.Field),
+			core.WarpScriptLabels(labels),
+			core.WarpScriptString(start.UTC().Format(time.RFC3339Nano)),
+			core.WarpScriptString(end.UTC().Format(time.RFC3339Nano)),
+			by, by)
+
+		if aggregate {
+			script += fmt.Sprintf(" [ SWAP %s %d %d %d ] BUCKETIZE", column.Bucketizer, last+span-1, span, (last-first)/span+1)
+		}
+		script += "\n"
+	}
+	script += "]\n"
+
+	var results [][]core.ExecGTS
+	if err := e.exec(script, &results); err != nil {
+		return nil, err
+	}
+
+	groups := map[string]*influxGroup{}
+	keys := []string{}
+	for i, gtss := range results {
+		if i >= len(columns) {
+			break
+		}
+
+		for _, gts := range gtss {
+			key := influxTagsKey(gts.Labels)
+			g, ok := groups[key]
+			if !ok {
+				g = &influxGroup{tags: map[string]string{}, rows: map[int64][]interface{}{}}
+				for _, tag := range tags {
+					g.tags[tag] = gts.Labels[tag]
+				}
+				groups[key] = g
+				keys = append(keys, key)
+			}
+
+			for j := range gts.Values {
+				ts, value := gts.Point(j)
+				if aggregate {
+					ts = ts - span + 1
+				}
+
+				row, ok := g.rows[ts]
+				if !ok {
+					row = make([]interface{}, len(columns))
+					g.rows[ts] = row
+				}
+				row[i] = value
+			}
+		}
+	}
+	sort.Strings(keys)
+	keys = influxPageKeys(keys, stmt.SLimit, stmt.SOffset)
+
+	names := []string{"time"}
+	for _, column := range columns {
+		names = append(names, column.Name)
+	}
+
+	series := make([]influxSeries, 0, len(keys))
+	for _, key := range keys {
+		g := groups[key]
+
+		timestamps := []int64{}
+		if aggregate && stmt.Fill != influxql.NoFill {
+			for ts := first; ts <= last; ts += span {
+				timestamps = append(timestamps, ts)
+			}
+		} else {
+			for ts := range g.rows {
+				timestamps = append(timestamps, ts)
+			}
+			sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+		}
+
+		previous := make([]interface{}, len(columns))
+		values := make([][]interface{}, 0, len(timestamps))
+		for _, ts := range timestamps {
+			row := g.rows[ts]
+			if row == nil {
+				row = make([]interface{}, len(columns))
+			}
+
+			value := []interface{}{e.time(ts)}
+			for i, v := range row {
+				if v == nil && aggregate {
+					switch stmt.Fill {
+					case influxql.NumberFill:
+						v = stmt.FillValue
+					case influxql.PreviousFill:
+						v = previous[i]
+					}
+				}
+				previous[i] = v
+				value = append(value, v)
+			}
+			values = append(values, value)
+		}
+
+		if !stmt.TimeAscending() {
+			for i, j := 0, len(values)-1; i < j; i, j = i+1, j-1 {
+				values[i], values[j] = values[j], values[i]
+			}
+		}
+
+		values = influxPage(values, stmt.Limit, stmt.Offset)
+		if len(values) == 0 {
+			continue
+		}
+
+		s := influxSeries{Name: m.Name, Columns: names, Values: values}
+		if len(tags) > 0 {
+			s.Tags = g.tags
+		}
+		series = append(series, s)
+	}
+
+	return series, nil
+}
+
+// find returns the fields of the measurements matching sources and the tags condition
+func (e *influxQuery) find(sources influxql.Sources, cond influxql.Expr) ([]influxField, error) {
+	cond, _, err := influxql.ConditionExpr(cond, &influxql.NowValuer{Now: e.now})
+	if err != nil {
+		return nil, err
+	}
+
+	labels, err := influxLabelSelectors(cond)
+	if err != nil {
+		return nil, err
+	}
+
+	class := `~.+\.[^.]+`
+	if len(sources) == 1 {
+		if m, ok := sources[0].(*influxql.Measurement); ok && m.Regex == nil {
+			class = "~" + regexp.QuoteMeta(m.Name) + `\.[^.]+`
+		}
+	}
+
+	script := fmt.Sprintf("[ %s %s %s ] FIND\n", core.WarpScriptString(e.token), core.WarpScriptString(class), core.WarpScriptLabels(labels))
+
+	var gtss []core.ExecGTS
+	if err := e.exec(script, &gtss); err != nil {
+		return nil, err
+	}
+
+	fields := make([]influxField, 0, len(gtss))
+	for _, gts := range gtss {
+		i := strings.LastIndex(gts.Class, metricAndFieldsSeparator)
+		if i <= 0 {
+			continue
+		}
+
+		f := influxField{
+			Measurement: gts.Class[:i],
+			Field:       gts.Class[i+len(metricAndFieldsSeparator):],
+			Labels:      gts.Labels,
+		}
+		if influxMatchSources(sources, f.Measurement) {
+			fields = append(fields, f)
+		}
+	}
+
+	return fields, nil
+}
+
+// exec run a script expecting a single element on the stack, decoded into result
+func (e *influxQuery) exec(script string, result interface{}) error {
+	if e.token == "" {
+		return core.WarpInvalidToken{}
+	}
+
+	body, err := core.Exec("influxdb", e.token, e.c.Get("txn").(string), script)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"txn": e.c.Get("txn"),
+		}).Warn("Failed to execute InfluxQL query")
+		return err
+	}
+
+	var stack []json.RawMessage
+	if err := json.Unmarshal(body, &stack); err != nil || len(stack) != 1 {
+		return errors.New("unexpected WarpScript result")
+	}
+
+	if err := json.Unmarshal(stack[0], result); err != nil {
+		return fmt.Errorf("unexpected WarpScript result: %v", err)
+	}
+
+	return nil
+}
+
+// time format a timestamp in platform time units according to the epoch parameter
+func (e *influxQuery) time(ts int64) interface{} {
+	t := core.Time(ts)
+	switch e.epoch {
+	case "ns":
+		return t.UnixNano()
+	case "u", "µ":
+		return t.UnixNano() / int64(time.Microsecond)
+	case "ms":
+		return t.UnixNano() / int64(time.Millisecond)
+	case "s":
+		return t.Unix()
+	case "m":
+		return t.Unix() / 60
+	case "h":
+		return t.Unix() / 3600
+	}
+
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// influxGroup is a GROUP BY tags group
+type influxGroup struct {
+	tags map[string]string
+	rows map[int64][]interface{}
+}
+
+// influxRows collects the distinct rows of the SHOW statements by measurement
+type influxRows map[string]map[string][]interface{}
+
+func (r influxRows) add(measurement string, values ...string) {
+	if r[measurement] == nil {
+		r[measurement] = map[string][]interface{}{}
+	}
+
+	row := make([]interface{}, len(values))
+	for i, v := range values {
+		row[i] = v
+	}
+	r[measurement][strings.Join(values, "\x00")] = row
+}
+
+func (r influxRows) series(columns []string, limit, offset int) []influxSeries {
+	measurements := make([]string, 0, len(r))
+	for m := range r {
+		measurements = append(measurements, m)
+	}
+	sort.Strings(measurements)
+
+	series := make([]influxSeries, 0, len(measurements))
+	for _, m := range measurements {
+		keys := make([]string, 0, len(r[m]))
+		for k := range r[m] {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		values := make([][]interface{}, 0, len(keys))
+		for _, k := range keys {
+			values = append(values, r[m][k])
+		}
+
+		values = influxPage(values, limit, offset)
+		if len(values) > 0 {
+			series = append(series, influxSeries{Name: m, Columns: columns, Values: values})
+		}
+	}
+
+	return series
+}
+
+// influxLabelSelectors returns the Warp 10 labels selectors of a tags condition
+func influxLabelSelectors(cond influxql.Expr) (map[string]string, error) {
+	regexps := map[string][]string{}
+	exact := map[string]string{}
+
+	var walk func(expr influxql.Expr) error
+	walk = func(expr influxql.Expr) error {
+		switch expr := expr.(type) {
+		case nil:
+			return nil
+
+		case *influxql.ParenExpr:
+			return walk(expr.Expr)
+
+		case *influxql.BinaryExpr:
+			if expr.Op == influxql.AND {
+				if err := walk(expr.LHS); err != nil {
+					return err
+				}
+				return walk(expr.RHS)
+			}
+
+			ref, ok := expr.LHS.(*influxql.VarRef)
+			if !ok {
+				break
+			}
+
+			re := ""
+			switch v := expr.RHS.(type) {
+			case *influxql.StringLiteral:
+				if v.Val == "" {
+					return fmt.Errorf("matching on empty tag values is not supported: %s", expr)
+				}
+
+				switch expr.Op {
+				case influxql.EQ:
+					re = regexp.QuoteMeta(v.Val)
+					exact[ref.Val] = v.Val
+				case influxql.NEQ:
+					re = "(?!" + regexp.QuoteMeta(v.Val) + "$).*"
+				}
+
+			case *influxql.RegexLiteral:
+				// InfluxDB regular expressions are not anchored
+				switch expr.Op {
+				case influxql.EQREGEX:
+					re = ".*(?:" + v.Val.String() + ").*"
+				case influxql.NEQREGEX:
+					re = "(?!.*(?:" + v.Val.String() + ")).*"
+				}
+			}
+
+			if re == "" {
+				break
+			}
+			regexps[ref.Val] = append(regexps[ref.Val], re)
+			return nil
+		}
+
+		return fmt.Errorf("unsupported condition: %s", expr)
+	}
+
+	if err := walk(cond); err != nil {
+		return nil, err
+	}
+
+	labels := map[string]string{}
+	for name, res := range regexps {
+		if v, ok := exact[name]; ok && len(res) == 1 {
+			labels[name] = "=" + v
+			continue
+		}
+
+		if len(res) == 1 {
+			labels[name] = "~" + res[0]
+			continue
+		}
+
+		selector := "~"
+		for _, re := range res {
+			selector += "(?=" + re + "$)"
+		}
+		labels[name] = selector + ".*"
+	}
+
+	return labels, nil
+}
+
+// influxMatchSources returns whether a measurement is selected by sources, no sources selecting all of them
+func influxMatchSources(sources influxql.Sources, measurement string) bool {
+	if len(sources) == 0 {
+		return true
+	}
+
+	for _, source := range sources {
+		m, ok := source.(*influxql.Measurement)
+		if !ok {
+			continue
+		}
+
+		if m.Regex != nil && m.Regex.Val.MatchString(measurement) {
+			return true
+		}
+		if m.Regex == nil && m.Name == measurement {
+			return true
+		}
+	}
+
+	return false
+}
+
+// influxMatchKey returns whether a tag key matches the WITH KEY clause
+func influxMatchKey(op influxql.Token, expr influxql.Literal, key string) (bool, error) {
+	switch lit := expr.(type) {
+	case *influxql.StringLiteral:
+		switch op {
+		case influxql.EQ:
+			return lit.Val == key, nil
+		case influxql.NEQ:
+			return lit.Val != key, nil
+		}
+
+	case *influxql.ListLiteral:
+		if op == influxql.IN {
+			for _, v := range lit.Vals {
+				if v == key {
+					return true, nil
+				}
+			}
+			return false, nil
+		}
+
+	case *influxql.RegexLiteral:
+		switch op {
+		case influxql.EQREGEX:
+			return lit.Val.MatchString(key), nil
+		case influxql.NEQREGEX:
+			return !lit.Val.MatchString(key), nil
+		}
+	}
+
+	return false, fmt.Errorf("unsupported WITH KEY clause: %s %s", op, expr)
+}
+
+func influxTagsKey(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	key := ""
+	for _, k := range keys {
+		key += k + "=" + tags[k] + ","
+	}
+	return key
+}
+
+func influxPage(values [][]interface{}, limit, offset int) [][]interface{} {
+	if offset >= len(values) {
+		return nil
+	}
+	values = values[offset:]
+
+	if limit > 0 && limit < len(values) {
+		values = values[:limit]
+	}
+	return values
+}
+
+func influxPageKeys(keys []string, limit, offset int) []string {
+	if offset >= len(keys) {
+		return nil
+	}
+	keys = keys[offset:]
+
+	if limit > 0 && limit < len(keys) {
+		keys = keys[:limit]
+	}
+	return keys
+}
+
+// influxFloor returns the largest multiple of d lower or equal to v
+func influxFloor(v, d int64) int64 {
+	r := v % d
+	if r < 0 {
+		r += d
+	}
+	return v - r
+}
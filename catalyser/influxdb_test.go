@@ -2,7 +2,19 @@ package catalyser
 
 import (
 	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/influxdata/influxql"
+	"github.com/labstack/echo"
+	"github.com/ovh/catalyst/core"
 )
 
 func TestParseInflux(t *testing.T) {
@@ -72,12 +84,19 @@ func TestParseInflux(t *testing.T) {
 
 	for _, test := range tests {
 		fmt.Println("testing ", test.Got)
-		gts, err := parseInflux([]byte(test.Got), "n")
+		gts, err := parseInflux([]byte(test.Got), "n", defaultInfluxMapping)
 		if err != nil {
 			t.Error(err)
 		}
-		if gts[0].Name != test.ExpectClassname {
-			t.Error("Wrong classname for ", gts[0].Name)
+		// Fields are not ordered
+		var expected *core.GTS
+		for i := range gts {
+			if gts[i].Name == test.ExpectClassname {
+				expected = &gts[i]
+			}
+		}
+		if expected == nil {
+			t.Fatal("Missing classname ", test.ExpectClassname)
 		}
 
 		for _, singleGTS := range gts {
@@ -86,7 +105,7 @@ func TestParseInflux(t *testing.T) {
 
 		fmt.Println("=======")
 
-		labels := gts[0].Labels
+		labels := expected.Labels
 		for labelKey, labelValue := range labels {
 			if test.ExpectLabels[labelKey] != labelValue {
 				t.Errorf("label %v is wrong, expected %v, got %v", labelKey, labelValue, test.ExpectLabels[labelKey])
@@ -96,3 +115,317 @@ func TestParseInflux(t *testing.T) {
 	}
 
 }
+
+func TestInfluxMapping(t *testing.T) {
+	line := []byte("cpu,host=a usage_idle=90.5,usage_user=2i,busy=true 1434055562000000000")
+
+	type series struct {
+		name   string
+		labels map[string]string
+		value  string
+	}
+
+	tests := []struct {
+		conf     map[string]interface{}
+		expected []series
+	}{
+		{
+			conf: map[string]interface{}{"separator": "_"},
+			expected: []series{
+				{"cpu_busy", map[string]string{"host": "a"}, "T"},
+				{"cpu_usage_idle", map[string]string{"host": "a"}, "90.5"},
+				{"cpu_usage_user", map[string]string{"host": "a"}, "2"},
+			},
+		},
+		{
+			conf: map[string]interface{}{"strategy": "label"},
+			expected: []series{
+				{"cpu", map[string]string{"host": "a", "field": "busy"}, "T"},
+				{"cpu", map[string]string{"host": "a", "field": "usage_idle"}, "90.5"},
+				{"cpu", map[string]string{"host": "a", "field": "usage_user"}, "2"},
+			},
+		},
+		{
+			conf: map[string]interface{}{"strategy": "multivalue", "field_label": "fields"},
+			expected: []series{
+				{"cpu", map[string]string{"host": "a", "fields": "busy,usage_idle,usage_user"}, "[ T 90.5 2 ]"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		mapping, err := parseInfluxMapping(test.conf, defaultInfluxMapping)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		gts, err := parseInflux(line, "n", mapping)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(gts) != len(test.expected) {
+			t.Fatalf("%v: got %d datapoints", test.conf, len(gts))
+		}
+
+		sort.Slice(gts, func(i, j int) bool { return string(gts[i].Encode()) < string(gts[j].Encode()) })
+		for i, expected := range test.expected {
+			got := series{gts[i].Name, gts[i].Labels, core.EncodeValue(gts[i].Value)}
+			if !reflect.DeepEqual(got, expected) {
+				t.Errorf("%v: got %+v, expected %+v", test.conf, got, expected)
+			}
+		}
+	}
+
+	// Points with different fields are different multivalue series, their values being decodable by position
+	mapping, _ := parseInfluxMapping(map[string]interface{}{"strategy": "multivalue"}, defaultInfluxMapping)
+	for line, expected := range map[string]series{
+		"cpu,host=a usage_idle=90 1":              {"cpu", map[string]string{"host": "a", "field": "usage_idle"}, "[ 90.0 ]"},
+		"cpu,host=a usage_user=2,usage_idle=90 1": {"cpu", map[string]string{"host": "a", "field": "usage_idle,usage_user"}, "[ 90.0 2.0 ]"},
+	} {
+		gts, err := parseInflux([]byte(line), "n", mapping)
+		if err != nil || len(gts) != 1 {
+			t.Fatalf("%s: got %v, %v", line, gts, err)
+		}
+		if got := (series{gts[0].Name, gts[0].Labels, fmt.Sprint(gts[0].Value)}); !reflect.DeepEqual(got, expected) || len(gts[0].Attributes) != 0 {
+			t.Errorf("%s: expected %v, got %v %v", line, expected, got, gts[0].Attributes)
+		}
+	}
+
+	// Unsigned integers are kept once a mapping is built
+	built, err := NewInfluxDBMapping("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gts, err := parseInflux([]byte("cpu count=18446744073709551615u 1"), "n", built.forToken("")); err != nil || len(gts) != 1 || gts[0].Value != uint64(math.MaxUint64) {
+		t.Errorf("got %v, %v", gts, err)
+	}
+
+	for _, invalid := range []map[string]interface{}{
+		{"strategy": "unknown"},
+		{"strategy": "label", "field_label": ""},
+	} {
+		if _, err := parseInfluxMapping(invalid, defaultInfluxMapping); err == nil {
+			t.Errorf("%v: expected an error", invalid)
+		}
+	}
+}
+
+func TestInfluxGeo(t *testing.T) {
+	mapping := defaultInfluxMapping
+	mapping.geo = geoMapping{latitude: "lat", longitude: "lon", elevation: "alt"}
+
+	gts, err := parseInflux([]byte("temp,sensor=s1,alt=35.5 lat=48.85,lon=2.35,value=21.5 1434055562000000000"), "n", mapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gts) != 1 {
+		t.Fatalf("got %d datapoints", len(gts))
+	}
+
+	dp := gts[0]
+	if dp.Name != "temp.value" || !reflect.DeepEqual(dp.Labels, map[string]string{"sensor": "s1"}) {
+		t.Errorf("got %s%v", dp.Name, dp.Labels)
+	}
+	if dp.Location == nil || *dp.Location != (core.Location{Lat: 48.85, Lon: 2.35}) || dp.Elevation == nil || *dp.Elevation != 35500 {
+		t.Errorf("got position %v/%v", dp.Location, dp.Elevation)
+	}
+
+	for _, invalid := range []string{
+		"temp lat=48.85,value=1",
+		"temp lat=91,lon=0,value=1",
+		"temp,lon=east lat=48.85,value=1",
+	} {
+		if _, err := parseInflux([]byte(invalid), "n", mapping); err == nil {
+			t.Errorf("%s: expected an error", invalid)
+		}
+	}
+
+	// Labels shared between datapoints are left unchanged
+	labels := map[string]string{"lat": "-33.5", "lon": "-70.25", "host": "a"}
+	dp = core.GTS{Labels: labels}
+	if err := mapping.geo.fromLabels(&dp); err != nil {
+		t.Fatal(err)
+	}
+	if len(labels) != 3 || !reflect.DeepEqual(dp.Labels, map[string]string{"host": "a"}) || dp.Location == nil || dp.Elevation != nil {
+		t.Errorf("got %v %v", dp.Labels, dp.Location)
+	}
+}
+
+func TestInfluxLabelSelectors(t *testing.T) {
+	tests := []struct {
+		Got    string
+		Expect map[string]string
+		Err    bool
+	}{
+		{
+			`host = 'a' AND time > now() - 1h`,
+			map[string]string{"host": "=a"},
+			false,
+		},
+		{
+			`host =~ /^web/ AND dc != 'gra'`,
+			map[string]string{"host": "~.*(?:^web).*", "dc": "~(?!gra$).*"},
+			false,
+		},
+		{
+			`host = 'a' AND host !~ /b/`,
+			map[string]string{"host": "~(?=a$)(?=(?!.*(?:b)).*$).*"},
+			false,
+		},
+		{
+			`host = 'a' OR host = 'b'`,
+			nil,
+			true,
+		},
+		{
+			`value > 5`,
+			nil,
+			true,
+		},
+	}
+
+	for _, test := range tests {
+		cond, err := influxql.ParseExpr(test.Got)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cond, _, err = influxql.ConditionExpr(cond, &influxql.NowValuer{Now: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		labels, err := influxLabelSelectors(cond)
+		if test.Err {
+			if err == nil {
+				t.Errorf("expected an error for %s", test.Got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("unexpected error for %s: %v", test.Got, err)
+			continue
+		}
+
+		if fmt.Sprint(labels) != fmt.Sprint(test.Expect) {
+			t.Errorf("%s: expected %v, got %v", test.Got, test.Expect, labels)
+		}
+	}
+}
+
+func TestInfluxSelectSeries(t *testing.T) {
+	// 2020-01-01T00:00:00Z, in microseconds, buckets being aligned on 20s from it
+	const t0 = int64(1577836800)
+	us := func(s int64) int64 { return (t0 + s) * 1000000 }
+	where := `WHERE time >= '2020-01-01T00:00:07Z' AND time < '2020-01-01T00:01:00Z'`
+
+	// The buckets of GROUP BY time(20s, 5s) start at 5s, 25s and 45s, Warp 10 timestamping them at their end
+	buckets := fmt.Sprintf(`[[[{"c":"cpu.value","l":{"host":"a"},"a":{},"v":[[%d,1],[%d,3]]}]]]`, us(25)-1, us(65)-1)
+	hosts := fmt.Sprintf(`[[[{"c":"cpu.value","l":{"host":"a"},"a":{},"v":[[%d,1]]},{"c":"cpu.value","l":{"host":"b"},"a":{},"v":[[%d,2]]}]]]`, us(25)-1, us(25)-1)
+	raw := fmt.Sprintf(`[[[{"c":"cpu.value","l":{"host":"a"},"a":{},"v":[[%d,1],[%d,2],[%d,3]]}]]]`, us(1), us(2), us(3))
+
+	tests := []struct {
+		Query  string
+		Result string
+		Script []string
+		Expect string
+	}{
+		{
+			`SELECT mean(value) FROM cpu ` + where + ` GROUP BY time(20s, 5s)`,
+			buckets,
+			[]string{
+				`'class' '=cpu.value'`,
+				fmt.Sprintf(" [ SWAP bucketizer.mean %d %d %d ] BUCKETIZE", us(65)-1, 20000000, 3),
+			},
+			fmt.Sprintf("map[] [[%d 1] [%d <nil>] [%d 3]]", t0+5, t0+25, t0+45),
+		},
+		{
+			`SELECT mean(value) FROM cpu ` + where + ` GROUP BY time(20s, 5s) fill(0)`,
+			buckets,
+			nil,
+			fmt.Sprintf("map[] [[%d 1] [%d 0] [%d 3]]", t0+5, t0+25, t0+45),
+		},
+		{
+			`SELECT mean(value) FROM cpu ` + where + ` GROUP BY time(20s, 5s) fill(previous)`,
+			buckets,
+			nil,
+			fmt.Sprintf("map[] [[%d 1] [%d 1] [%d 3]]", t0+5, t0+25, t0+45),
+		},
+		{
+			`SELECT mean(value) FROM cpu ` + where + ` GROUP BY time(20s, 5s) fill(none)`,
+			buckets,
+			nil,
+			fmt.Sprintf("map[] [[%d 1] [%d 3]]", t0+5, t0+45),
+		},
+		{
+			`SELECT mean(value) FROM cpu ` + where + ` GROUP BY time(20s, 5s) ORDER BY time DESC`,
+			buckets,
+			nil,
+			fmt.Sprintf("map[] [[%d 3] [%d <nil>] [%d 1]]", t0+45, t0+25, t0+5),
+		},
+		{
+			`SELECT mean(value) FROM cpu ` + where + ` GROUP BY time(20s, 5s) LIMIT 1 OFFSET 1`,
+			buckets,
+			nil,
+			fmt.Sprintf("map[] [[%d <nil>]]", t0+25),
+		},
+		{
+			// Without GROUP BY time, a single bucket spans the whole time range
+			`SELECT max(value) FROM cpu ` + where,
+			fmt.Sprintf(`[[[{"c":"cpu.value","l":{},"a":{},"v":[[%d,3]]}]]]`, us(60)-1),
+			[]string{fmt.Sprintf(" [ SWAP bucketizer.max %d %d 1 ] BUCKETIZE", us(60)-1, us(60)-us(7))},
+			fmt.Sprintf("map[] [[%d 3]]", t0+7),
+		},
+		{
+			`SELECT mean(value) FROM cpu ` + where + ` GROUP BY time(20s, 5s), host fill(none) SLIMIT 1 SOFFSET 1`,
+			hosts,
+			[]string{`PARTITION VALUES <% DROP MERGE DUP LABELS [ 'host' ] SUBMAP`},
+			fmt.Sprintf("map[host:b] [[%d 2]]", t0+5),
+		},
+		{
+			`SELECT value FROM cpu WHERE host = 'a'`,
+			raw,
+			[]string{`'class' '=cpu.value' 'labels' { 'host' '=a' }`},
+			fmt.Sprintf("map[] [[%d 1] [%d 2] [%d 3]]", t0+1, t0+2, t0+3),
+		},
+	}
+
+	for _, test := range tests {
+		var script string
+		setTestWarp(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			script = string(body)
+			_, _ = w.Write([]byte(test.Result))
+		})
+
+		stmt, err := influxql.ParseStatement(test.Query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/influxdb/query", nil), httptest.NewRecorder())
+		c.Set("txn", "test")
+		e := &influxQuery{c: c, token: "token", epoch: "s", now: time.Unix(t0+3600, 0)}
+
+		series, err := e.selectSeries(stmt.(*influxql.SelectStatement))
+		if err != nil {
+			t.Errorf("%s: %v", test.Query, err)
+			continue
+		}
+
+		for _, expect := range test.Script {
+			if !strings.Contains(script, expect) {
+				t.Errorf("%s: expected %q in the script\n%s", test.Query, expect, script)
+			}
+		}
+
+		got := ""
+		for _, s := range series {
+			got += fmt.Sprint(s.Tags, s.Values)
+		}
+		if got != test.Expect {
+			t.Errorf("%s: expected %s, got %s", test.Query, test.Expect, got)
+		}
+	}
+}
@@ -1,17 +1,15 @@
 package catalyser
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
 	"time"
 
-	"github.com/prometheus/client_golang/prometheus"
-
 	"github.com/ovh/catalyst/core"
 )
 
@@ -28,99 +26,99 @@ type dataPoint struct {
 }
 
 // OpenTSDB returns an OpenTSDB catalyser.
-func OpenTSDB(url *url.URL, header *http.Header, reader io.Reader, send func([]byte) error, dpCounter prometheus.Counter) (int, int, error) {
-	dps := 0
-
-	r := bufio.NewReader(reader)
-
-	// check input format
-	solo := true
-	for {
-		head, err := r.Peek(1)
-		if err != nil {
-			if err != io.EOF {
-				return dps, -1, core.NewParsingError("Failed to parse datapoint - EOF", "")
-			}
-			return dps, -1, err
-		}
-
-		i := bytes.Index(head, []byte("["))
-		j := bytes.Index(head, []byte("{"))
-		if i < 0 && j < 0 {
-			_, _ = r.Discard(1)
-			continue
-		} else {
-			if j < 0 || (j < i) {
-				solo = false
-			}
-			break
-		}
+func OpenTSDB(url *url.URL, header *http.Header, reader io.Reader, emit core.Emit) (core.Reply, error) {
+	return openTSDBWrite(url, reader, emit, parseOpenTSDBPut)
+}
+
+// parseOpenTSDBPut parse a put datapoint
+func parseOpenTSDBPut(raw json.RawMessage, precision time.Duration, geo geoMapping) ([]core.GTS, error) {
+	var dp dataPoint
+	if err := unmarshalNumbers(raw, &dp); err != nil {
+		return nil, err
 	}
 
-	// handle request
-	dec := json.NewDecoder(r)
+	gts, err := dp.gts(precision)
+	if err != nil {
+		return nil, err
+	}
 
-	if solo {
-		gts, err := decode(dec)
-		if err != nil {
-			return dps, -1, err
-		}
+	if err := openTSDBLocate(raw, gts, geo); err != nil {
+		return nil, err
+	}
 
-		err = send(gts.Encode())
-		if err != nil {
-			return dps, -1, err
-		}
+	return []core.GTS{*gts}, nil
+}
 
-		dpCounter.Inc()
-		dps++
-	} else {
-		// read open bracket
-		_, err := dec.Token()
-		if err != nil {
-			return dps, -1, core.NewParsingError(fmt.Sprintf("Failed to parse datapoint: %v", err.Error()), "")
-		}
-
-		// while the array contains values
-		for dec.More() {
-			gts, err := decode(dec)
-			if err != nil {
-				return dps, -1, err
-			}
-
-			err = send(gts.Encode())
-			if err != nil {
-				return dps, -1, err
-			}
-
-			dpCounter.Inc()
-			dps++
-		}
-
-		// read closing bracket
-		_, err = dec.Token()
-		if err != nil {
-			return dps, -1, core.NewParsingError(fmt.Sprintf("Failed to parse datapoint: %v", err.Error()), "")
-		}
+// openTSDBLocate set the position of a datapoint from the extra fields of its JSON object named by the
+// `opentsdb.geo` configuration
+func openTSDBLocate(raw json.RawMessage, gts *core.GTS, geo geoMapping) error {
+	if !geo.enabled() {
+		return nil
+	}
+
+	var fields map[string]interface{}
+	if err := unmarshalNumbers(raw, &fields); err != nil {
+		return err
 	}
 
-	return dps, http.StatusNoContent, nil
+	return geo.locate(gts, func(name string) (interface{}, bool) {
+		v, ok := fields[name]
+		return v, ok && v != nil
+	})
 }
 
-func decode(dec *json.Decoder) (*core.GTS, error) {
-	var dp dataPoint
-	err := dec.Decode(&dp)
-	if err != nil {
-		return nil, core.NewParsingError(fmt.Sprintf("Failed to parse datapoint: %v", err.Error()), "")
+// unmarshalNumbers decode raw into v, numbers being kept as json.Number so that integers are not read as floats
+func unmarshalNumbers(raw json.RawMessage, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// parseNumber returns a number as an int64, an uint64 or a float64
+func parseNumber(s string) (interface{}, error) {
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i, nil
+	}
+	if u, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return u, nil
 	}
+	return strconv.ParseFloat(s, 64)
+}
 
-	gts := core.GTS{
-		Ts:     float64(int64toTime(dp.Timestamp).UnixNano() / 1000),
-		Name:   dp.Name,
-		Labels: dp.Tags,
-		Value:  dp.Value,
+// parsePrecision read the unit of the timestamps, n, u, ms, s, m or h as with InfluxDB, an empty precision
+// returning 0 so that the unit is guessed
+func parsePrecision(s string) (time.Duration, error) {
+	switch s {
+	case "":
+		return 0, nil
+	case "n", "ns":
+		return time.Nanosecond, nil
+	case "u", "us", "µ":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	case "m":
+		return time.Minute, nil
+	case "h":
+		return time.Hour, nil
+	}
+	return 0, fmt.Errorf("invalid precision '%s', expected n, u, ms, s, m or h", s)
+}
+
+// unitToTime convert a timestamp in the precision unit into a Time object, the unit being guessed by int64toTime
+// without precision
+func unitToTime(timestamp int64, precision time.Duration) time.Time {
+	if precision == 0 || timestamp == 0 {
+		return int64toTime(timestamp)
+	}
+	if precision >= time.Second {
+		return time.Unix(timestamp*int64(precision/time.Second), 0)
 	}
 
-	return &gts, nil
+	perSec := int64(time.Second / precision)
+	return time.Unix(timestamp/perSec, timestamp%perSec*int64(precision))
 }
 
 // int64toTime Convert an int expressed either in seconds or milliseconds into a Time object
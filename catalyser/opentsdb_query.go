@@ -0,0 +1,769 @@
+package catalyser
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ovh/catalyst/core"
+)
+
+// openTSDBAggregators maps the supported OpenTSDB aggregators to Warp 10 reducers, series being aggregated without interpolation
+var openTSDBAggregators = map[string]string{
+	"sum":    "reducer.sum",
+	"zimsum": "reducer.sum",
+	"avg":    "reducer.mean",
+	"min":    "reducer.min",
+	"mimmin": "reducer.min",
+	"max":    "reducer.max",
+	"mimmax": "reducer.max",
+	"count":  "reducer.count",
+	"dev":    "reducer.sd",
+	"none":   "",
+}
+
+// openTSDBDownsamplers maps the supported OpenTSDB downsamplers to Warp 10 bucketizers
+var openTSDBDownsamplers = map[string]string{
+	"sum":    "bucketizer.sum",
+	"zimsum": "bucketizer.sum",
+	"avg":    "bucketizer.mean",
+	"min":    "bucketizer.min",
+	"mimmin": "bucketizer.min",
+	"max":    "bucketizer.max",
+	"mimmax": "bucketizer.max",
+	"count":  "bucketizer.count",
+	"first":  "bucketizer.first",
+	"last":   "bucketizer.last",
+	"median": "bucketizer.median",
+}
+
+var openTSDBPercentile = regexp.MustCompile(`^p(\d{2,3})$`)
+
+// openTSDBQuery is an /api/query request
+type openTSDBQuery struct {
+	Start        interface{}        `json:"start"`
+	End          interface{}        `json:"end"`
+	Queries      []openTSDBSubQuery `json:"queries"`
+	MsResolution bool               `json:"msResolution"`
+	ShowQuery    bool               `json:"showQuery"`
+}
+
+// openTSDBSubQuery is a metric query of an /api/query request
+type openTSDBSubQuery struct {
+	Aggregator  string               `json:"aggregator"`
+	Metric      string               `json:"metric"`
+	Rate        bool                 `json:"rate"`
+	RateOptions *openTSDBRateOptions `json:"rateOptions,omitempty"`
+	Downsample  string               `json:"downsample,omitempty"`
+	Tags        map[string]string    `json:"tags,omitempty"`
+	Filters     []openTSDBFilter     `json:"filters,omitempty"`
+}
+
+// openTSDBRateOptions are the options of the rate conversion, only counter being honoured
+type openTSDBRateOptions struct {
+	Counter    bool  `json:"counter"`
+	CounterMax int64 `json:"counterMax,omitempty"`
+	ResetValue int64 `json:"resetValue,omitempty"`
+	DropResets bool  `json:"dropResets,omitempty"`
+}
+
+// openTSDBFilter is a tag filter
+type openTSDBFilter struct {
+	Type    string `json:"type"`
+	Tagk    string `json:"tagk"`
+	Filter  string `json:"filter"`
+	GroupBy bool   `json:"groupBy"`
+}
+
+// openTSDBResult is a series of the /api/query response
+type openTSDBResult struct {
+	Metric        string                 `json:"metric"`
+	Tags          map[string]string      `json:"tags"`
+	AggregateTags []string               `json:"aggregateTags"`
+	Query         *openTSDBSubQuery      `json:"query,omitempty"`
+	Dps           map[string]interface{} `json:"dps"`
+}
+
+// openTSDBSuggest is an /api/suggest request
+type openTSDBSuggest struct {
+	Type string `json:"type"`
+	Q    string `json:"q"`
+	Max  int    `json:"max"`
+}
+
+// openTSDBPlan is a sub-query translated into WarpScript
+type openTSDBPlan struct {
+	script  string
+	groupBy []string
+	// aggregate is false for the none aggregator, each series being returned as is
+	aggregate bool
+	// span is the downsampling interval in platform time units, 0 without downsampling
+	span  int64
+	first int64
+	last  int64
+	fill  string
+}
+
+// OpenTSDBQuery handle the /api/query API
+func OpenTSDBQuery(c echo.Context) error {
+	req := c.Request()
+
+	token, err := core.GetToken(req)
+	if err != nil {
+		return openTSDBError(c, http.StatusUnauthorized, err)
+	}
+
+	var q openTSDBQuery
+	if req.Method == http.MethodPost {
+		dec := json.NewDecoder(req.Body)
+		dec.UseNumber()
+		if err := dec.Decode(&q); err != nil {
+			return openTSDBError(c, http.StatusBadRequest, fmt.Errorf("unable to parse the query: %v", err))
+		}
+	} else {
+		if q, err = parseOpenTSDBQueryString(c.QueryParams()); err != nil {
+			return openTSDBError(c, http.StatusBadRequest, err)
+		}
+	}
+
+	if len(q.Queries) == 0 {
+		return openTSDBError(c, http.StatusBadRequest, errors.New("missing sub queries"))
+	}
+
+	now := time.Now()
+	start, err := parseOpenTSDBTime(q.Start, now)
+	if err != nil || q.Start == nil {
+		return openTSDBError(c, http.StatusBadRequest, fmt.Errorf("invalid start time: %v", q.Start))
+	}
+
+	end := now
+	if q.End != nil {
+		if end, err = parseOpenTSDBTime(q.End, now); err != nil {
+			return openTSDBError(c, http.StatusBadRequest, fmt.Errorf("invalid end time: %v", q.End))
+		}
+	}
+
+	if !end.After(start) {
+		return openTSDBError(c, http.StatusBadRequest, errors.New("start time must be before end time"))
+	}
+
+	plans := make([]*openTSDBPlan, 0, len(q.Queries))
+	script := "[\n"
+	for _, sub := range q.Queries {
+		plan, err := sub.plan(token, start, end)
+		if err != nil {
+			return openTSDBError(c, http.StatusBadRequest, err)
+		}
+		plans = append(plans, plan)
+		script += plan.script + "\n"
+	}
+	script += "]\n"
+
+	body, err := core.Exec("opentsdb", token, c.Get("txn").(string), script)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"txn": c.Get("txn"),
+		}).Warn("Failed to execute OpenTSDB query")
+		return openTSDBError(c, core.ExecStatus(err), err)
+	}
+
+	// Each sub-query pushes its series without values and its aggregated series
+	var stack [][][2][]core.ExecGTS
+	if err := json.Unmarshal(body, &stack); err != nil || len(stack) != 1 || len(stack[0]) != len(plans) {
+		return openTSDBError(c, http.StatusBadGateway, errors.New("unexpected WarpScript result"))
+	}
+
+	results := []openTSDBResult{}
+	for i, res := range stack[0] {
+		sub := q.Queries[i]
+		for _, gts := range res[1] {
+			r := plans[i].result(gts, res[0], q.MsResolution)
+			if q.ShowQuery {
+				r.Query = &sub
+			}
+			results = append(results, r)
+		}
+	}
+
+	return c.JSON(http.StatusOK, results)
+}
+
+// OpenTSDBSuggest handle the /api/suggest API
+func OpenTSDBSuggest(c echo.Context) error {
+	req := c.Request()
+
+	token, err := core.GetToken(req)
+	if err != nil {
+		return openTSDBError(c, http.StatusUnauthorized, err)
+	}
+
+	s := openTSDBSuggest{Max: 25}
+	if req.Method == http.MethodPost {
+		if err := json.NewDecoder(req.Body).Decode(&s); err != nil {
+			return openTSDBError(c, http.StatusBadRequest, fmt.Errorf("unable to parse the query: %v", err))
+		}
+	} else {
+		s.Type = c.QueryParam("type")
+		s.Q = c.QueryParam("q")
+		if max := c.QueryParam("max"); max != "" {
+			if s.Max, err = strconv.Atoi(max); err != nil {
+				return openTSDBError(c, http.StatusBadRequest, errors.New("invalid max parameter"))
+			}
+		}
+	}
+
+	class := "~.*"
+	switch s.Type {
+	case "metrics":
+		class = "~" + regexp.QuoteMeta(s.Q) + ".*"
+	case "tagk", "tagv":
+	default:
+		return openTSDBError(c, http.StatusBadRequest, fmt.Errorf("invalid type: %s", s.Type))
+	}
+
+	script := fmt.Sprintf("[ %s %s {} ] FINDSETS DROP 2 ->LIST\n", core.WarpScriptString(token), core.WarpScriptString(class))
+	body, err := core.Exec("opentsdb", token, c.Get("txn").(string), script)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"txn": c.Get("txn"),
+		}).Warn("Failed to execute OpenTSDB suggest")
+		return openTSDBError(c, core.ExecStatus(err), err)
+	}
+
+	var stack [][]json.RawMessage
+	if err := json.Unmarshal(body, &stack); err != nil || len(stack) != 1 || len(stack[0]) != 2 {
+		return openTSDBError(c, http.StatusBadGateway, errors.New("unexpected WarpScript result"))
+	}
+
+	var classes []string
+	var labels map[string][]string
+	if json.Unmarshal(stack[0][0], &classes) != nil || json.Unmarshal(stack[0][1], &labels) != nil {
+		return openTSDBError(c, http.StatusBadGateway, errors.New("unexpected WarpScript result"))
+	}
+
+	seen := map[string]bool{}
+	suggestions := []string{}
+	add := func(v string) {
+		if strings.HasPrefix(v, s.Q) && !seen[v] {
+			seen[v] = true
+			suggestions = append(suggestions, v)
+		}
+	}
+
+	switch s.Type {
+	case "metrics":
+		for _, class := range classes {
+			add(class)
+		}
+	case "tagk":
+		for k := range labels {
+			add(k)
+		}
+	case "tagv":
+		for _, values := range labels {
+			for _, v := range values {
+				add(v)
+			}
+		}
+	}
+
+	sort.Strings(suggestions)
+	if s.Max > 0 && len(suggestions) > s.Max {
+		suggestions = suggestions[:s.Max]
+	}
+
+	return c.JSON(http.StatusOK, suggestions)
+}
+
+// plan translate a sub-query into WarpScript
+func (q *openTSDBSubQuery) plan(token string, start, end time.Time) (*openTSDBPlan, error) {
+	if q.Metric == "" {
+		return nil, errors.New("missing metric")
+	}
+
+	reducer, err := openTSDBFunction(q.Aggregator, openTSDBAggregators, "reducer.percentile")
+	if err != nil {
+		return nil, fmt.Errorf("unsupported aggregator: %s", q.Aggregator)
+	}
+
+	filters := q.Filters
+	for tagk, filter := range q.Tags {
+		f, err := parseOpenTSDBTagFilter(tagk, filter, true)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+
+	labels, groupBy, err := openTSDBLabelSelectors(filters)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &openTSDBPlan{groupBy: groupBy, aggregate: reducer != ""}
+	script := fmt.Sprintf("[ { 'token' %s 'class' %s 'labels' %s 'start' %s 'end' %s } FETCH DUP <%% DROP CLONEEMPTY %%> LMAP SWAP",
+		core.WarpScriptString(token),
+		core.WarpScriptString("="+q.Metric),
+		core.WarpScriptLabels(labels),
+		core.WarpScriptString(start.UTC().Format(time.RFC3339Nano)),
+		core.WarpScriptString(end.UTC().Format(time.RFC3339Nano)),
+	)
+
+	if q.Downsample != "" {
+		parts := strings.Split(q.Downsample, "-")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("invalid downsample: %s", q.Downsample)
+		}
+
+		bucketizer, err := openTSDBFunction(parts[1], openTSDBDownsamplers, "bucketizer.percentile")
+		if err != nil || bucketizer == "" {
+			return nil, fmt.Errorf("unsupported downsampler: %s", parts[1])
+		}
+
+		startTs, endTs := core.Timestamp(start), core.Timestamp(end)
+		if parts[0] == "0all" {
+			plan.span = endTs - startTs + 1
+			plan.first, plan.last = startTs, startTs
+		} else {
+			interval, err := parseOpenTSDBDuration(parts[0])
+			if err != nil || interval <= 0 {
+				return nil, fmt.Errorf("invalid downsample interval: %s", parts[0])
+			}
+			// Buckets are aligned on the interval, their timestamp being their start
+			plan.span = core.Units(interval)
+			plan.first = influxFloor(startTs, plan.span)
+			plan.last = influxFloor(endTs, plan.span)
+		}
+
+		if len(parts) == 3 {
+			switch parts[2] {
+			case "none", "nan", "null", "zero":
+				plan.fill = parts[2]
+			default:
+				return nil, fmt.Errorf("unsupported fill policy: %s", parts[2])
+			}
+		}
+
+		script += fmt.Sprintf(" [ SWAP %s %d %d 0 ] BUCKETIZE", bucketizer, plan.last+plan.span-1, plan.span)
+	}
+
+	if q.Rate {
+		if q.RateOptions != nil && q.RateOptions.Counter {
+			script += " true RESETS"
+		}
+		script += " [ SWAP mapper.rate 1 0 0 ] MAP"
+	}
+
+	if plan.aggregate {
+		by := ""
+		for _, tagk := range groupBy {
+			by += " " + core.WarpScriptString(tagk)
+		}
+		script += fmt.Sprintf(" [ SWAP [%s ] %s ] REDUCE", by, reducer)
+	}
+
+	plan.script = script + " ]"
+	return plan, nil
+}
+
+// result render an aggregated series, series being the matching series without values
+func (p *openTSDBPlan) result(gts core.ExecGTS, series []core.ExecGTS, ms bool) openTSDBResult {
+	r := openTSDBResult{
+		Metric:        gts.Class,
+		Tags:          map[string]string{},
+		AggregateTags: []string{},
+		Dps:           map[string]interface{}{},
+	}
+
+	// Tags with the same value in all the aggregated series are reported as tags, the others as aggregate tags
+	var members []core.ExecGTS
+	if !p.aggregate {
+		members = append(members, gts)
+		series = nil
+	}
+	for _, s := range series {
+		match := true
+		for _, tagk := range p.groupBy {
+			if s.Labels[tagk] != gts.Labels[tagk] {
+				match = false
+				break
+			}
+		}
+		if match {
+			members = append(members, s)
+		}
+	}
+
+	aggregated := map[string]bool{}
+	for i, s := range members {
+		for k, v := range s.Labels {
+			if i == 0 {
+				r.Tags[k] = v
+			} else if tv, ok := r.Tags[k]; !ok || tv != v {
+				aggregated[k] = true
+			}
+		}
+		for k := range r.Tags {
+			if _, ok := s.Labels[k]; !ok {
+				aggregated[k] = true
+			}
+		}
+	}
+	if len(members) == 0 {
+		for k, v := range gts.Labels {
+			r.Tags[k] = v
+		}
+	}
+	for k := range aggregated {
+		delete(r.Tags, k)
+		r.AggregateTags = append(r.AggregateTags, k)
+	}
+	sort.Strings(r.AggregateTags)
+
+	key := func(ts int64) string {
+		if ms {
+			return strconv.FormatInt(ts/core.Units(time.Millisecond), 10)
+		}
+		return strconv.FormatInt(ts/core.UnitsPerSecond(), 10)
+	}
+
+	for i := range gts.Values {
+		ts, value := gts.Point(i)
+		if p.span > 0 {
+			ts = ts - p.span + 1
+		}
+		r.Dps[key(ts)] = value
+	}
+
+	if p.span > 0 && p.fill != "" && p.fill != "none" {
+		var value interface{}
+		if p.fill == "zero" {
+			value = 0
+		}
+
+		for ts := p.first; ts <= p.last; ts += p.span {
+			if _, ok := r.Dps[key(ts)]; !ok {
+				r.Dps[key(ts)] = value
+			}
+		}
+	}
+
+	return r
+}
+
+// openTSDBFunction returns the Warp 10 function of an aggregator or downsampler, including the pXX percentiles
+func openTSDBFunction(name string, functions map[string]string, percentile string) (string, error) {
+	if f, ok := functions[name]; ok {
+		return f, nil
+	}
+
+	m := openTSDBPercentile.FindStringSubmatch(name)
+	if m == nil {
+		return "", fmt.Errorf("unsupported function: %s", name)
+	}
+
+	p := m[1][:2]
+	if len(m[1]) > 2 {
+		p += "." + m[1][2:]
+	}
+	return p + " " + percentile, nil
+}
+
+// openTSDBLabelSelectors returns the Warp 10 labels selectors of the filters and the tags to group by
+func openTSDBLabelSelectors(filters []openTSDBFilter) (map[string]string, []string, error) {
+	regexps := map[string][]string{}
+	exact := map[string]string{}
+	groupBy := []string{}
+	seen := map[string]bool{}
+
+	for _, f := range filters {
+		if f.Tagk == "" {
+			return nil, nil, errors.New("missing filter tag key")
+		}
+
+		re := ""
+		switch f.Type {
+		case "literal_or", "iliteral_or", "not_literal_or", "not_iliteral_or":
+			values := strings.Split(f.Filter, "|")
+			for i, v := range values {
+				values[i] = regexp.QuoteMeta(v)
+			}
+			re = "(?:" + strings.Join(values, "|") + ")"
+
+			if strings.HasPrefix(f.Type, "not_") {
+				re = "(?!" + re + "$).+"
+			}
+			if strings.Contains(f.Type, "iliteral") {
+				re = "(?i)" + re
+			}
+			if f.Type == "literal_or" && len(values) == 1 {
+				exact[f.Tagk] = f.Filter
+			}
+
+		case "wildcard", "iwildcard":
+			parts := strings.Split(f.Filter, "*")
+			for i, part := range parts {
+				parts[i] = regexp.QuoteMeta(part)
+			}
+			re = strings.Join(parts, ".*")
+			if f.Filter == "*" {
+				re = ".+"
+			}
+			if f.Type == "iwildcard" {
+				re = "(?i)" + re
+			}
+
+		case "regexp":
+			if _, err := regexp.Compile(f.Filter); err != nil {
+				return nil, nil, fmt.Errorf("invalid regexp filter %s: %v", f.Filter, err)
+			}
+			// OpenTSDB regular expressions are not anchored
+			re = ".*(?:" + f.Filter + ").*"
+
+		default:
+			return nil, nil, fmt.Errorf("unsupported filter type: %s", f.Type)
+		}
+
+		regexps[f.Tagk] = append(regexps[f.Tagk], re)
+		if f.GroupBy && !seen[f.Tagk] {
+			seen[f.Tagk] = true
+			groupBy = append(groupBy, f.Tagk)
+		}
+	}
+	sort.Strings(groupBy)
+
+	labels := map[string]string{}
+	for tagk, res := range regexps {
+		if v, ok := exact[tagk]; ok && len(res) == 1 {
+			labels[tagk] = "=" + v
+			continue
+		}
+
+		if len(res) == 1 {
+			labels[tagk] = "~" + res[0]
+			continue
+		}
+
+		selector := "~"
+		for _, re := range res {
+			selector += "(?=" + re + "$)"
+		}
+		labels[tagk] = selector + ".*"
+	}
+
+	return labels, groupBy, nil
+}
+
+// parseOpenTSDBTagFilter parse a filter of the tags map, or of the m query string parameter
+func parseOpenTSDBTagFilter(tagk, filter string, groupBy bool) (openTSDBFilter, error) {
+	f := openTSDBFilter{Tagk: tagk, GroupBy: groupBy}
+
+	if i := strings.Index(filter, "("); i > 0 && strings.HasSuffix(filter, ")") {
+		f.Type = filter[:i]
+		f.Filter = filter[i+1 : len(filter)-1]
+		return f, nil
+	}
+
+	f.Filter = filter
+	switch {
+	case strings.Contains(filter, "*"):
+		f.Type = "wildcard"
+	default:
+		f.Type = "literal_or"
+	}
+
+	if f.Filter == "" {
+		return f, fmt.Errorf("empty filter for tag %s", tagk)
+	}
+
+	return f, nil
+}
+
+// parseOpenTSDBQueryString parse the start, end, m, ms and show_query parameters of a GET /api/query
+func parseOpenTSDBQueryString(params map[string][]string) (openTSDBQuery, error) {
+	q := openTSDBQuery{}
+	if v, ok := params["start"]; ok {
+		q.Start = v[0]
+	}
+	if v, ok := params["end"]; ok {
+		q.End = v[0]
+	}
+	_, q.MsResolution = params["ms"]
+	_, q.ShowQuery = params["show_query"]
+
+	for _, m := range params["m"] {
+		sub, err := parseOpenTSDBMetricQuery(m)
+		if err != nil {
+			return q, err
+		}
+		q.Queries = append(q.Queries, sub)
+	}
+
+	return q, nil
+}
+
+// parseOpenTSDBMetricQuery parse a <aggregator>:[rate[{counter[,max[,reset]]}]:][<downsample>:]<metric>[{tags}][{filters}] query
+func parseOpenTSDBMetricQuery(m string) (openTSDBSubQuery, error) {
+	sub := openTSDBSubQuery{}
+
+	// Split on the colons which are not within braces
+	parts := []string{}
+	depth, from := 0, 0
+	for i, c := range m {
+		switch c {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case ':':
+			if depth == 0 {
+				parts = append(parts, m[from:i])
+				from = i + 1
+			}
+		}
+	}
+	parts = append(parts, m[from:])
+
+	if len(parts) < 2 || len(parts) > 4 {
+		return sub, fmt.Errorf("invalid metric query: %s", m)
+	}
+
+	sub.Aggregator = parts[0]
+	for _, part := range parts[1 : len(parts)-1] {
+		if !strings.HasPrefix(part, "rate") {
+			sub.Downsample = part
+			continue
+		}
+
+		sub.Rate = true
+		if options := strings.TrimPrefix(part, "rate"); options != "" {
+			if !strings.HasPrefix(options, "{") || !strings.HasSuffix(options, "}") {
+				return sub, fmt.Errorf("invalid rate options: %s", part)
+			}
+
+			values := strings.Split(options[1:len(options)-1], ",")
+			sub.RateOptions = &openTSDBRateOptions{Counter: values[0] == "counter"}
+			if len(values) > 1 && values[1] != "" {
+				sub.RateOptions.CounterMax, _ = strconv.ParseInt(values[1], 10, 64)
+			}
+			if len(values) > 2 && values[2] != "" {
+				sub.RateOptions.ResetValue, _ = strconv.ParseInt(values[2], 10, 64)
+			}
+		}
+	}
+
+	metric := parts[len(parts)-1]
+	braces := ""
+	if i := strings.Index(metric, "{"); i >= 0 {
+		metric, braces = metric[:i], metric[i:]
+	}
+	sub.Metric = metric
+
+	// The first braces are group by filters, the second ones are filters only
+	for i := 0; braces != ""; i++ {
+		end := strings.Index(braces, "}")
+		if !strings.HasPrefix(braces, "{") || end < 0 || i > 1 {
+			return sub, fmt.Errorf("invalid tags in metric query: %s", m)
+		}
+
+		for _, pair := range strings.Split(braces[1:end], ",") {
+			if pair == "" {
+				continue
+			}
+
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				return sub, fmt.Errorf("invalid tag filter: %s", pair)
+			}
+
+			f, err := parseOpenTSDBTagFilter(kv[0], kv[1], i == 0)
+			if err != nil {
+				return sub, err
+			}
+			sub.Filters = append(sub.Filters, f)
+		}
+		braces = braces[end+1:]
+	}
+
+	return sub, nil
+}
+
+// parseOpenTSDBTime parse an absolute, relative (1h-ago) or epoch (seconds or milliseconds) time
+func parseOpenTSDBTime(v interface{}, now time.Time) (time.Time, error) {
+	s := fmt.Sprint(v)
+
+	if s == "now" {
+		return now, nil
+	}
+
+	if strings.HasSuffix(s, "-ago") {
+		d, err := parseOpenTSDBDuration(strings.TrimSuffix(s, "-ago"))
+		if err != nil {
+			return time.Time{}, err
+		}
+		return now.Add(-d), nil
+	}
+
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		if strings.Contains(s, ".") {
+			return time.Unix(0, int64(f*1e9)), nil
+		}
+		return int64toTime(int64(f)), nil
+	}
+
+	for _, layout := range []string{"2006/01/02-15:04:05", "2006/01/02 15:04:05", "2006/01/02-15:04", "2006/01/02 15:04", "2006/01/02"} {
+		if t, err := time.ParseInLocation(layout, s, time.UTC); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("invalid time: %s", s)
+}
+
+// parseOpenTSDBDuration parse a duration using the ms, s, m, h, d, w, n (30 days) and y (365 days) units
+func parseOpenTSDBDuration(s string) (time.Duration, error) {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+
+	n, err := strconv.Atoi(s[:i])
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration: %s", s)
+	}
+
+	unit, ok := map[string]time.Duration{
+		"ms": time.Millisecond,
+		"s":  time.Second,
+		"m":  time.Minute,
+		"h":  time.Hour,
+		"d":  24 * time.Hour,
+		"w":  7 * 24 * time.Hour,
+		"n":  30 * 24 * time.Hour,
+		"y":  365 * 24 * time.Hour,
+	}[s[i:]]
+	if !ok {
+		return 0, fmt.Errorf("invalid duration unit: %s", s)
+	}
+
+	return time.Duration(n) * unit, nil
+}
+
+// openTSDBError render an error using the OpenTSDB error envelope
+func openTSDBError(c echo.Context, code int, err error) error {
+	return c.JSON(code, map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    code,
+			"message": err.Error(),
+		},
+	})
+}
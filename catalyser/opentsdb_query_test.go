@@ -0,0 +1,77 @@
+package catalyser
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseOpenTSDBMetricQuery(t *testing.T) {
+	tests := []struct {
+		Got    string
+		Expect []string
+		Err    bool
+	}{
+		{
+			"sum:sys.cpu.user{host=*}",
+			[]string{"'class' '=sys.cpu.user'", "'host' '~.+'", "[ 'host' ] reducer.sum ] REDUCE"},
+			false,
+		},
+		{
+			"avg:1h-max-zero:rate{counter,,1}:if.octets{host=web01|web02}{dc=literal_or(gra)}",
+			[]string{"bucketizer.max", "true RESETS [ SWAP mapper.rate 1 0 0 ] MAP", "'host' '~(?:web01|web02)'", "'dc' '=gra'", "[ 'host' ] reducer.mean"},
+			false,
+		},
+		{
+			"p99:sys.cpu.user{host=regexp(web[0-9]+)}",
+			[]string{"'host' '~.*(?:web[0-9]+).*'", "99 reducer.percentile"},
+			false,
+		},
+		{
+			"none:sys.cpu.user{host=not_literal_or(web01)}",
+			[]string{"'host' '~(?!(?:web01)$).+'", "SWAP ]"},
+			false,
+		},
+		{
+			"unknown:sys.cpu.user",
+			nil,
+			true,
+		},
+		{
+			"sum:1m-foo:sys.cpu.user",
+			nil,
+			true,
+		},
+		{
+			"sys.cpu.user",
+			nil,
+			true,
+		},
+	}
+
+	for _, test := range tests {
+		sub, err := parseOpenTSDBMetricQuery(test.Got)
+		var plan *openTSDBPlan
+		if err == nil {
+			plan, err = sub.plan("token", time.Unix(0, 0), time.Unix(3600, 0))
+		}
+
+		if test.Err {
+			if err == nil {
+				t.Errorf("expected an error for %s", test.Got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("unexpected error for %s: %v", test.Got, err)
+			continue
+		}
+
+		for _, expect := range test.Expect {
+			if !strings.Contains(plan.script, expect) {
+				t.Errorf("%s: expected %s in %s", test.Got, expect, plan.script)
+			}
+		}
+	}
+}
@@ -0,0 +1,442 @@
+package catalyser
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/spf13/viper"
+
+	"github.com/ovh/catalyst/core"
+)
+
+// openTSDBSummary is the response of the OpenTSDB write APIs with the summary or details parameters
+type openTSDBSummary struct {
+	Success int                  `json:"success"`
+	Failed  int                  `json:"failed"`
+	Errors  []openTSDBPointError `json:"errors,omitempty"`
+}
+
+// openTSDBPointError is a rejected datapoint of the details response
+type openTSDBPointError struct {
+	Datapoint json.RawMessage `json:"datapoint"`
+	Error     string          `json:"error"`
+}
+
+// openTSDBRollupPoint is a datapoint of the /api/rollup API
+type openTSDBRollupPoint struct {
+	dataPoint
+	// The rollup interval, such as 1h
+	Interval string `json:"interval"`
+	// The function used to downsample the raw datapoints of the interval
+	Aggregator string `json:"aggregator"`
+	// The function used to aggregate the series of a pre-aggregate
+	GroupByAggregator string `json:"groupByAggregator"`
+}
+
+// openTSDBHistogramPoint is a datapoint of the /api/histogram API
+type openTSDBHistogramPoint struct {
+	Name      string            `json:"metric"`
+	Timestamp int64             `json:"timestamp"`
+	Tags      map[string]string `json:"tags"`
+	// The bucket counts, keyed by "lower,upper" bounds
+	Buckets   map[string]int64 `json:"buckets"`
+	Underflow *int64           `json:"underflow"`
+	Overflow  *int64           `json:"overflow"`
+	// The codec of a binary encoded histogram
+	ID *int `json:"id"`
+}
+
+// openTSDBAnnotation is an annotation of the /api/annotation API
+type openTSDBAnnotation struct {
+	StartTime   int64             `json:"startTime"`
+	EndTime     int64             `json:"endTime,omitempty"`
+	TSUID       string            `json:"tsuid,omitempty"`
+	Description string            `json:"description"`
+	Notes       string            `json:"notes,omitempty"`
+	Custom      map[string]string `json:"custom,omitempty"`
+}
+
+// OpenTSDBRollup returns an OpenTSDB rollup catalyser, interval and aggregators being stored as labels
+func OpenTSDBRollup(url *url.URL, header *http.Header, reader io.Reader, emit core.Emit) (core.Reply, error) {
+	return openTSDBWrite(url, reader, emit, parseOpenTSDBRollup)
+}
+
+// OpenTSDBHistogram returns an OpenTSDB histogram catalyser, each bucket being stored as a GTS
+func OpenTSDBHistogram(url *url.URL, header *http.Header, reader io.Reader, emit core.Emit) (core.Reply, error) {
+	return openTSDBWrite(url, reader, emit, parseOpenTSDBHistogram)
+}
+
+// OpenTSDBAnnotation returns an OpenTSDB annotation catalyser, annotations being stored as string values
+func OpenTSDBAnnotation(url *url.URL, header *http.Header, reader io.Reader, emit core.Emit) (core.Reply, error) {
+	return openTSDBWrite(url, reader, emit, parseOpenTSDBAnnotation)
+}
+
+// openTSDBWrite send the datapoints of a single object or of an array of objects, the invalid ones being
+// reported according to the details and summary parameters as OpenTSDB does
+func openTSDBWrite(u *url.URL, reader io.Reader, emit core.Emit, parse func(json.RawMessage, time.Duration, geoMapping) ([]core.GTS, error)) (core.Reply, error) {
+	summary := openTSDBSummary{Errors: []openTSDBPointError{}}
+
+	query := u.Query()
+	_, details := query["details"]
+	_, summarize := query["summary"]
+
+	// Datapoints are always stored before answering, sync_timeout bounds the wait
+	timeout := time.Duration(0)
+	if _, sync := query["sync"]; sync && query.Get("sync_timeout") != "" {
+		ms, err := strconv.ParseInt(query.Get("sync_timeout"), 10, 64)
+		if err != nil || ms < 0 {
+			return openTSDBReply(http.StatusBadRequest, time.Duration(0), map[string]interface{}{
+				"error": map[string]interface{}{
+					"code":    http.StatusBadRequest,
+					"message": "Invalid sync_timeout parameter",
+				},
+			})
+		}
+		timeout = time.Duration(ms) * time.Millisecond
+	}
+
+	// Timestamps in seconds or milliseconds are guessed without precision
+	precision, err := parsePrecision(query.Get("precision"))
+	if err != nil {
+		return openTSDBReply(http.StatusBadRequest, time.Duration(0), map[string]interface{}{
+			"error": map[string]interface{}{
+				"code":    http.StatusBadRequest,
+				"message": "Invalid precision parameter",
+			},
+		})
+	}
+
+	geo := newGeoMapping("opentsdb")
+	err = openTSDBDecode(reader, func(raw json.RawMessage) error {
+		gtss, err := parse(raw, precision, geo)
+		if err != nil {
+			summary.Failed++
+			summary.Errors = append(summary.Errors, openTSDBPointError{Datapoint: raw, Error: err.Error()})
+			return nil
+		}
+
+		// Every datapoint of an object, such as the buckets of a histogram, is sent before counting the object.
+		// Datapoints rejected by the pipeline are reported as the invalid ones.
+		sent := 0
+		rejected := ""
+		for i := range gtss {
+			err := emit(&gtss[i])
+			if err == nil {
+				sent++
+				continue
+			}
+
+			message := err.Error()
+			if perr, ok := err.(core.ParsingError); ok {
+				message = perr.Row
+			} else if !core.Rejected(err) {
+				return err
+			}
+			if rejected == "" {
+				rejected = message
+			}
+		}
+
+		if sent < len(gtss) {
+			if sent > 0 {
+				rejected = fmt.Sprintf("%s (%d of %d datapoints stored)", rejected, sent, len(gtss))
+			}
+			summary.Failed++
+			summary.Errors = append(summary.Errors, openTSDBPointError{Datapoint: raw, Error: rejected})
+			return nil
+		}
+
+		summary.Success++
+		return nil
+	})
+	if err != nil {
+		return core.Reply{}, err
+	}
+
+	if !details && !summarize {
+		if summary.Failed > 0 {
+			return openTSDBReply(http.StatusBadRequest, timeout, map[string]interface{}{
+				"error": map[string]interface{}{
+					"code":    http.StatusBadRequest,
+					"message": "One or more data points had errors",
+					"details": "Please see the TSD logs or append \"details\" to the put request",
+				},
+			})
+		}
+		return core.Reply{Code: http.StatusNoContent, Timeout: timeout}, nil
+	}
+
+	if !details {
+		summary.Errors = nil
+	}
+
+	code := http.StatusOK
+	if summary.Failed > 0 {
+		code = http.StatusBadRequest
+	}
+	return openTSDBReply(code, timeout, summary)
+}
+
+// openTSDBDecode calls fn for the single object or for each object of the array read from reader
+func openTSDBDecode(reader io.Reader, fn func(json.RawMessage) error) error {
+	r := bufio.NewReader(reader)
+
+	// Skip up to the first object or array
+	array := false
+	for {
+		head, err := r.Peek(1)
+		if err != nil {
+			if err != io.EOF {
+				return core.NewParsingError("Failed to parse datapoint - EOF", "")
+			}
+			return err
+		}
+
+		if head[0] == '[' || head[0] == '{' {
+			array = head[0] == '['
+			break
+		}
+		_, _ = r.Discard(1)
+	}
+
+	dec := json.NewDecoder(r)
+	if array {
+		if _, err := dec.Token(); err != nil {
+			return core.NewParsingError(fmt.Sprintf("Failed to parse datapoint: %v", err.Error()), "")
+		}
+	}
+
+	for !array || dec.More() {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return core.NewParsingError(fmt.Sprintf("Failed to parse datapoint: %v", err.Error()), "")
+		}
+
+		if err := fn(raw); err != nil {
+			return err
+		}
+
+		if !array {
+			return nil
+		}
+	}
+
+	if _, err := dec.Token(); err != nil {
+		return core.NewParsingError(fmt.Sprintf("Failed to parse datapoint: %v", err.Error()), "")
+	}
+
+	return nil
+}
+
+func parseOpenTSDBRollup(raw json.RawMessage, precision time.Duration, geo geoMapping) ([]core.GTS, error) {
+	var dp openTSDBRollupPoint
+	if err := unmarshalNumbers(raw, &dp); err != nil {
+		return nil, err
+	}
+
+	if dp.Interval == "" && dp.GroupByAggregator == "" {
+		return nil, errors.New("missing interval or groupByAggregator")
+	}
+
+	if dp.Interval != "" && dp.Aggregator == "" {
+		return nil, errors.New("missing aggregator for the interval")
+	}
+
+	gts, err := dp.gts(precision)
+	if err != nil {
+		return nil, err
+	}
+
+	gts.Labels = openTSDBLabels(dp.Tags, map[string]string{
+		"interval":          dp.Interval,
+		"aggregator":        strings.ToLower(dp.Aggregator),
+		"groupByAggregator": strings.ToLower(dp.GroupByAggregator),
+	})
+
+	if err := openTSDBLocate(raw, gts, geo); err != nil {
+		return nil, err
+	}
+
+	return []core.GTS{*gts}, nil
+}
+
+func parseOpenTSDBHistogram(raw json.RawMessage, precision time.Duration, _ geoMapping) ([]core.GTS, error) {
+	var dp openTSDBHistogramPoint
+	if err := json.Unmarshal(raw, &dp); err != nil {
+		return nil, err
+	}
+
+	if dp.Name == "" {
+		return nil, errors.New("missing metric")
+	}
+
+	if dp.Timestamp <= 0 {
+		return nil, errors.New("invalid timestamp")
+	}
+
+	if len(dp.Buckets) == 0 {
+		if dp.ID != nil {
+			return nil, errors.New("binary encoded histograms are not supported")
+		}
+		return nil, errors.New("missing buckets")
+	}
+
+	type bucket struct {
+		lower, upper float64
+		count        int64
+	}
+
+	buckets := make([]bucket, 0, len(dp.Buckets))
+	for bounds, count := range dp.Buckets {
+		parts := strings.Split(bounds, ",")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid bucket bounds: %s", bounds)
+		}
+
+		lower, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket bounds: %s", bounds)
+		}
+
+		upper, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil || upper < lower {
+			return nil, fmt.Errorf("invalid bucket bounds: %s", bounds)
+		}
+
+		buckets = append(buckets, bucket{lower, upper, count})
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].lower < buckets[j].lower })
+
+	// Underflow and overflow are stored as the buckets below and above the bounds
+	lowest, highest := buckets[0].lower, buckets[len(buckets)-1].upper
+	if dp.Underflow != nil {
+		buckets = append(buckets, bucket{math.Inf(-1), lowest, *dp.Underflow})
+	}
+	if dp.Overflow != nil {
+		buckets = append(buckets, bucket{highest, math.Inf(1), *dp.Overflow})
+	}
+
+	ts := core.Timestamp(unitToTime(dp.Timestamp, precision))
+	gtss := make([]core.GTS, 0, len(buckets))
+	for _, b := range buckets {
+		gtss = append(gtss, core.GTS{
+			Ts:   ts,
+			Name: dp.Name,
+			Labels: openTSDBLabels(dp.Tags, map[string]string{
+				"lower": strconv.FormatFloat(b.lower, 'g', -1, 64),
+				"upper": strconv.FormatFloat(b.upper, 'g', -1, 64),
+			}),
+			Value: b.count,
+		})
+	}
+
+	return gtss, nil
+}
+
+func parseOpenTSDBAnnotation(raw json.RawMessage, precision time.Duration, _ geoMapping) ([]core.GTS, error) {
+	var a openTSDBAnnotation
+	if err := json.Unmarshal(raw, &a); err != nil {
+		return nil, err
+	}
+
+	if a.StartTime <= 0 {
+		return nil, errors.New("missing start time")
+	}
+
+	if a.EndTime != 0 && a.EndTime < a.StartTime {
+		return nil, errors.New("end time must be after the start time")
+	}
+
+	// The whole annotation is kept as the value, the series being global without tsuid
+	value, err := json.Marshal(a)
+	if err != nil {
+		return nil, err
+	}
+
+	labels := map[string]string{}
+	if a.TSUID != "" {
+		labels["tsuid"] = a.TSUID
+	}
+
+	return []core.GTS{{
+		Ts:     core.Timestamp(unitToTime(a.StartTime, precision)),
+		Name:   viper.GetString("opentsdb.annotation.class"),
+		Labels: labels,
+		Value:  string(value),
+	}}, nil
+}
+
+// gts validate a datapoint and returns its GTS, a zero timestamp being the current time
+func (dp *dataPoint) gts(precision time.Duration) (*core.GTS, error) {
+	if dp.Name == "" {
+		return nil, errors.New("missing metric")
+	}
+
+	if dp.Timestamp < 0 {
+		return nil, errors.New("invalid timestamp")
+	}
+
+	value, err := openTSDBValue(dp.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	return &core.GTS{
+		Ts:     core.Timestamp(unitToTime(dp.Timestamp, precision)),
+		Name:   dp.Name,
+		Labels: dp.Tags,
+		Value:  value,
+	}, nil
+}
+
+// openTSDBValue returns a numeric value keeping integers as such, OpenTSDB accepting numbers as strings
+func openTSDBValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case float64:
+		return v, nil
+	case json.Number:
+		return parseNumber(string(v))
+	case string:
+		if n, err := parseNumber(v); err == nil {
+			return n, nil
+		}
+		return nil, fmt.Errorf("invalid value: %s", v)
+	case nil:
+		return nil, errors.New("missing value")
+	}
+
+	return nil, fmt.Errorf("invalid value: %v", v)
+}
+
+// openTSDBLabels merge the tags with the non empty extra labels
+func openTSDBLabels(tags, extra map[string]string) map[string]string {
+	labels := make(map[string]string, len(tags)+len(extra))
+	for k, v := range tags {
+		labels[k] = v
+	}
+	for k, v := range extra {
+		if v != "" {
+			labels[k] = v
+		}
+	}
+	return labels
+}
+
+func openTSDBReply(code int, timeout time.Duration, body interface{}) (core.Reply, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return core.Reply{}, err
+	}
+	return core.Reply{Code: code, ContentType: echo.MIMEApplicationJSONCharsetUTF8, Body: string(b), Timeout: timeout}, nil
+}
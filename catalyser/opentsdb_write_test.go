@@ -0,0 +1,80 @@
+package catalyser
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/ovh/catalyst/core"
+)
+
+func TestNumericInputs(t *testing.T) {
+	for raw, expected := range map[string]interface{}{
+		`{"metric":"m","timestamp":1,"value":42}`:                   int64(42),
+		`{"metric":"m","timestamp":1,"value":9223372036854775807}`:  int64(math.MaxInt64),
+		`{"metric":"m","timestamp":1,"value":18446744073709551615}`: uint64(math.MaxUint64),
+		`{"metric":"m","timestamp":1,"value":42.0}`:                 float64(42),
+		`{"metric":"m","timestamp":1,"value":1e-9}`:                 1e-9,
+		`{"metric":"m","timestamp":1,"value":"7"}`:                  int64(7),
+	} {
+		gts, err := parseOpenTSDBPut(json.RawMessage(raw), 0, geoMapping{})
+		if err != nil {
+			t.Errorf("%s: %v", raw, err)
+			continue
+		}
+		if gts[0].Value != expected {
+			t.Errorf("%s: got %T %v", raw, gts[0].Value, gts[0].Value)
+		}
+	}
+
+	gts, err := parseInflux([]byte("m u=18446744073709551615u,i=-3i,f=1"), "n", defaultInfluxMapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dp := range gts {
+		expected := map[string]interface{}{"m.u": uint64(math.MaxUint64), "m.i": int64(-3), "m.f": float64(1)}[dp.Name]
+		if dp.Value != expected {
+			t.Errorf("%s: got %T %v", dp.Name, dp.Value, dp.Value)
+		}
+	}
+}
+
+func TestOpenTSDBWriteDetails(t *testing.T) {
+	body := `[
+		{"metric":"g","timestamp":1,"buckets":{"0,1":1,"1,2":2},"tags":{"host":"a"}},
+		{"metric":"h","timestamp":1,"buckets":{"0,1":1,"1,2":2,"2,4":3},"tags":{"host":"a"}}
+	]`
+
+	// The pipeline rejects a bucket of h, the others being sent
+	var sent []string
+	emit := func(gts *core.GTS) error {
+		if gts.Name == "h" && gts.Labels["lower"] == "1" {
+			return core.ReservedLabelError{Class: gts.Name, Label: "lower"}
+		}
+		sent = append(sent, gts.Name+gts.Labels["lower"])
+		return nil
+	}
+
+	u, _ := url.Parse("/api/histogram?details")
+	reply, err := OpenTSDBHistogram(u, &http.Header{}, strings.NewReader(body), emit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var summary openTSDBSummary
+	if err := json.Unmarshal([]byte(reply.Body), &summary); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Code != http.StatusBadRequest || summary.Success != 1 || summary.Failed != 1 || len(summary.Errors) != 1 {
+		t.Fatalf("got %d %s", reply.Code, reply.Body)
+	}
+	if msg := summary.Errors[0].Error; !strings.HasSuffix(msg, "(2 of 3 datapoints stored)") {
+		t.Errorf("got %s for the histogram", msg)
+	}
+	if len(sent) != 4 {
+		t.Errorf("got %q sent", sent)
+	}
+}
@@ -3,7 +3,6 @@ package catalyser
 import (
 	"fmt"
 	"io"
-	"math"
 	"net/http"
 	"net/url"
 	"strings"
@@ -13,14 +12,18 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/ovh/catalyst/core"
-	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
 )
 
-// Prometheus returns a Prometheus catalyser.
-func Prometheus(url *url.URL, headers *http.Header, r io.Reader, send func([]byte) error, dpCounter prometheus.Counter) (int, int, error) {
-	dps := 0
+// NewPrometheus returns a Prometheus catalyser mapping the histograms and summaries with mapping.
+func NewPrometheus(mapping *PromHistogramMapping) core.CatalyserFunc {
+	return func(url *url.URL, headers *http.Header, r io.Reader, emit core.Emit) (core.Reply, error) {
+		return promText(url, headers, r, emit, mapping)
+	}
+}
+
+func promText(url *url.URL, headers *http.Header, r io.Reader, emit core.Emit, mapping *PromHistogramMapping) (core.Reply, error) {
 	extraLabels := make(map[string]string)
 
 	path := url.Path
@@ -30,7 +33,7 @@ func Prometheus(url *url.URL, headers *http.Header, r io.Reader, send func([]byt
 
 	pathLabels := strings.Split(path, "/")
 	if len(pathLabels)%2 != 0 {
-		return dps, -1, core.NewParsingError(fmt.Sprintf("Bad number of labels in URL (must be even but got : %d entries)", len(pathLabels)), path)
+		return core.Reply{}, core.NewParsingError(fmt.Sprintf("Bad number of labels in URL (must be even but got : %d entries)", len(pathLabels)), path)
 	}
 
 	for i := 0; i < len(pathLabels); i = i + 2 {
@@ -43,9 +46,20 @@ func Prometheus(url *url.URL, headers *http.Header, r io.Reader, send func([]byt
 		format = expfmt.FmtText
 	}
 
+	geo := newGeoMapping("prometheus")
+	token, _ := core.GetToken(&http.Request{URL: url, Header: *headers})
+
+	// The text parser skips the units, they are read while it reads the exposition
+	metadata := promMetadataEnabled()
+	units := map[string]string{}
+	if metadata && format == expfmt.FmtText {
+		u := newPromUnits(r)
+		r, units = u, u.units
+	}
+
 	decoder := expfmt.NewDecoder(r, format)
 	if decoder == nil {
-		return dps, -1, core.NewParsingError("Unable to create decoder to decode response", path)
+		return core.Reply{}, core.NewParsingError("Unable to create decoder to decode response", path)
 	}
 
 	log.WithFields(log.Fields{
@@ -61,7 +75,7 @@ func Prometheus(url *url.URL, headers *http.Header, r io.Reader, send func([]byt
 		}
 		if err != nil {
 			log.WithError(err).Errorln("Error decoding MetricFamily")
-			return dps, -1, core.NewParsingError("Invalid format", path)
+			return core.Reply{}, core.NewParsingError("Invalid format", path)
 		}
 
 		// Geting values from MetricFamily. We are injecting time.Now()
@@ -71,19 +85,16 @@ func Prometheus(url *url.URL, headers *http.Header, r io.Reader, send func([]byt
 		}, &mf)
 		if err != nil {
 			log.WithError(err).Errorln("Error creating extractor")
-			return dps, -1, core.NewParsingError("Invalid format", path)
+			return core.Reply{}, core.NewParsingError("Invalid format", path)
 		}
 
-		// Creating GTS
+		// Creating GTS, the histograms and summaries being mapped once the whole family is read
+		family := make([]*core.GTS, 0, len(metrics))
 		for _, metric := range metrics {
-			dp := core.GTS{
+			dp := &core.GTS{
 				Labels: make(map[string]string),
 			}
 
-			if float64(metric.Value) == math.Inf(1) || float64(metric.Value) == math.Inf(-1) {
-				continue
-			}
-
 			// get inner labels
 			for key, value := range metric.Metric {
 				if key == "__name__" {
@@ -97,21 +108,36 @@ func Prometheus(url *url.URL, headers *http.Header, r io.Reader, send func([]byt
 			for key, value := range extraLabels {
 				dp.Labels[key] = value
 			}
+
+			if err := geo.fromLabels(dp); err != nil {
+				return core.Reply{}, core.NewParsingError(err.Error(), dp.Name)
+			}
 			// TS and value
-			dp.Ts = float64(time.Unix(0, int64(metric.Timestamp)*1000*1000).UnixNano()) / 1000.0
+			dp.Ts = core.Timestamp(metric.Timestamp.Time())
 			dp.Value = float64(metric.Value)
 
-			// Send to Warp
-			err = send(dp.Encode())
-			if err != nil {
-				return dps, -1, err
+			family = append(family, dp)
+		}
+
+		if t := mf.GetType(); t == dto.MetricType_HISTOGRAM || t == dto.MetricType_SUMMARY {
+			family = mapping.apply(token, family)
+		}
+
+		if metadata {
+			attributes := promFamilyAttributes(&mf, units)
+			for _, dp := range family {
+				dp.Attributes = attributes
 			}
+		}
 
-			dpCounter.Inc()
-			dps++
+		for _, dp := range family {
+			log.Debug(dp)
 
-			log.Debug(string(dp.Encode()))
+			// Send to Warp
+			if err := emit(dp); err != nil {
+				return core.Reply{}, err
+			}
 		}
 	}
-	return dps, http.StatusAccepted, nil
+	return core.Reply{Code: http.StatusAccepted}, nil
 }
@@ -0,0 +1,312 @@
+package catalyser
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ovh/catalyst/core"
+	"github.com/prometheus/prometheus/pkg/value"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// PromHistogramMapping select how the Prometheus histograms and summaries are stored: as flat `_bucket{le}` and
+// `{quantile}` series (default), as a Warp 10 multivalue per series or as quantiles derived from the buckets
+type PromHistogramMapping struct {
+	mode      string
+	quantiles []float64
+	// previous holds the last buckets of the histograms of the `prometheus.histograms.series` series last written,
+	// the quantiles being estimated on the observations since then
+	previous *core.LRU
+	mutex    sync.Mutex
+}
+
+// NewPromHistogramMapping build the mapping from the `prometheus.histograms` configuration
+func NewPromHistogramMapping() (*PromHistogramMapping, error) {
+	m := &PromHistogramMapping{
+		mode:     viper.GetString("prometheus.histograms.mode"),
+		previous: core.NewLRU(viper.GetInt("prometheus.histograms.series")),
+	}
+	if m.mode == "" {
+		m.mode = "flat"
+	}
+
+	for _, raw := range cast.ToSlice(viper.Get("prometheus.histograms.quantiles")) {
+		q, err := cast.ToFloat64E(raw)
+		if err != nil || q < 0 || q > 1 {
+			return nil, fmt.Errorf("prometheus.histograms: invalid quantile '%v'", raw)
+		}
+		m.quantiles = append(m.quantiles, q)
+	}
+
+	switch m.mode {
+	case "flat", "multivalue":
+	case "quantiles":
+		if len(m.quantiles) == 0 {
+			return nil, fmt.Errorf("prometheus.histograms: quantiles are required with the quantiles mode")
+		}
+	default:
+		return nil, fmt.Errorf("prometheus.histograms: invalid mode '%s'", m.mode)
+	}
+
+	return m, nil
+}
+
+// flat returns whether the datapoints are stored as parsed
+func (m *PromHistogramMapping) flat() bool {
+	return m == nil || m.mode == "flat"
+}
+
+// promBound is a bucket or a quantile of a series
+type promBound struct {
+	raw   string
+	bound float64
+	value float64
+}
+
+// promGroup is a histogram or a summary at a timestamp, the bounds being read from label
+type promGroup struct {
+	name   string
+	label  string
+	series string
+	gts    *core.GTS
+	bounds []promBound
+}
+
+// apply map the `_bucket{le}` and `{quantile}` datapoints of datapoints written with token, the others being kept
+func (m *PromHistogramMapping) apply(token string, datapoints []*core.GTS) []*core.GTS {
+	if m.flat() {
+		return datapoints
+	}
+
+	// Entries keep the order of the datapoints, a group being set at its first datapoint
+	type entry struct {
+		gts   *core.GTS
+		group *promGroup
+	}
+	entries := make([]entry, 0, len(datapoints))
+	groups := map[string]*promGroup{}
+
+	for _, gts := range datapoints {
+		name, label := gts.Name, ""
+		if _, ok := gts.Labels["le"]; ok && strings.HasSuffix(gts.Name, "_bucket") {
+			name, label = strings.TrimSuffix(gts.Name, "_bucket"), "le"
+		} else if _, ok := gts.Labels["quantile"]; ok && m.mode == "multivalue" {
+			label = "quantile"
+		}
+
+		v, isFloat := gts.Value.(float64)
+		bound, err := strconv.ParseFloat(gts.Labels[label], 64)
+		if label == "" || !isFloat || err != nil {
+			entries = append(entries, entry{gts: gts})
+			continue
+		}
+
+		series := promSeriesKey(name, label, gts)
+		key := series + "\x00" + strconv.FormatInt(gts.Ts, 10)
+		group, ok := groups[key]
+		if !ok {
+			group = &promGroup{name: name, label: label, series: series, gts: gts}
+			groups[key] = group
+			entries = append(entries, entry{group: group})
+		}
+		group.bounds = append(group.bounds, promBound{raw: gts.Labels[label], bound: bound, value: v})
+	}
+
+	mapped := make([]*core.GTS, 0, len(entries))
+	for _, e := range entries {
+		if e.group == nil {
+			mapped = append(mapped, e.gts)
+			continue
+		}
+
+		sort.SliceStable(e.group.bounds, func(i, j int) bool { return e.group.bounds[i].bound < e.group.bounds[j].bound })
+		if m.mode == "multivalue" {
+			mapped = append(mapped, e.group.multivalue())
+		} else if buckets, ok := m.window(token, e.group); ok {
+			mapped = append(mapped, e.group.quantiles(m.quantiles, buckets)...)
+		}
+	}
+
+	return mapped
+}
+
+// promSeriesKey returns the name and labels but the bound label of a datapoint
+func promSeriesKey(name, label string, gts *core.GTS) string {
+	names := make([]string, 0, len(gts.Labels))
+	for k := range gts.Labels {
+		if k != label {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+
+	var key strings.Builder
+	key.WriteString(name)
+	for _, k := range names {
+		key.WriteByte(0)
+		key.WriteString(k)
+		key.WriteByte(0)
+		key.WriteString(gts.Labels[k])
+	}
+	return key.String()
+}
+
+// datapoint returns a datapoint of the group, its labels being the ones of the group with label set to bound
+func (g *promGroup) datapoint(name, label, bound string, v interface{}) *core.GTS {
+	labels := make(map[string]string, len(g.gts.Labels))
+	for k, l := range g.gts.Labels {
+		if k != g.label {
+			labels[k] = l
+		}
+	}
+	labels[label] = bound
+
+	return &core.GTS{
+		Ts:         g.gts.Ts,
+		Location:   g.gts.Location,
+		Elevation:  g.gts.Elevation,
+		Name:       name,
+		Labels:     labels,
+		Value:      v,
+		Attributes: g.gts.Attributes,
+	}
+}
+
+// stale returns whether the group holds a staleness marker, the series being gone
+func (g *promGroup) stale() bool {
+	for _, b := range g.bounds {
+		if value.IsStaleNaN(b.value) {
+			return true
+		}
+	}
+	return false
+}
+
+// multivalue returns the values of the group as a Warp 10 multivalue ordered by bound, the bound label holding
+// the bounds
+func (g *promGroup) multivalue() *core.GTS {
+	name := g.name
+	if g.label == "le" {
+		name += "_bucket"
+	}
+
+	raws := make([]string, len(g.bounds))
+	values := make([]string, len(g.bounds))
+	for i, b := range g.bounds {
+		raws[i] = b.raw
+		values[i] = core.EncodeValue(b.value)
+	}
+
+	if g.stale() {
+		return g.datapoint(name, g.label, strings.Join(raws, ","), math.Float64frombits(value.StaleNaN))
+	}
+	return g.datapoint(name, g.label, strings.Join(raws, ","), core.RawValue("[ "+strings.Join(values, " ")+" ]"))
+}
+
+// quantiles returns the quantiles of the observations of a histogram as the `{quantile}` series of a summary
+func (g *promGroup) quantiles(quantiles []float64, buckets []promBucket) []*core.GTS {
+	stale := g.stale()
+	datapoints := make([]*core.GTS, len(quantiles))
+	for i, q := range quantiles {
+		v := math.Float64frombits(value.StaleNaN)
+		if !stale {
+			v = promBucketQuantile(q, buckets)
+		}
+		datapoints[i] = g.datapoint(g.name, "quantile", strconv.FormatFloat(q, 'g', -1, 64), v)
+	}
+	return datapoints
+}
+
+// promBucket is a cumulative bucket of a histogram
+type promBucket struct {
+	bound float64
+	count float64
+}
+
+// window returns the buckets of the observations of a histogram since the previous write of its series, false
+// for its first write. The buckets of a reset histogram are taken whole.
+func (m *PromHistogramMapping) window(token string, g *promGroup) ([]promBucket, bool) {
+	buckets := make([]promBucket, len(g.bounds))
+	for i, b := range g.bounds {
+		buckets[i] = promBucket{bound: b.bound, count: b.value}
+	}
+
+	key := token + "\x00" + g.series
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if g.stale() {
+		m.previous.Remove(key)
+		return nil, true
+	}
+
+	previous, ok := m.previous.Get(key)
+	m.previous.Add(key, buckets)
+	if !ok {
+		return nil, false
+	}
+
+	last := previous.([]promBucket)
+	reset := len(last) != len(buckets)
+	for i := 0; !reset && i < len(buckets); i++ {
+		reset = last[i].bound != buckets[i].bound || buckets[i].count < last[i].count
+	}
+	if reset {
+		return buckets, true
+	}
+
+	increase := make([]promBucket, len(buckets))
+	for i, b := range buckets {
+		increase[i] = promBucket{bound: b.bound, count: b.count - last[i].count}
+	}
+	return increase, true
+}
+
+// promBucketQuantile estimate the q quantile of cumulative buckets ordered by bound, interpolating linearly
+// within a bucket as the Prometheus histogram_quantile function
+func promBucketQuantile(q float64, buckets []promBucket) float64 {
+	switch {
+	case q < 0:
+		return math.Inf(-1)
+	case q > 1:
+		return math.Inf(1)
+	case len(buckets) < 2 || !math.IsInf(buckets[len(buckets)-1].bound, 1):
+		return math.NaN()
+	}
+
+	// Counts read during an observation may decrease
+	counts := make([]float64, len(buckets))
+	for i, b := range buckets {
+		counts[i] = b.count
+		if i > 0 && counts[i] < counts[i-1] {
+			counts[i] = counts[i-1]
+		}
+	}
+
+	observations := counts[len(counts)-1]
+	if observations == 0 || math.IsNaN(observations) {
+		return math.NaN()
+	}
+
+	rank := q * observations
+	b := sort.Search(len(counts)-1, func(i int) bool { return counts[i] >= rank })
+	if b == len(counts)-1 {
+		return buckets[len(buckets)-2].bound
+	}
+	if b == 0 && buckets[0].bound <= 0 {
+		return buckets[0].bound
+	}
+
+	start, end, count := 0.0, buckets[b].bound, counts[b]
+	if b > 0 {
+		start = buckets[b-1].bound
+		count -= counts[b-1]
+		rank -= counts[b-1]
+	}
+	return start + (end-start)*(rank/count)
+}
@@ -0,0 +1,164 @@
+package catalyser
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/ovh/catalyst/core"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/spf13/viper"
+)
+
+// promMetadataEnabled returns whether the metadata of the Prometheus metrics are forwarded as Warp 10 attributes
+func promMetadataEnabled() bool {
+	return viper.GetBool("prometheus.metadata.enabled")
+}
+
+// promAttributes returns the attributes of the series of a family, empty metadata being skipped
+func promAttributes(help, typ, unit string) map[string]string {
+	attributes := map[string]string{}
+	for name, v := range map[string]string{"help": help, "type": typ, "unit": unit} {
+		if v != "" {
+			attributes[name] = v
+		}
+	}
+	if len(attributes) == 0 {
+		return nil
+	}
+	return attributes
+}
+
+// promFamilyAttributes returns the attributes of the series of a decoded family
+func promFamilyAttributes(mf *dto.MetricFamily, units map[string]string) map[string]string {
+	typ := ""
+	if mf.Type != nil {
+		typ = strings.ToLower(mf.GetType().String())
+	}
+	return promAttributes(mf.GetHelp(), typ, units[mf.GetName()])
+}
+
+// promUnits records the `# UNIT <family> <unit>` lines of a text exposition, the text parser reading them
+// as comments
+type promUnits struct {
+	r     *bufio.Reader
+	units map[string]string
+	line  []byte
+	start bool
+	err   error
+}
+
+func newPromUnits(r io.Reader) *promUnits {
+	return &promUnits{r: bufio.NewReader(r), units: map[string]string{}, start: true}
+}
+
+// Read forward the exposition line by line
+func (u *promUnits) Read(p []byte) (int, error) {
+	if len(u.line) == 0 && u.err == nil {
+		line, err := u.r.ReadSlice('\n')
+		if u.start && bytes.HasPrefix(line, []byte("# UNIT ")) {
+			if fields := strings.Fields(string(line)); len(fields) == 4 {
+				u.units[fields[2]] = fields[3]
+			}
+		}
+
+		// A line longer than the buffer is read in several parts
+		u.start = err == nil
+		if err != nil && err != bufio.ErrBufferFull {
+			u.err = err
+		}
+		u.line = line
+	}
+
+	n := copy(p, u.line)
+	u.line = u.line[n:]
+	if len(u.line) == 0 && u.err != nil {
+		return n, u.err
+	}
+	return n, nil
+}
+
+// promMetricMetadata is the metadata of a family sent by remote write, missing from the vendored prompb
+type promMetricMetadata struct {
+	Type             int32  `protobuf:"varint,1,opt,name=type,proto3"`
+	MetricFamilyName string `protobuf:"bytes,2,opt,name=metric_family_name,json=metricFamilyName,proto3"`
+	Help             string `protobuf:"bytes,4,opt,name=help,proto3"`
+	Unit             string `protobuf:"bytes,5,opt,name=unit,proto3"`
+}
+
+func (m *promMetricMetadata) Reset()         { *m = promMetricMetadata{} }
+func (m *promMetricMetadata) String() string { return proto.CompactTextString(m) }
+func (*promMetricMetadata) ProtoMessage()    {}
+
+// promWriteMetadata decodes the metadata field of a remote write request
+type promWriteMetadata struct {
+	Metadata []*promMetricMetadata `protobuf:"bytes,3,rep,name=metadata,proto3"`
+}
+
+func (m *promWriteMetadata) Reset()         { *m = promWriteMetadata{} }
+func (m *promWriteMetadata) String() string { return proto.CompactTextString(m) }
+func (*promWriteMetadata) ProtoMessage()    {}
+
+// promMetricTypes are the names of the remote write metric types
+var promMetricTypes = []string{"unknown", "counter", "gauge", "histogram", "gaugehistogram", "summary", "info", "stateset"}
+
+func (m *promMetricMetadata) attributes() map[string]string {
+	typ := ""
+	if m.Type > 0 && int(m.Type) < len(promMetricTypes) {
+		typ = promMetricTypes[m.Type]
+	}
+	return promAttributes(m.Help, typ, m.Unit)
+}
+
+// promFamilyKey identifies a family of a token
+type promFamilyKey struct {
+	token  string
+	family string
+}
+
+// promFamilyStore keeps the remote write metadata, Prometheus sending them apart from the samples. The least
+// recently used family is evicted beyond `prometheus.metadata.families` entries.
+type promFamilyStore struct {
+	families *core.LRU
+	mutex    sync.Mutex
+}
+
+var promFamilies = &promFamilyStore{}
+
+func (s *promFamilyStore) set(token string, metadata []*promMetricMetadata) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.families == nil {
+		s.families = core.NewLRU(viper.GetInt("prometheus.metadata.families"))
+	}
+	for _, m := range metadata {
+		s.families.Add(promFamilyKey{token: token, family: m.MetricFamilyName}, m.attributes())
+	}
+}
+
+// get returns the attributes of a series, its family being its name or its name without a suffix of the
+// histogram, summary and counter series
+func (s *promFamilyStore) get(token, name string) map[string]string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.families == nil {
+		return nil
+	}
+	if attributes, ok := s.families.Get(promFamilyKey{token: token, family: name}); ok {
+		return attributes.(map[string]string)
+	}
+	for _, suffix := range []string{"_bucket", "_sum", "_count", "_total"} {
+		if strings.HasSuffix(name, suffix) {
+			if attributes, ok := s.families.Get(promFamilyKey{token: token, family: strings.TrimSuffix(name, suffix)}); ok {
+				return attributes.(map[string]string)
+			}
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,709 @@
+package catalyser
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ovh/catalyst/core"
+)
+
+const (
+	// promLookback is the window used to find the last sample of an instant vector
+	promLookback = 5 * time.Minute
+)
+
+// promResponse is the Prometheus HTTP API envelope
+type promResponse struct {
+	Status    string      `json:"status"`
+	Data      interface{} `json:"data,omitempty"`
+	ErrorType string      `json:"errorType,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// promSeries is a series of an instant (Value) or range (Values) query result
+type promSeries struct {
+	Metric map[string]string `json:"metric"`
+	Value  []interface{}     `json:"value,omitempty"`
+	Values [][]interface{}   `json:"values,omitempty"`
+}
+
+// promQuery hold the evaluation parameters of an expression
+type promQuery struct {
+	token string
+	start time.Time
+	end   time.Time
+	step  time.Duration
+}
+
+// PrometheusQuery handle the /api/v1/query API
+func PrometheusQuery(c echo.Context) error {
+	req := c.Request()
+	_ = req.ParseForm()
+
+	ts := time.Now()
+	if t := req.Form.Get("time"); t != "" {
+		var err error
+		if ts, err = parsePromTime(t); err != nil {
+			return promError(c, http.StatusBadRequest, "bad_data", err)
+		}
+	}
+
+	return promEvaluate(c, req.Form.Get("query"), ts, ts, promLookback, false)
+}
+
+// PrometheusQueryRange handle the /api/v1/query_range API
+func PrometheusQueryRange(c echo.Context) error {
+	req := c.Request()
+	_ = req.ParseForm()
+
+	start, err := parsePromTime(req.Form.Get("start"))
+	if err != nil {
+		return promError(c, http.StatusBadRequest, "bad_data", fmt.Errorf("invalid start: %v", err))
+	}
+
+	end, err := parsePromTime(req.Form.Get("end"))
+	if err != nil {
+		return promError(c, http.StatusBadRequest, "bad_data", fmt.Errorf("invalid end: %v", err))
+	}
+
+	step, err := parsePromStep(req.Form.Get("step"))
+	if err != nil {
+		return promError(c, http.StatusBadRequest, "bad_data", fmt.Errorf("invalid step: %v", err))
+	}
+
+	if end.Before(start) {
+		return promError(c, http.StatusBadRequest, "bad_data", fmt.Errorf("end timestamp must not be before start time"))
+	}
+
+	if end.Sub(start)/step > 11000 {
+		return promError(c, http.StatusBadRequest, "bad_data", fmt.Errorf("exceeded maximum resolution of 11,000 points per timeseries"))
+	}
+
+	return promEvaluate(c, req.Form.Get("query"), start, end, step, true)
+}
+
+// PrometheusSeries handle the /api/v1/series API
+func PrometheusSeries(c echo.Context) error {
+	req := c.Request()
+	_ = req.ParseForm()
+
+	matches := req.Form["match[]"]
+	if len(matches) == 0 {
+		return promError(c, http.StatusBadRequest, "bad_data", fmt.Errorf("no match[] parameter provided"))
+	}
+
+	token, err := core.GetToken(req)
+	if err != nil {
+		return promError(c, http.StatusUnauthorized, "bad_data", err)
+	}
+
+	script := "[\n"
+	for _, match := range matches {
+		node, err := parsePromQL(match)
+		if err != nil {
+			return promError(c, http.StatusBadRequest, "bad_data", err)
+		}
+
+		sel, ok := node.(*promSelector)
+		if !ok || sel.Range != 0 {
+			return promError(c, http.StatusBadRequest, "bad_data", fmt.Errorf("match[] must be an instant vector selector"))
+		}
+
+		class, labels, err := promSelectors(sel)
+		if err != nil {
+			return promError(c, http.StatusBadRequest, "bad_data", err)
+		}
+
+		script += fmt.Sprintf("[ %s %s %s ] FIND\n", core.WarpScriptString(token), core.WarpScriptString(class), core.WarpScriptLabels(labels))
+	}
+	script += "] FLATTEN\n"
+
+	var gtss []core.ExecGTS
+	if err := promExec(c, script, &gtss); err != nil {
+		return promFail(c, err)
+	}
+
+	seen := map[string]bool{}
+	series := []map[string]string{}
+	for _, gts := range gtss {
+		metric := promMetric(gts, false)
+		key := fmt.Sprint(metric)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		series = append(series, metric)
+	}
+
+	return c.JSON(http.StatusOK, promResponse{Status: "success", Data: series})
+}
+
+// PrometheusLabels handle the /api/v1/labels API
+func PrometheusLabels(c echo.Context) error {
+	sets, err := promFindSets(c)
+	if err != nil {
+		return promFail(c, err)
+	}
+
+	names := []string{"__name__"}
+	for name := range sets.labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return c.JSON(http.StatusOK, promResponse{Status: "success", Data: names})
+}
+
+// PrometheusLabelValues handle the /api/v1/label/<name>/values API
+func PrometheusLabelValues(c echo.Context) error {
+	sets, err := promFindSets(c)
+	if err != nil {
+		return promFail(c, err)
+	}
+
+	values := sets.labels[c.Param("name")]
+	if c.Param("name") == "__name__" {
+		values = sets.classes
+	}
+	if values == nil {
+		values = []string{}
+	}
+	sort.Strings(values)
+
+	return c.JSON(http.StatusOK, promResponse{Status: "success", Data: values})
+}
+
+type promSets struct {
+	classes []string
+	labels  map[string][]string
+}
+
+// promFindSets returns the classes and label values of the token using FINDSETS
+func promFindSets(c echo.Context) (*promSets, error) {
+	token, err := core.GetToken(c.Request())
+	if err != nil {
+		return nil, promAPIError{http.StatusUnauthorized, "bad_data", err}
+	}
+
+	script := fmt.Sprintf("[ %s '~.*' {} ] FINDSETS DROP 2 ->LIST\n", core.WarpScriptString(token))
+
+	var res []json.RawMessage
+	if err := promExec(c, script, &res); err != nil {
+		return nil, err
+	}
+
+	sets := &promSets{}
+	if len(res) != 2 || json.Unmarshal(res[0], &sets.classes) != nil || json.Unmarshal(res[1], &sets.labels) != nil {
+		return nil, promAPIError{http.StatusBadGateway, "execution", fmt.Errorf("unexpected WarpScript result")}
+	}
+
+	return sets, nil
+}
+
+// promEvaluate translate an expression into WarpScript, execute it and render the result
+func promEvaluate(c echo.Context, query string, start, end time.Time, step time.Duration, matrix bool) error {
+	if query == "" {
+		return promError(c, http.StatusBadRequest, "bad_data", fmt.Errorf("missing query"))
+	}
+
+	node, err := parsePromQL(query)
+	if err != nil {
+		return promError(c, http.StatusBadRequest, "bad_data", err)
+	}
+
+	// Scalar expressions don't need Warp 10
+	if n, ok := node.(*promNumber); ok {
+		if matrix {
+			return promError(c, http.StatusBadRequest, "bad_data", fmt.Errorf("scalar range queries are not supported"))
+		}
+		return c.JSON(http.StatusOK, promResponse{
+			Status: "success",
+			Data: map[string]interface{}{
+				"resultType": "scalar",
+				"result":     promSample(core.Timestamp(start), n.Value),
+			},
+		})
+	}
+
+	token, err := core.GetToken(c.Request())
+	if err != nil {
+		return promError(c, http.StatusUnauthorized, "bad_data", err)
+	}
+
+	q := &promQuery{
+		token: token,
+		start: start,
+		end:   end,
+		step:  step,
+	}
+
+	// histogram_quantile is computed on the buckets returned by Warp 10
+	quantile := math.NaN()
+	if call, ok := node.(*promCall); ok && call.Func == "histogram_quantile" {
+		quantile = call.Args[0].(*promNumber).Value
+		node = call.Args[1]
+	}
+
+	script, err := q.compile(node)
+	if err != nil {
+		return promError(c, http.StatusBadRequest, "bad_data", err)
+	}
+
+	var gtss []core.ExecGTS
+	if err := promExec(c, "[ "+script+" ] FLATTEN\n", &gtss); err != nil {
+		return promFail(c, err)
+	}
+
+	_, isSelector := node.(*promSelector)
+	dropName := !isSelector
+
+	if !math.IsNaN(quantile) {
+		gtss = promHistogramQuantile(quantile, gtss)
+		dropName = true
+	}
+
+	result := []promSeries{}
+	for _, gts := range gtss {
+		if len(gts.Values) == 0 {
+			continue
+		}
+		gts.Sort()
+
+		s := promSeries{
+			Metric: promMetric(gts, dropName),
+		}
+
+		if matrix {
+			s.Values = make([][]interface{}, 0, len(gts.Values))
+			for i := range gts.Values {
+				ts, value := gts.Point(i)
+				s.Values = append(s.Values, promSample(ts, value))
+			}
+		} else {
+			_, value := gts.Point(len(gts.Values) - 1)
+			s.Value = promSample(core.Timestamp(end), value)
+		}
+
+		result = append(result, s)
+	}
+
+	resultType := "vector"
+	if matrix {
+		resultType = "matrix"
+	}
+
+	return c.JSON(http.StatusOK, promResponse{
+		Status: "success",
+		Data: map[string]interface{}{
+			"resultType": resultType,
+			"result":     result,
+		},
+	})
+}
+
+// compile translate a node into a WarpScript pushing a list of GTS aligned on the query steps
+func (q *promQuery) compile(node promNode) (string, error) {
+	switch n := node.(type) {
+	case *promSelector:
+		if n.Range != 0 {
+			return "", fmt.Errorf("range vector selectors are only supported in rate, irate and increase")
+		}
+
+		fetch, err := q.fetch(n, 0)
+		if err != nil {
+			return "", err
+		}
+		return fetch + " " + q.bucketize(), nil
+
+	case *promCall:
+		switch n.Func {
+		case "rate", "irate", "increase":
+			sel := n.Args[0].(*promSelector)
+			fetch, err := q.fetch(sel, sel.Range)
+			if err != nil {
+				return "", err
+			}
+
+			window := fmt.Sprintf("-%d", core.Units(sel.Range))
+			mapper := "mapper.rate " + window
+			switch n.Func {
+			case "irate":
+				mapper = "mapper.rate 1"
+			case "increase":
+				mapper = "mapper.delta " + window
+			}
+
+			// Compensate counter resets before computing the rate over the range window
+			return fmt.Sprintf("[ %s true RESETS %s 0 0 ] MAP %s", fetch, mapper, q.bucketize()), nil
+		}
+
+		return "", fmt.Errorf("%s is only supported as the outermost function", n.Func)
+
+	case *promAggregate:
+		inner, err := q.compile(n.Expr)
+		if err != nil {
+			return "", err
+		}
+
+		reducer := map[string]string{
+			"sum":   "reducer.sum",
+			"avg":   "reducer.mean",
+			"max":   "reducer.max",
+			"min":   "reducer.min",
+			"count": "reducer.count",
+		}[n.Op]
+
+		by := ""
+		for _, label := range n.By {
+			by += " " + core.WarpScriptString(label)
+		}
+
+		// Only keep the grouping labels
+		return fmt.Sprintf("[ %s [%s ] %s ] REDUCE <%% DROP DUP LABELS [%s ] SUBMAP 'labels' STORE { NULL NULL } RELABEL $labels RELABEL %%> LMAP",
+			inner, by, reducer, by), nil
+
+	case *promBinary:
+		return q.compileBinary(n)
+
+	case *promNumber:
+		return "", fmt.Errorf("unexpected scalar")
+	}
+
+	return "", fmt.Errorf("unsupported expression")
+}
+
+func (q *promQuery) compileBinary(n *promBinary) (string, error) {
+	l, lScalar := n.LHS.(*promNumber)
+	r, rScalar := n.RHS.(*promNumber)
+
+	switch {
+	case rScalar:
+		vector, err := q.compile(n.LHS)
+		if err != nil {
+			return "", err
+		}
+
+		switch n.Op {
+		case "+":
+			return promMap(vector, r.Value, "mapper.add"), nil
+		case "-":
+			return promMap(vector, -r.Value, "mapper.add"), nil
+		case "*":
+			return promMap(vector, r.Value, "mapper.mul"), nil
+		}
+
+		// The infinite factor would not be a WarpScript number
+		if r.Value == 0 {
+			return "", fmt.Errorf("division by zero is not supported")
+		}
+		return promMap(vector, 1/r.Value, "mapper.mul"), nil
+
+	case lScalar:
+		vector, err := q.compile(n.RHS)
+		if err != nil {
+			return "", err
+		}
+
+		switch n.Op {
+		case "+":
+			return promMap(vector, l.Value, "mapper.add"), nil
+		case "-":
+			return promMap(promMap(vector, -1, "mapper.mul"), l.Value, "mapper.add"), nil
+		case "*":
+			return promMap(vector, l.Value, "mapper.mul"), nil
+		}
+		return promMap(promMap(vector, -1, "mapper.pow"), l.Value, "mapper.mul"), nil
+	}
+
+	lhs, err := q.compile(n.LHS)
+	if err != nil {
+		return "", err
+	}
+
+	rhs, err := q.compile(n.RHS)
+	if err != nil {
+		return "", err
+	}
+
+	op := map[string]string{
+		"+": "op.add",
+		"-": "op.sub",
+		"*": "op.mul",
+		"/": "op.div",
+	}[n.Op]
+
+	// One-to-one matching on all the labels, the class names being ignored
+	return fmt.Sprintf("[ %s %s NULL %s ] APPLY", lhs, rhs, op), nil
+}
+
+// fetch returns the FETCH of a selector, extended by window before the first step
+func (q *promQuery) fetch(sel *promSelector, window time.Duration) (string, error) {
+	class, labels, err := promSelectors(sel)
+	if err != nil {
+		return "", err
+	}
+
+	start := q.start.Add(-q.step - window)
+	return fmt.Sprintf("{ 'token' %s 'class' %s 'labels' %s 'start' %s 'end' %s } FETCH",
+		core.WarpScriptString(q.token),
+		core.WarpScriptString(class),
+		core.WarpScriptLabels(labels),
+		core.WarpScriptString(start.UTC().Format(time.RFC3339Nano)),
+		core.WarpScriptString(q.end.UTC().Format(time.RFC3339Nano)),
+	), nil
+}
+
+// bucketize align the GTS on the query steps using the last value of each step
+func (q *promQuery) bucketize() string {
+	count := int64(q.end.Sub(q.start)/q.step) + 1
+	return fmt.Sprintf("[ SWAP bucketizer.last %d %d %d ] BUCKETIZE", core.Timestamp(q.end), core.Units(q.step), count)
+}
+
+func promMap(vector string, value float64, mapper string) string {
+	return fmt.Sprintf("[ %s %s %s 0 0 0 ] MAP", vector, strconv.FormatFloat(value, 'g', -1, 64), mapper)
+}
+
+// promSelectors returns the Warp 10 class and labels selectors of a PromQL selector
+func promSelectors(sel *promSelector) (string, map[string]string, error) {
+	class := "~.*"
+	if sel.Name != "" {
+		class = "=" + sel.Name
+	}
+
+	regexps := map[string][]string{}
+	for _, m := range sel.Matchers {
+		if m.Value == "" && (m.Op == "=" || m.Op == "!=") {
+			return "", nil, fmt.Errorf("matching on empty label values is not supported: %s%s\"\"", m.Name, m.Op)
+		}
+
+		if _, err := regexp.Compile(m.Value); err != nil && (m.Op == "=~" || m.Op == "!~") {
+			return "", nil, fmt.Errorf("invalid regular expression %q: %v", m.Value, err)
+		}
+
+		re := ""
+		switch m.Op {
+		case "=":
+			re = regexp.QuoteMeta(m.Value)
+		case "!=":
+			re = "(?!" + regexp.QuoteMeta(m.Value) + "$).*"
+		case "=~":
+			re = "(?:" + m.Value + ")"
+		case "!~":
+			re = "(?!(?:" + m.Value + ")$).*"
+		}
+		regexps[m.Name] = append(regexps[m.Name], re)
+	}
+
+	labels := map[string]string{}
+	for name, res := range regexps {
+		selector := "~^" + res[0] + "$"
+		if len(res) > 1 {
+			selector = "~^"
+			for _, re := range res {
+				selector += "(?=" + re + "$)"
+			}
+			selector += ".*$"
+		}
+
+		if name == "__name__" {
+			class = selector
+			continue
+		}
+		labels[name] = selector
+	}
+
+	// Keep exact selectors when possible
+	for _, m := range sel.Matchers {
+		if m.Op == "=" && len(regexps[m.Name]) == 1 && m.Name != "__name__" {
+			labels[m.Name] = "=" + m.Value
+		}
+	}
+
+	return class, labels, nil
+}
+
+// promAPIError is an error to render using the Prometheus error envelope
+type promAPIError struct {
+	code      int
+	errorType string
+	err       error
+}
+
+func (e promAPIError) Error() string {
+	return e.err.Error()
+}
+
+// promExec run a script expecting a single element on the stack, decoded into result
+func promExec(c echo.Context, script string, result interface{}) error {
+	token, err := core.GetToken(c.Request())
+	if err != nil {
+		return promAPIError{http.StatusUnauthorized, "bad_data", err}
+	}
+
+	body, err := core.Exec("prometheus", token, c.Get("txn").(string), script)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"txn": c.Get("txn"),
+		}).Warn("Failed to execute PromQL query")
+		return promAPIError{core.ExecStatus(err), "execution", err}
+	}
+
+	var stack []json.RawMessage
+	if err := json.Unmarshal(body, &stack); err != nil || len(stack) != 1 {
+		return promAPIError{http.StatusBadGateway, "execution", fmt.Errorf("unexpected WarpScript result")}
+	}
+
+	if err := json.Unmarshal(stack[0], result); err != nil {
+		return promAPIError{http.StatusBadGateway, "execution", fmt.Errorf("unexpected WarpScript result: %v", err)}
+	}
+
+	return nil
+}
+
+// promFail render an error returned by promExec or promFindSets
+func promFail(c echo.Context, err error) error {
+	if e, ok := err.(promAPIError); ok {
+		return promError(c, e.code, e.errorType, e.err)
+	}
+	return promError(c, http.StatusInternalServerError, "internal", err)
+}
+
+func promError(c echo.Context, code int, errorType string, err error) error {
+	return c.JSON(code, promResponse{
+		Status:    "error",
+		ErrorType: errorType,
+		Error:     err.Error(),
+	})
+}
+
+func promMetric(gts core.ExecGTS, dropName bool) map[string]string {
+	metric := make(map[string]string, len(gts.Labels)+1)
+	for k, v := range gts.Labels {
+		metric[k] = v
+	}
+	if !dropName {
+		metric["__name__"] = gts.Class
+	}
+	return metric
+}
+
+// promSample format a [timestamp, "value"] pair, timestamp being in platform time units
+func promSample(ts int64, value interface{}) []interface{} {
+	v := ""
+	switch value := value.(type) {
+	case float64:
+		v = promFormatFloat(value)
+	case bool:
+		v = "0"
+		if value {
+			v = "1"
+		}
+	default:
+		v = fmt.Sprint(value)
+	}
+
+	return []interface{}{float64(ts) / float64(core.UnitsPerSecond()), v}
+}
+
+func promFormatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// parsePromTime parse an unix timestamp in seconds or a RFC3339 date
+func parsePromTime(s string) (time.Time, error) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(frac*1e9)), nil
+	}
+
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+// parsePromStep parse a step in seconds or a duration
+func parsePromStep(s string) (time.Duration, error) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		if f <= 0 {
+			return 0, fmt.Errorf("zero or negative step")
+		}
+		return time.Duration(f * float64(time.Second)), nil
+	}
+
+	p := &promParser{input: s}
+	d, err := p.parseDuration()
+	if err != nil || p.pos != len(s) {
+		return 0, fmt.Errorf("cannot parse %q to a valid duration", s)
+	}
+	return d, nil
+}
+
+// promHistogramQuantile compute the quantile of the buckets series grouped by their labels except `le`
+func promHistogramQuantile(q float64, gtss []core.ExecGTS) []core.ExecGTS {
+	type histogram struct {
+		labels  map[string]string
+		buckets map[int64][]promBucket
+	}
+
+	histograms := map[string]*histogram{}
+	keys := []string{}
+	for _, gts := range gtss {
+		le, err := strconv.ParseFloat(gts.Labels["le"], 64)
+		if err != nil {
+			continue
+		}
+
+		labels := map[string]string{}
+		for k, v := range gts.Labels {
+			if k != "le" {
+				labels[k] = v
+			}
+		}
+		key := fmt.Sprint(labels)
+
+		h, ok := histograms[key]
+		if !ok {
+			h = &histogram{labels: labels, buckets: map[int64][]promBucket{}}
+			histograms[key] = h
+			keys = append(keys, key)
+		}
+
+		for i := range gts.Values {
+			ts, value := gts.Point(i)
+			if f, ok := value.(float64); ok {
+				h.buckets[ts] = append(h.buckets[ts], promBucket{bound: le, count: f})
+			}
+		}
+	}
+
+	res := make([]core.ExecGTS, 0, len(keys))
+	for _, key := range keys {
+		h := histograms[key]
+		gts := core.ExecGTS{Labels: h.labels}
+
+		for ts, buckets := range h.buckets {
+			sort.Slice(buckets, func(i, j int) bool { return buckets[i].bound < buckets[j].bound })
+			value := promBucketQuantile(q, buckets)
+			gts.Values = append(gts.Values, []interface{}{float64(ts), value})
+		}
+
+		res = append(res, gts)
+	}
+
+	return res
+}
@@ -3,53 +3,92 @@ package catalyser
 import (
 	"io"
 	"io/ioutil"
-	"math"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/golang/snappy"
 	"github.com/ovh/catalyst/core"
-	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/prometheus/prompb"
 	log "github.com/sirupsen/logrus"
 )
 
-// HandleRemoteWrite support remote_write protocol
+// NewRemoteWrite returns a remote_write catalyser mapping the histograms and summaries with mapping
 // https://github.com/prometheus/prometheus/tree/0e0fc5a7f45ce28632f43f1ead0183ee82c7afca/documentation/examples/remote_storage/remote_storage_adapter
-func HandleRemoteWrite(url *url.URL, headers *http.Header, r io.Reader, send func([]byte) error, dpCounter prometheus.Counter) (int, int, error) {
-	dps := 0
+func NewRemoteWrite(mapping *PromHistogramMapping) core.CatalyserFunc {
+	return func(url *url.URL, headers *http.Header, r io.Reader, emit core.Emit) (core.Reply, error) {
+		return remoteWrite(url, headers, r, emit, mapping)
+	}
+}
 
+func remoteWrite(url *url.URL, headers *http.Header, r io.Reader, emit core.Emit, mapping *PromHistogramMapping) (core.Reply, error) {
 	compressed, err := ioutil.ReadAll(r)
 	if err != nil {
 		log.WithError(err).Error("Cannot read body")
-		return 0, http.StatusBadRequest, err
+		return core.Reply{}, err
 	}
 
 	reqBuf, err := snappy.Decode(nil, compressed)
 	if err != nil {
 		log.Error("msg", "Decode error", "err", err.Error())
-		return 0, http.StatusInternalServerError, err
+		return core.Reply{}, err
 	}
 
 	var wReq prompb.WriteRequest
 	if err := proto.Unmarshal(reqBuf, &wReq); err != nil {
-		return 0, http.StatusBadRequest, err
+		return core.Reply{}, err
+	}
+
+	// Metadata are sent by family, usually in requests without samples
+	metadata := promMetadataEnabled()
+	token, _ := core.GetToken(&http.Request{URL: url, Header: *headers})
+	if metadata {
+		var wMeta promWriteMetadata
+		if err := proto.Unmarshal(reqBuf, &wMeta); err != nil {
+			return core.Reply{}, err
+		}
+		promFamilies.set(token, wMeta.Metadata)
 	}
 
+	// Without type, histograms and summaries are the _bucket{le} and {quantile} series of the whole request
+	geo := newGeoMapping("prometheus")
+	var request []*core.GTS
 	for _, promGts := range wReq.GetTimeseries() {
-		for _, gts := range formatPromGts(promGts) {
-			_ = send(gts.Encode())
-			dpCounter.Inc()
-			dps++
+		gtss, err := formatPromGts(promGts, geo)
+		if err != nil {
+			return core.Reply{}, err
+		}
+
+		if metadata {
+			for _, gts := range gtss {
+				gts.Attributes = promFamilies.get(token, gts.Name)
+			}
+		}
+
+		if !mapping.flat() {
+			request = append(request, gtss...)
+			continue
+		}
+
+		for _, gts := range gtss {
+			if err := emit(gts); err != nil {
+				return core.Reply{}, err
+			}
+		}
+	}
+
+	for _, gts := range mapping.apply(token, request) {
+		if err := emit(gts); err != nil {
+			return core.Reply{}, err
 		}
 	}
 
-	// dps processed, response status code, error
-	return dps, http.StatusOK, nil
+	// response status code, error
+	return core.Reply{Code: http.StatusOK}, nil
 }
 
-func formatPromGts(ts *prompb.TimeSeries) []*core.GTS {
+func formatPromGts(ts *prompb.TimeSeries, geo geoMapping) ([]*core.GTS, error) {
 	gtss := make([]*core.GTS, len(ts.GetSamples()))
 
 	name := ""
@@ -64,23 +103,25 @@ func formatPromGts(ts *prompb.TimeSeries) []*core.GTS {
 		labels[label.GetName()] = label.GetValue()
 	}
 
-	for i, dp := range ts.GetSamples() {
-		v := dp.GetValue()
-
-		// +Inf, -Inf -> 0
-		if v == math.Inf(1) || v == math.Inf(-1) || math.IsNaN(v) {
-			v = 0
-		}
+	// The position labels are the same for all the samples of the series
+	series := core.GTS{Name: name, Labels: labels}
+	if err := geo.fromLabels(&series); err != nil {
+		return nil, core.NewParsingError(err.Error(), name)
+	}
 
+	// NaN, infinite values and staleness markers are handled by the pipeline
+	for i, dp := range ts.GetSamples() {
 		gtss[i] = &core.GTS{
-			Name:   name,
-			Labels: labels,
-			Ts:     float64(dp.GetTimestamp() * 1000), // ms -> μs
-			Value:  v,
+			Name:      name,
+			Labels:    series.Labels,
+			Location:  series.Location,
+			Elevation: series.Elevation,
+			Ts:        core.Timestamp(time.Unix(0, dp.GetTimestamp()*int64(time.Millisecond))),
+			Value:     dp.GetValue(),
 		}
 	}
 
 	log.Debug(len(gtss))
 
-	return gtss
+	return gtss, nil
 }
@@ -0,0 +1,270 @@
+package catalyser
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/ovh/catalyst/core"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/spf13/viper"
+)
+
+const promHistogramText = `# TYPE http_duration_seconds histogram
+http_duration_seconds_bucket{path="/",le="0.1"} 50 1546420308000
+http_duration_seconds_bucket{path="/",le="0.5"} 90 1546420308000
+http_duration_seconds_bucket{path="/",le="+Inf"} 100 1546420308000
+http_duration_seconds_sum{path="/"} 20.5 1546420308000
+http_duration_seconds_count{path="/"} 100 1546420308000
+# TYPE rpc_seconds summary
+rpc_seconds{quantile="0.5"} 0.2 1546420308000
+rpc_seconds{quantile="0.9"} 0.7 1546420308000
+rpc_seconds_sum 12 1546420308000
+rpc_seconds_count 30 1546420308000
+`
+
+// promHistogramBaseline is a previous write of the histogram of promHistogramText without observations
+const promHistogramBaseline = `# TYPE http_duration_seconds histogram
+http_duration_seconds_bucket{path="/",le="0.1"} 0 1546420248000
+http_duration_seconds_bucket{path="/",le="0.5"} 0 1546420248000
+http_duration_seconds_bucket{path="/",le="+Inf"} 0 1546420248000
+`
+
+// promWriteRequest returns the remote write payload of the samples of promHistogramText
+func promWriteRequest() []byte {
+	var req prompb.WriteRequest
+	for _, line := range strings.Split(strings.TrimSpace(promHistogramText), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		gts, err := parsePromTestLine(line)
+		if err != nil {
+			panic(err)
+		}
+
+		ts := &prompb.TimeSeries{Labels: []*prompb.Label{{Name: "__name__", Value: gts.Name}}}
+		for k, v := range gts.Labels {
+			ts.Labels = append(ts.Labels, &prompb.Label{Name: k, Value: v})
+		}
+		ts.Samples = []*prompb.Sample{{Value: gts.Value.(float64), Timestamp: 1546420308000}}
+		req.Timeseries = append(req.Timeseries, ts)
+	}
+
+	raw, err := proto.Marshal(&req)
+	if err != nil {
+		panic(err)
+	}
+	return snappy.Encode(nil, raw)
+}
+
+// parsePromTestLine parse a line of promHistogramText using the text catalyser
+func parsePromTestLine(line string) (*core.GTS, error) {
+	var gts *core.GTS
+	_, err := NewPrometheus(nil)(&url.URL{Path: "/prometheus/metrics/job/t"}, &http.Header{}, strings.NewReader(line+"\n"), func(dp *core.GTS) error {
+		gts = dp
+		return nil
+	})
+	return gts, err
+}
+
+// promTestSeries returns the sorted `class{labels} value` of the datapoints
+func promTestSeries(t *testing.T, catalyser core.CatalyserFunc, body []byte) []string {
+	var series []string
+	_, err := catalyser(&url.URL{Path: "/prometheus/metrics/job/t"}, &http.Header{}, bytes.NewReader(body), func(gts *core.GTS) error {
+		line := string(gts.Encode())
+		series = append(series, strings.TrimSpace(line[strings.IndexByte(line, ' ')+1:]))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(series)
+	return series
+}
+
+func TestPromHistogramMapping(t *testing.T) {
+	tests := []struct {
+		mapping  *PromHistogramMapping
+		expected []string
+	}{
+		{
+			mapping: &PromHistogramMapping{mode: "multivalue"},
+			expected: []string{
+				"http_duration_seconds_bucket{job=t,le=0.1%2C0.5%2C%2BInf,path=%2F} [ 50.0 90.0 100.0 ]",
+				"http_duration_seconds_count{job=t,path=%2F} 100.0",
+				"http_duration_seconds_sum{job=t,path=%2F} 20.5",
+				"rpc_seconds_count{job=t} 30.0",
+				"rpc_seconds_sum{job=t} 12.0",
+				"rpc_seconds{job=t,quantile=0.5%2C0.9} [ 0.2 0.7 ]",
+			},
+		},
+		{
+			mapping: &PromHistogramMapping{mode: "quantiles", quantiles: []float64{0.5, 0.95}, previous: core.NewLRU(0)},
+			expected: []string{
+				"http_duration_seconds_count{job=t,path=%2F} 100.0",
+				"http_duration_seconds_sum{job=t,path=%2F} 20.5",
+				"http_duration_seconds{job=t,path=%2F,quantile=0.5} 0.1",
+				"http_duration_seconds{job=t,path=%2F,quantile=0.95} 0.5",
+				"rpc_seconds_count{job=t} 30.0",
+				"rpc_seconds_sum{job=t} 12.0",
+				"rpc_seconds{job=t,quantile=0.5} 0.2",
+				"rpc_seconds{job=t,quantile=0.9} 0.7",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		// Quantiles are estimated from the observations since the previous write
+		baseline := func() {
+			if test.mapping.mode == "quantiles" {
+				promTestSeries(t, NewPrometheus(test.mapping), []byte(promHistogramBaseline))
+			}
+		}
+
+		baseline()
+		text := promTestSeries(t, NewPrometheus(test.mapping), []byte(promHistogramText))
+		if !reflect.DeepEqual(text, test.expected) {
+			t.Errorf("%s: got %q", test.mapping.mode, text)
+		}
+
+		// Remote write series are named as the text ones
+		baseline()
+		if remote := promTestSeries(t, NewRemoteWrite(test.mapping), promWriteRequest()); !reflect.DeepEqual(remote, text) {
+			t.Errorf("%s: got %q from remote write", test.mapping.mode, remote)
+		}
+	}
+
+	if flat := promTestSeries(t, NewPrometheus(nil), []byte(promHistogramText)); len(flat) != 9 {
+		t.Errorf("flat: got %q", flat)
+	}
+}
+
+func TestPromBucketQuantile(t *testing.T) {
+	buckets := []promBucket{{bound: 1, count: 10}, {bound: 2, count: 30}, {bound: 4, count: 40}}
+	inf := append(append([]promBucket{}, buckets...), promBucket{bound: math.Inf(1), count: 40})
+	for q, expected := range map[float64]float64{0.25: 1, 0.5: 1.5, 0.75: 2, -1: math.Inf(-1), 2: math.Inf(1)} {
+		if got := promBucketQuantile(q, buckets); !math.IsNaN(got) && q >= 0 && q <= 1 {
+			t.Errorf("%v: got %v without +Inf bucket", q, got)
+		}
+		if got := promBucketQuantile(q, inf); got != expected {
+			t.Errorf("%v: got %v, expected %v", q, got, expected)
+		}
+	}
+}
+
+func TestPromHistogramWindow(t *testing.T) {
+	m := &PromHistogramMapping{mode: "quantiles", quantiles: []float64{0.5}, previous: core.NewLRU(0)}
+	// counts are the cumulative counts of the 1, 2 and +Inf buckets
+	write := func(token string, counts ...float64) []string {
+		var datapoints []*core.GTS
+		for i, le := range []string{"1", "2", "+Inf"} {
+			datapoints = append(datapoints, &core.GTS{Ts: 1, Name: "latency_bucket", Labels: map[string]string{"host": "a", "le": le}, Value: counts[i]})
+		}
+		datapoints = append(datapoints,
+			&core.GTS{Ts: 1, Name: "latency_sum", Labels: map[string]string{"host": "a"}, Value: float64(0)},
+			&core.GTS{Ts: 1, Name: "latency_count", Labels: map[string]string{"host": "a"}, Value: counts[2]})
+
+		var quantiles []string
+		for _, gts := range m.apply(token, datapoints) {
+			if gts.Name == "latency" {
+				quantiles = append(quantiles, core.EncodeValue(gts.Value))
+			}
+		}
+		return quantiles
+	}
+
+	// The first write of a series only records its buckets, the next ones using the observations since then
+	if got := write("a", 10, 10, 10); got != nil {
+		t.Errorf("got %q on the first write", got)
+	}
+	if got := write("b", 0, 10, 10); got != nil {
+		t.Errorf("got %q on the first write of another token", got)
+	}
+	if got := write("a", 10, 20, 20); !reflect.DeepEqual(got, []string{"1.5"}) {
+		t.Errorf("got %q", got)
+	}
+	if got := write("a", 10, 20, 20); !reflect.DeepEqual(got, []string{"NaN"}) {
+		t.Errorf("got %q without observations", got)
+	}
+	if got := write("a", 4, 4, 4); !reflect.DeepEqual(got, []string{"0.5"}) {
+		t.Errorf("got %q after a reset", got)
+	}
+}
+
+func TestPromMetadata(t *testing.T) {
+	viper.Set("prometheus.metadata.enabled", true)
+	defer viper.Reset()
+
+	attributes := func(catalyser core.CatalyserFunc, body []byte) map[string]map[string]string {
+		found := map[string]map[string]string{}
+		header := http.Header{"X-Warp10-Token": []string{"token"}}
+		_, err := catalyser(&url.URL{Path: "/prometheus/metrics/job/t"}, &header, bytes.NewReader(body), func(gts *core.GTS) error {
+			found[gts.Name] = gts.Attributes
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return found
+	}
+
+	text := "# HELP http_duration_seconds Request duration.\n# UNIT http_duration_seconds seconds\n" + promHistogramText
+	expected := map[string]map[string]string{
+		"http_duration_seconds_bucket": {"help": "Request duration.", "type": "histogram", "unit": "seconds"},
+		"http_duration_seconds_sum":    {"help": "Request duration.", "type": "histogram", "unit": "seconds"},
+		"http_duration_seconds_count":  {"help": "Request duration.", "type": "histogram", "unit": "seconds"},
+		"rpc_seconds":                  {"type": "summary"},
+		"rpc_seconds_sum":              {"type": "summary"},
+		"rpc_seconds_count":            {"type": "summary"},
+	}
+	if got := attributes(NewPrometheus(nil), []byte(text)); !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %v from text", got)
+	}
+
+	// Remote write metadata are sent apart from the samples
+	raw, err := proto.Marshal(&promWriteMetadata{Metadata: []*promMetricMetadata{
+		{Type: 3, MetricFamilyName: "http_duration_seconds", Help: "Request duration.", Unit: "seconds"},
+		{Type: 5, MetricFamilyName: "rpc_seconds"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := attributes(NewRemoteWrite(nil), snappy.Encode(nil, raw)); len(got) != 0 {
+		t.Errorf("got %v without samples", got)
+	}
+	if got := attributes(NewRemoteWrite(&PromHistogramMapping{mode: "multivalue"}), promWriteRequest()); !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %v from remote write", got)
+	}
+}
+
+func TestPromRemoteWriteGeo(t *testing.T) {
+	geo := geoMapping{latitude: "lat", longitude: "lon"}
+	ts := &prompb.TimeSeries{
+		Labels: []*prompb.Label{
+			{Name: "__name__", Value: "temp"},
+			{Name: "lat", Value: "48.85"},
+			{Name: "lon", Value: "2.35"},
+		},
+		Samples: []*prompb.Sample{{Value: 21, Timestamp: 1}},
+	}
+
+	gtss, err := formatPromGts(ts, geo)
+	if err != nil || len(gtss) != 1 || gtss[0].Location == nil || len(gtss[0].Labels) != 0 {
+		t.Fatalf("got %v, %v", gtss, err)
+	}
+
+	// An invalid position answers a 422 as the other parsing errors
+	ts.Labels[2].Value = "east"
+	if _, err := formatPromGts(ts, geo); err == nil {
+		t.Error("expected an error for an invalid longitude")
+	} else if _, ok := err.(core.ParsingError); !ok {
+		t.Errorf("expected a parsing error, got %T %v", err, err)
+	}
+}
@@ -0,0 +1,415 @@
+package catalyser
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ovh/catalyst/core"
+)
+
+const (
+	// tsdbHeadID is the key used in the import state for the in-memory head (WAL)
+	tsdbHeadID = "head"
+	// tsdbMaxSamples is the maximum number of samples converted at once for a single series
+	tsdbMaxSamples = 10000
+)
+
+var tsdbMatcherRegexp = regexp.MustCompile(`^\s*([a-zA-Z_][a-zA-Z0-9_]*)\s*(=~|!~|!=|=)\s*"?(.*?)"?\s*$`)
+
+// TSDBImport backfill a local Prometheus TSDB data directory into Warp 10
+type TSDBImport struct {
+	// Dir is the Prometheus data directory
+	Dir string
+	// Token is the Warp 10 write token
+	Token string
+	// MinTime and MaxTime bound the imported samples (milliseconds, inclusive)
+	MinTime int64
+	MaxTime int64
+	// Matchers filters the imported series
+	Matchers []labels.Matcher
+	// BatchSize is the number of series sent in a single Warp 10 request
+	BatchSize int
+	// StateFile keeps track of the imported series to resume an interrupted import
+	StateFile string
+	// Head also import the samples of the WAL which are not yet compacted into a block
+	Head bool
+	// Pipeline the datapoints go through, none by default
+	Pipeline *core.Pipeline
+
+	state tsdbImportState
+	geo   geoMapping
+}
+
+// tsdbImportState is the resumable progress of an import
+type tsdbImportState struct {
+	// Blocks hold, for each block, the number of series already sent
+	Blocks map[string]*tsdbBlockState `json:"blocks"`
+}
+
+// tsdbBlockState hold the labels of the last series sent. Series are selected ordered by labels, unlike their
+// index the labels of a series still identify it once the head changed.
+type tsdbBlockState struct {
+	Last map[string]string `json:"last,omitempty"`
+	Done bool              `json:"done"`
+}
+
+// ParseTSDBMatcher parse a label matcher such as `job="node"`, `instance=~"web-.*"`, `env!="dev"` or `name!~"tmp_.*"`
+func ParseTSDBMatcher(matcher string) (labels.Matcher, error) {
+	parts := tsdbMatcherRegexp.FindStringSubmatch(matcher)
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("invalid matcher: %s", matcher)
+	}
+
+	name, op, value := parts[1], parts[2], parts[3]
+	switch op {
+	case "=":
+		return labels.NewEqualMatcher(name, value), nil
+	case "!=":
+		return labels.Not(labels.NewEqualMatcher(name, value)), nil
+	case "=~":
+		return labels.NewRegexpMatcher(name, "^(?:"+value+")$")
+	case "!~":
+		m, err := labels.NewRegexpMatcher(name, "^(?:"+value+")$")
+		if err != nil {
+			return nil, err
+		}
+		return labels.Not(m), nil
+	}
+
+	return nil, fmt.Errorf("invalid matcher operator: %s", op)
+}
+
+// Run import the data directory, it returns the number of datapoints stored by Warp 10
+func (i *TSDBImport) Run() (int, error) {
+	if i.BatchSize <= 0 {
+		i.BatchSize = 1000
+	}
+	if i.MaxTime == 0 {
+		i.MaxTime = math.MaxInt64
+	}
+	if i.Pipeline == nil {
+		i.Pipeline = &core.Pipeline{Route: "import"}
+	}
+
+	if err := i.loadState(); err != nil {
+		return 0, err
+	}
+	i.geo = newGeoMapping("prometheus")
+
+	db, err := tsdb.OpenDBReadOnly(i.Dir, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			log.WithError(err).Warn("Cannot close the Prometheus TSDB")
+		}
+	}()
+
+	blocks, err := db.Blocks()
+	if err != nil {
+		return 0, err
+	}
+
+	dps := 0
+	maxBlockTime := int64(math.MinInt64)
+	for _, block := range blocks {
+		meta := block.Meta()
+		if meta.MaxTime > maxBlockTime {
+			maxBlockTime = meta.MaxTime
+		}
+
+		// Skip blocks outside of the requested time range
+		if meta.MaxTime < i.MinTime || meta.MinTime > i.MaxTime {
+			continue
+		}
+
+		querier, err := tsdb.NewBlockQuerier(block, i.MinTime, i.MaxTime)
+		if err != nil {
+			return dps, err
+		}
+
+		n, err := i.importQuerier(meta.ULID.String(), meta.Stats.NumSeries, querier)
+		dps += n
+		if cerr := querier.Close(); cerr != nil {
+			log.WithError(cerr).Warn("Cannot close the block querier")
+		}
+		if err != nil {
+			return dps, err
+		}
+	}
+
+	if !i.Head || maxBlockTime >= i.MaxTime {
+		return dps, nil
+	}
+
+	// Blocks are exclusive on their upper bound
+	mint := i.MinTime
+	if maxBlockTime > mint {
+		mint = maxBlockTime
+	}
+
+	querier, err := db.Querier(mint, i.MaxTime)
+	if err != nil {
+		return dps, err
+	}
+	defer func() {
+		if err := querier.Close(); err != nil {
+			log.WithError(err).Warn("Cannot close the head querier")
+		}
+	}()
+
+	n, err := i.importQuerier(tsdbHeadID, 0, querier)
+	return dps + n, err
+}
+
+// importQuerier send the series selected by the matchers, by batch, checkpointing the state after each batch. It
+// returns the number of datapoints stored by Warp 10.
+func (i *TSDBImport) importQuerier(id string, total uint64, querier tsdb.Querier) (int, error) {
+	state, ok := i.state.Blocks[id]
+	if !ok {
+		state = &tsdbBlockState{}
+		i.state.Blocks[id] = state
+	}
+
+	if state.Done {
+		log.WithFields(log.Fields{
+			"block": id,
+		}).Info("Block already imported, skipping")
+		return 0, nil
+	}
+
+	matchers := i.Matchers
+	if len(matchers) == 0 {
+		matchers = []labels.Matcher{labels.NewMustRegexpMatcher("__name__", ".+")}
+	}
+
+	set, err := querier.Select(matchers...)
+	if err != nil {
+		return 0, err
+	}
+
+	dps := 0
+	sent := 0
+	series := uint64(0)
+	batch := 0
+	last := labels.FromMap(state.Last)
+	var warp *core.Warp
+	var in *core.Ingest
+	var emit core.Emit
+
+	// The new series of a batch count once its datapoints are stored
+	closeBatch := func() error {
+		err := warp.Close()
+		if err != nil {
+			in.Rollback()
+		} else {
+			in.Commit()
+		}
+		warp = nil
+		return err
+	}
+
+	for set.Next() {
+		series++
+
+		// Resume after the last checkpoint
+		lset := set.At().Labels()
+		if len(last) > 0 && labels.Compare(lset, last) <= 0 {
+			continue
+		}
+
+		if warp == nil {
+			txn := tsdbTxn(id, series)
+			warp, err = core.NewWarp(i.Token, txn, "")
+			if err != nil {
+				return dps, err
+			}
+
+			// The datapoints of a batch are only stored once its connection is closed
+			w := warp
+			in = &core.Ingest{
+				Route: i.Pipeline.Route,
+				Token: i.Token,
+				Txn:   txn,
+			}
+			emit = i.Pipeline.Emitter(in, core.SinkFunc(func(b []byte) error {
+				if err := w.Send(b); err != nil {
+					return err
+				}
+				sent++
+				return nil
+			}))
+		}
+
+		if err := sendTSDBSeries(set.At(), i.geo, emit); err != nil {
+			_ = closeBatch()
+			return dps, err
+		}
+
+		last = lset
+		batch++
+		if batch < i.BatchSize {
+			continue
+		}
+
+		if err := closeBatch(); err != nil {
+			return dps, err
+		}
+		batch = 0
+		dps += sent
+		sent = 0
+
+		state.Last = last.Map()
+		if err := i.saveState(); err != nil {
+			return dps, err
+		}
+		logTSDBProgress(id, series, total, dps)
+	}
+
+	if err := set.Err(); err != nil {
+		if warp != nil {
+			_ = closeBatch()
+		}
+		return dps, err
+	}
+
+	if warp != nil {
+		if err := closeBatch(); err != nil {
+			return dps, err
+		}
+		dps += sent
+	}
+
+	state.Last = last.Map()
+	state.Done = true
+	if err := i.saveState(); err != nil {
+		return dps, err
+	}
+	logTSDBProgress(id, series, total, dps)
+
+	return dps, nil
+}
+
+// sendTSDBSeries convert a TSDB series using the remote write labels handling and emit it
+func sendTSDBSeries(series tsdb.Series, geo geoMapping, emit core.Emit) error {
+	ts := &prompb.TimeSeries{
+		Labels: make([]*prompb.Label, len(series.Labels())),
+	}
+	for idx, label := range series.Labels() {
+		ts.Labels[idx] = &prompb.Label{
+			Name:  label.Name,
+			Value: label.Value,
+		}
+	}
+
+	flush := func() error {
+		gtss, err := formatPromGts(ts, geo)
+		if err != nil {
+			return err
+		}
+
+		for _, gts := range gtss {
+			if err := emit(gts); err != nil {
+				return err
+			}
+		}
+		ts.Samples = ts.Samples[:0]
+		return nil
+	}
+
+	it := series.Iterator()
+	for it.Next() {
+		t, v := it.At()
+		ts.Samples = append(ts.Samples, &prompb.Sample{
+			Timestamp: t,
+			Value:     v,
+		})
+
+		if len(ts.Samples) >= tsdbMaxSamples {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := it.Err(); err != nil {
+		return err
+	}
+
+	return flush()
+}
+
+func (i *TSDBImport) loadState() error {
+	i.state = tsdbImportState{
+		Blocks: make(map[string]*tsdbBlockState),
+	}
+
+	if i.StateFile == "" {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(i.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(b, &i.state); err != nil {
+		return fmt.Errorf("invalid import state file %s: %v", i.StateFile, err)
+	}
+	if i.state.Blocks == nil {
+		i.state.Blocks = make(map[string]*tsdbBlockState)
+	}
+
+	return nil
+}
+
+// saveState write the state file atomically
+func (i *TSDBImport) saveState() error {
+	if i.StateFile == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(i.state)
+	if err != nil {
+		return err
+	}
+
+	tmp := i.StateFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, i.StateFile)
+}
+
+func logTSDBProgress(id string, series, total uint64, dps int) {
+	fields := log.Fields{
+		"block":      id,
+		"series":     series,
+		"datapoints": dps,
+	}
+	if total > 0 {
+		fields["progress"] = fmt.Sprintf("%.1f%%", float64(series)*100/float64(total))
+	}
+	log.WithFields(fields).Info("Prometheus TSDB import progress")
+}
+
+func tsdbTxn(id string, series uint64) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(strings.Join([]string{id, fmt.Sprint(series), time.Now().String()}, ":"))))
+}
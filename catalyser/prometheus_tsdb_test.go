@@ -0,0 +1,151 @@
+package catalyser
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+	"github.com/spf13/viper"
+)
+
+var (
+	testWarpOnce    sync.Once
+	testWarpHandler http.HandlerFunc
+	testWarpMutex   sync.Mutex
+)
+
+// setTestWarp serve the Warp 10 requests of a test with handler, the endpoint being read once by core
+func setTestWarp(handler http.HandlerFunc) {
+	testWarpOnce.Do(func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			testWarpMutex.Lock()
+			defer testWarpMutex.Unlock()
+			testWarpHandler(w, r)
+		}))
+		viper.Set("warp_endpoint", server.URL)
+	})
+
+	testWarpMutex.Lock()
+	testWarpHandler = handler
+	testWarpMutex.Unlock()
+}
+
+func TestParseTSDBMatcher(t *testing.T) {
+	tests := []struct {
+		matcher string
+		matches map[string]bool
+	}{
+		{matcher: `job="node"`, matches: map[string]bool{"node": true, "nodes": false, "": false}},
+		{matcher: `job = node`, matches: map[string]bool{"node": true, "web": false}},
+		{matcher: `job!="node"`, matches: map[string]bool{"node": false, "web": true}},
+		{matcher: `job=~"web-.*"`, matches: map[string]bool{"web-1": true, "api-web-1": false}},
+		{matcher: `job!~"tmp_.*"`, matches: map[string]bool{"tmp_a": false, "a_tmp_b": true}},
+	}
+
+	for _, test := range tests {
+		m, err := ParseTSDBMatcher(test.matcher)
+		if err != nil {
+			t.Errorf("%s: %v", test.matcher, err)
+			continue
+		}
+		if m.Name() != "job" {
+			t.Errorf("%s: got name %s", test.matcher, m.Name())
+		}
+		for value, expected := range test.matches {
+			if got := m.Matches(value); got != expected {
+				t.Errorf("%s: got %v for %q", test.matcher, got, value)
+			}
+		}
+	}
+
+	for _, matcher := range []string{`job`, `1job="node"`, `job<"node"`, `job=~"("`} {
+		if _, err := ParseTSDBMatcher(matcher); err == nil {
+			t.Errorf("%s: expected an error", matcher)
+		}
+	}
+}
+
+func TestTSDBImportResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catalyst-tsdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The head is written as a block, the vendored TSDB reading no data directory without block
+	db, err := tsdb.Open(filepath.Join(dir, "wal"), nil, nil, tsdb.DefaultOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := db.Appender()
+	for _, instance := range []string{"c", "a", "b"} {
+		lset := labels.FromStrings("__name__", "up", "instance", instance)
+		for _, ts := range []int64{1000, 2000} {
+			if _, err := app.Add(lset, ts, 1); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := app.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Snapshot(filepath.Join(dir, "data"), true); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Warp 10 fails the second request of the first run
+	var series []string
+	requests, fail := 0, 2
+	setTestWarp(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests++
+		if requests == fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		for _, line := range strings.Split(string(body), "\r\n") {
+			if fields := strings.Fields(line); len(fields) == 3 {
+				series = append(series, fields[1])
+			}
+		}
+	})
+
+	importer := func() *TSDBImport {
+		return &TSDBImport{
+			Dir:       filepath.Join(dir, "data"),
+			Token:     "token",
+			BatchSize: 1,
+			StateFile: filepath.Join(dir, "state.json"),
+		}
+	}
+
+	dps, err := importer().Run()
+	if err == nil {
+		t.Fatal("expected the failed batch error")
+	}
+	if dps != 2 {
+		t.Errorf("got %d datapoints stored before the failure", dps)
+	}
+
+	if dps, err = importer().Run(); err != nil || dps != 4 {
+		t.Fatalf("got %d datapoints, %v on resume", dps, err)
+	}
+
+	sort.Strings(series)
+	expected := []string{"up{instance=a}", "up{instance=b}", "up{instance=c}"}
+	if !reflect.DeepEqual(series, expected) {
+		t.Errorf("got %q", series)
+	}
+}
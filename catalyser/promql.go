@@ -0,0 +1,519 @@
+package catalyser
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// promNode is a node of a parsed PromQL expression
+type promNode interface{}
+
+// promNumber is a scalar literal
+type promNumber struct {
+	Value float64
+}
+
+// promMatcher is a label matcher (=, !=, =~, !~)
+type promMatcher struct {
+	Name  string
+	Op    string
+	Value string
+}
+
+// promSelector is an instant or range vector selector
+type promSelector struct {
+	Name     string
+	Matchers []promMatcher
+	Range    time.Duration
+}
+
+// promCall is a function call
+type promCall struct {
+	Func string
+	Args []promNode
+}
+
+// promAggregate is an aggregation such as `sum by (job) (...)`
+type promAggregate struct {
+	Op   string
+	By   []string
+	Expr promNode
+}
+
+// promBinary is an arithmetic binary expression
+type promBinary struct {
+	Op  string
+	LHS promNode
+	RHS promNode
+}
+
+// promParser is a recursive descent parser of the supported PromQL subset
+type promParser struct {
+	input string
+	pos   int
+}
+
+var (
+	promDurationRegexp = regexp.MustCompile(`^(\d+)(ms|s|m|h|d|w|y)`)
+	promAggregations   = map[string]bool{"sum": true, "avg": true, "max": true, "min": true, "count": true}
+	promFunctions      = map[string]bool{"rate": true, "irate": true, "increase": true, "histogram_quantile": true}
+)
+
+// parsePromQL parse an expression, returning an error for unsupported constructs
+func parsePromQL(input string) (promNode, error) {
+	p := &promParser{input: input}
+	node, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+
+	p.skipSpaces()
+	if p.pos < len(p.input) {
+		return nil, fmt.Errorf("unexpected %q at position %d", p.input[p.pos:], p.pos)
+	}
+
+	return node, nil
+}
+
+// parseExpr parse additive expressions
+func (p *promParser) parseExpr() (promNode, error) {
+	lhs, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		p.skipSpaces()
+		if !p.peekAny("+-") {
+			return lhs, nil
+		}
+		op := string(p.input[p.pos])
+		p.pos++
+
+		rhs, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		lhs = foldPromBinary(op, lhs, rhs)
+	}
+}
+
+// parseTerm parse multiplicative expressions
+func (p *promParser) parseTerm() (promNode, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		p.skipSpaces()
+		if !p.peekAny("*/") {
+			if p.peekAny("%^") || p.peekAny("=<>!") {
+				return nil, fmt.Errorf("unsupported operator %q", p.input[p.pos:p.pos+1])
+			}
+			if p.peekWord("and") || p.peekWord("or") || p.peekWord("unless") {
+				return nil, fmt.Errorf("unsupported set operator at position %d", p.pos)
+			}
+			return lhs, nil
+		}
+		op := string(p.input[p.pos])
+		p.pos++
+
+		rhs, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		lhs = foldPromBinary(op, lhs, rhs)
+	}
+}
+
+func (p *promParser) parseUnary() (promNode, error) {
+	p.skipSpaces()
+	if p.peekAny("-") {
+		p.pos++
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return foldPromBinary("*", &promNumber{Value: -1}, node), nil
+	}
+	if p.peekAny("+") {
+		p.pos++
+		return p.parseUnary()
+	}
+
+	return p.parsePrimary()
+}
+
+func (p *promParser) parsePrimary() (promNode, error) {
+	p.skipSpaces()
+	if p.pos >= len(p.input) {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+
+	c := p.input[p.pos]
+	switch {
+	case c == '(':
+		p.pos++
+		node, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return node, nil
+
+	case c == '{':
+		return p.parseSelector("")
+
+	case c >= '0' && c <= '9' || c == '.':
+		start := p.pos
+		for p.pos < len(p.input) && strings.ContainsRune("0123456789.eE", rune(p.input[p.pos])) {
+			p.pos++
+		}
+		v, err := strconv.ParseFloat(p.input[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", p.input[start:p.pos])
+		}
+		return &promNumber{Value: v}, nil
+	}
+
+	ident := p.parseIdentifier(true)
+	if ident == "" {
+		return nil, fmt.Errorf("unexpected %q at position %d", string(c), p.pos)
+	}
+
+	if promAggregations[ident] {
+		return p.parseAggregate(ident)
+	}
+
+	p.skipSpaces()
+	if p.peekAny("(") {
+		if !promFunctions[ident] {
+			return nil, fmt.Errorf("unsupported function %s", ident)
+		}
+		return p.parseCall(ident)
+	}
+
+	return p.parseSelector(ident)
+}
+
+func (p *promParser) parseAggregate(op string) (promNode, error) {
+	agg := &promAggregate{Op: op}
+
+	p.skipSpaces()
+	if p.peekWord("without") {
+		return nil, fmt.Errorf("unsupported aggregation modifier: without")
+	}
+	if p.peekWord("by") {
+		by, err := p.parseBy()
+		if err != nil {
+			return nil, err
+		}
+		agg.By = by
+	}
+
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	expr, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	agg.Expr = expr
+
+	p.skipSpaces()
+	if p.peekWord("without") {
+		return nil, fmt.Errorf("unsupported aggregation modifier: without")
+	}
+	if p.peekWord("by") {
+		if agg.By != nil {
+			return nil, fmt.Errorf("duplicate by clause")
+		}
+		by, err := p.parseBy()
+		if err != nil {
+			return nil, err
+		}
+		agg.By = by
+	}
+
+	return agg, nil
+}
+
+func (p *promParser) parseBy() ([]string, error) {
+	p.pos += len("by")
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+
+	by := []string{}
+	for {
+		p.skipSpaces()
+		if p.peekAny(")") {
+			p.pos++
+			return by, nil
+		}
+
+		label := p.parseIdentifier(false)
+		if label == "" {
+			return nil, fmt.Errorf("expecting a label name at position %d", p.pos)
+		}
+		by = append(by, label)
+
+		p.skipSpaces()
+		if p.peekAny(",") {
+			p.pos++
+		}
+	}
+}
+
+func (p *promParser) parseCall(fn string) (promNode, error) {
+	p.pos++
+	call := &promCall{Func: fn}
+
+	for {
+		p.skipSpaces()
+		if p.peekAny(")") {
+			p.pos++
+			break
+		}
+
+		arg, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		call.Args = append(call.Args, arg)
+
+		p.skipSpaces()
+		if p.peekAny(",") {
+			p.pos++
+		}
+	}
+
+	switch fn {
+	case "rate", "irate", "increase":
+		if len(call.Args) != 1 {
+			return nil, fmt.Errorf("%s expects one argument", fn)
+		}
+		if s, ok := call.Args[0].(*promSelector); !ok || s.Range == 0 {
+			return nil, fmt.Errorf("%s expects a range vector selector", fn)
+		}
+	case "histogram_quantile":
+		if len(call.Args) != 2 {
+			return nil, fmt.Errorf("histogram_quantile expects two arguments")
+		}
+		if _, ok := call.Args[0].(*promNumber); !ok {
+			return nil, fmt.Errorf("histogram_quantile expects a scalar quantile")
+		}
+	}
+
+	return call, nil
+}
+
+func (p *promParser) parseSelector(name string) (promNode, error) {
+	sel := &promSelector{Name: name}
+
+	p.skipSpaces()
+	if p.peekAny("{") {
+		p.pos++
+		for {
+			p.skipSpaces()
+			if p.peekAny("}") {
+				p.pos++
+				break
+			}
+
+			label := p.parseIdentifier(false)
+			if label == "" {
+				return nil, fmt.Errorf("expecting a label name at position %d", p.pos)
+			}
+
+			p.skipSpaces()
+			op := ""
+			for _, candidate := range []string{"=~", "!~", "!=", "="} {
+				if strings.HasPrefix(p.input[p.pos:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("expecting a matcher operator at position %d", p.pos)
+			}
+			p.pos += len(op)
+
+			value, err := p.parseString()
+			if err != nil {
+				return nil, err
+			}
+
+			if label == "__name__" && op == "=" {
+				sel.Name = value
+			} else {
+				sel.Matchers = append(sel.Matchers, promMatcher{Name: label, Op: op, Value: value})
+			}
+
+			p.skipSpaces()
+			if p.peekAny(",") {
+				p.pos++
+			}
+		}
+	}
+
+	if sel.Name == "" && len(sel.Matchers) == 0 {
+		return nil, fmt.Errorf("vector selector must contain at least one matcher")
+	}
+
+	p.skipSpaces()
+	if p.peekAny("[") {
+		p.pos++
+		p.skipSpaces()
+		d, err := p.parseDuration()
+		if err != nil {
+			return nil, err
+		}
+		sel.Range = d
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+	}
+
+	p.skipSpaces()
+	if p.peekWord("offset") {
+		return nil, fmt.Errorf("unsupported modifier: offset")
+	}
+
+	return sel, nil
+}
+
+func (p *promParser) parseDuration() (time.Duration, error) {
+	total := time.Duration(0)
+	for {
+		parts := promDurationRegexp.FindStringSubmatch(p.input[p.pos:])
+		if parts == nil {
+			break
+		}
+		p.pos += len(parts[0])
+
+		n, _ := strconv.Atoi(parts[1])
+		unit := map[string]time.Duration{
+			"ms": time.Millisecond,
+			"s":  time.Second,
+			"m":  time.Minute,
+			"h":  time.Hour,
+			"d":  24 * time.Hour,
+			"w":  7 * 24 * time.Hour,
+			"y":  365 * 24 * time.Hour,
+		}[parts[2]]
+		total += time.Duration(n) * unit
+	}
+
+	if total == 0 {
+		return 0, fmt.Errorf("invalid duration at position %d", p.pos)
+	}
+
+	return total, nil
+}
+
+func (p *promParser) parseString() (string, error) {
+	p.skipSpaces()
+	if p.pos >= len(p.input) || !strings.ContainsRune("\"'`", rune(p.input[p.pos])) {
+		return "", fmt.Errorf("expecting a string at position %d", p.pos)
+	}
+
+	quote := p.input[p.pos]
+	start := p.pos
+	p.pos++
+	for p.pos < len(p.input) && p.input[p.pos] != quote {
+		if p.input[p.pos] == '\\' && quote != '`' {
+			p.pos++
+		}
+		p.pos++
+	}
+	if p.pos >= len(p.input) {
+		return "", fmt.Errorf("unterminated string")
+	}
+	p.pos++
+
+	raw := p.input[start:p.pos]
+	if quote == '`' {
+		return raw[1 : len(raw)-1], nil
+	}
+	if quote == '\'' {
+		raw = `"` + strings.Replace(strings.Replace(raw[1:len(raw)-1], `\'`, `'`, -1), `"`, `\"`, -1) + `"`
+	}
+
+	return strconv.Unquote(raw)
+}
+
+// parseIdentifier parse a label name, or a metric name (allowing colons) if metric is true
+func (p *promParser) parseIdentifier(metric bool) string {
+	p.skipSpaces()
+	start := p.pos
+	for p.pos < len(p.input) {
+		r := rune(p.input[p.pos])
+		if r == '_' || unicode.IsLetter(r) || (p.pos > start && unicode.IsDigit(r)) || (metric && r == ':') {
+			p.pos++
+			continue
+		}
+		break
+	}
+
+	return p.input[start:p.pos]
+}
+
+func (p *promParser) expect(s string) error {
+	p.skipSpaces()
+	if !strings.HasPrefix(p.input[p.pos:], s) {
+		return fmt.Errorf("expecting %q at position %d", s, p.pos)
+	}
+	p.pos += len(s)
+	return nil
+}
+
+func (p *promParser) peekAny(chars string) bool {
+	return p.pos < len(p.input) && strings.IndexByte(chars, p.input[p.pos]) >= 0
+}
+
+// peekWord returns true if the next token is the given keyword
+func (p *promParser) peekWord(word string) bool {
+	if !strings.HasPrefix(p.input[p.pos:], word) {
+		return false
+	}
+
+	next := p.pos + len(word)
+	return next >= len(p.input) || !(p.input[next] == '_' || unicode.IsLetter(rune(p.input[next])) || unicode.IsDigit(rune(p.input[next])))
+}
+
+func (p *promParser) skipSpaces() {
+	for p.pos < len(p.input) && unicode.IsSpace(rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
+
+// foldPromBinary build a binary expression, computing scalar operations
+func foldPromBinary(op string, lhs, rhs promNode) promNode {
+	l, lok := lhs.(*promNumber)
+	r, rok := rhs.(*promNumber)
+	if !lok || !rok {
+		return &promBinary{Op: op, LHS: lhs, RHS: rhs}
+	}
+
+	switch op {
+	case "+":
+		return &promNumber{Value: l.Value + r.Value}
+	case "-":
+		return &promNumber{Value: l.Value - r.Value}
+	case "*":
+		return &promNumber{Value: l.Value * r.Value}
+	}
+
+	return &promNumber{Value: l.Value / r.Value}
+}
@@ -0,0 +1,99 @@
+package catalyser
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePromQL(t *testing.T) {
+	tests := []struct {
+		Got    string
+		Expect []string
+		Err    bool
+	}{
+		{
+			`http_requests_total{job="api"}`,
+			[]string{"'class' '=http_requests_total'", "'job' '=api'", "bucketizer.last"},
+			false,
+		},
+		{
+			`sum by (job) (rate(http_requests_total[5m]))`,
+			[]string{"true RESETS mapper.rate -300000000", "reducer.sum", "[ 'job' ] SUBMAP"},
+			false,
+		},
+		{
+			`increase(http_requests_total{code=~"5.."}[1h]) * 2`,
+			[]string{"mapper.delta -3600000000", "'code' '~^(?:5..)$'", "2 mapper.mul"},
+			false,
+		},
+		{
+			`node_memory_free / node_memory_total`,
+			[]string{"NULL op.div ] APPLY"},
+			false,
+		},
+		{
+			`up offset 5m`,
+			nil,
+			true,
+		},
+		{
+			`sum without (job) (up)`,
+			nil,
+			true,
+		},
+		{
+			`up / 4`,
+			[]string{"0.25 mapper.mul"},
+			false,
+		},
+		{
+			`up / 0`,
+			nil,
+			true,
+		},
+		{
+			`up % 2`,
+			nil,
+			true,
+		},
+		{
+			`rate(up)`,
+			nil,
+			true,
+		},
+	}
+
+	q := &promQuery{
+		token: "token",
+		start: time.Unix(0, 0),
+		end:   time.Unix(3600, 0),
+		step:  time.Minute,
+	}
+
+	for _, test := range tests {
+		node, err := parsePromQL(test.Got)
+		ws := ""
+		if err == nil {
+			ws, err = q.compile(node)
+		}
+
+		if test.Err {
+			if err == nil {
+				t.Errorf("expected an error for %s", test.Got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("unexpected error for %s: %v", test.Got, err)
+			continue
+		}
+
+		for _, expect := range test.Expect {
+			if !strings.Contains(ws, expect) {
+				t.Errorf("%s: expected %s in %s", test.Got, expect, ws)
+			}
+		}
+	}
+}
@@ -5,47 +5,40 @@ import (
 	"io"
 	"net/http"
 	"net/url"
-
-	"github.com/prometheus/client_golang/prometheus"
+	"strings"
 
 	"github.com/ovh/catalyst/core"
 )
 
 // Warp returns a Warp catalyser.
-func Warp(url *url.URL, header *http.Header, r io.Reader, send func([]byte) error, dpCounter prometheus.Counter) (int, int, error) {
-	dps := 0
-	i := 0
-	metrics := ""
+func Warp(url *url.URL, header *http.Header, r io.Reader, emit core.Emit) (core.Reply, error) {
+	var previous *core.GTS
 
 	// handle request
 	scan := bufio.NewScanner(r)
 	for scan.Scan() {
-		metric := scan.Text()
-
-		metrics += metric + "\r\n"
-
-		i++
-		if i >= 27 {
-			i = 0
-			err := send([]byte(metrics))
-			if err != nil {
-				return dps, -1, err
-			}
-			metrics = ""
+		metric := strings.TrimSpace(scan.Text())
+		if metric == "" || strings.HasPrefix(metric, "#") {
+			continue
 		}
 
-		dpCounter.Inc()
-		dps++
-	}
-
-	if i != 0 {
-		err := send([]byte(metrics))
+		gts, err := core.ParseSensision(metric, previous)
 		if err != nil {
-			return dps, -1, err
+			return core.Reply{}, core.NewParsingError("Failed to parse datapoint", metric)
+		}
+
+		// Keep the parsed series as the pipeline stages may update the datapoint
+		previous = &core.GTS{Name: gts.Name, Labels: make(map[string]string, len(gts.Labels))}
+		for k, v := range gts.Labels {
+			previous.Labels[k] = v
+		}
+
+		if err := emit(gts); err != nil {
+			return core.Reply{}, err
 		}
 	}
 
-	return dps, http.StatusOK, nil
+	return core.Reply{Code: http.StatusOK}, nil
 }
 
 // WarpError handle errors.
@@ -0,0 +1,37 @@
+package catalyser
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ovh/catalyst/core"
+)
+
+func TestWarpPassthrough(t *testing.T) {
+	// A valid payload sorted by label names goes through byte for byte
+	payload := strings.Join([]string{
+		"1440000000000000// cpu{dc=gra,host=a} 42",
+		"=1440000000000001// 43",
+		"=1440000000000002// -1.5",
+		"1440000000000000/48.85:2.35/1000 temp{room=a%2Cb} 21.5",
+		"// status{} 'ok%20now'",
+		"1440000000000000// up{host=a} T",
+		"1440000000000000// up{host=b} F",
+		"",
+	}, "\r\n")
+
+	var sent strings.Builder
+	p := &core.Pipeline{Route: "warp"}
+	emit := p.Emitter(&core.Ingest{Route: "warp"}, core.SinkFunc(func(b []byte) error {
+		sent.Write(b)
+		return nil
+	}))
+
+	if _, err := Warp(nil, nil, strings.NewReader(payload), emit); err != nil {
+		t.Fatal(err)
+	}
+
+	if sent.String() != payload {
+		t.Errorf("expected %q, got %q", payload, sent.String())
+	}
+}
@@ -0,0 +1,208 @@
+package cmd
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/tsdb/labels"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/ovh/catalyst/catalyser"
+	"github.com/ovh/catalyst/core"
+)
+
+func init() {
+	RootCmd.AddCommand(importCmd)
+	importCmd.AddCommand(importPrometheusTSDBCmd)
+	importCmd.AddCommand(importInfluxDBCmd)
+	importCmd.AddCommand(importOpenTSDBCmd)
+
+	importCmd.PersistentFlags().StringP("token", "t", "", "Warp 10 write token")
+
+	importPrometheusTSDBCmd.Flags().String("start", "", "import samples after this time (RFC3339 or unix milliseconds)")
+	importPrometheusTSDBCmd.Flags().String("end", "", "import samples before this time (RFC3339 or unix milliseconds)")
+	importPrometheusTSDBCmd.Flags().StringArrayP("match", "m", nil, "series matcher, e.g. job=\"node\" (repeatable)")
+	importPrometheusTSDBCmd.Flags().Int("batch", 1000, "number of series sent per Warp 10 request")
+	importPrometheusTSDBCmd.Flags().String("state", "", "state file used to resume an interrupted import")
+	importPrometheusTSDBCmd.Flags().Bool("head", false, "also import the samples of the WAL not yet compacted into a block")
+
+	for _, c := range []*cobra.Command{importInfluxDBCmd, importOpenTSDBCmd} {
+		c.Flags().Int("rate", 0, "maximum datapoints sent per second (0 means unlimited)")
+		c.Flags().Int("batch", 100000, "number of datapoints sent per Warp 10 request")
+	}
+
+	importInfluxDBCmd.Flags().String("db-label", "db", "label holding the exported database (empty to disable)")
+	importInfluxDBCmd.Flags().String("rp-label", "rp", "label holding the exported retention policy (empty to disable)")
+	importInfluxDBCmd.Flags().String("precision", "n", "precision of the exported timestamps")
+}
+
+var importCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Import time series exported from other databases into Warp 10",
+}
+
+var importPrometheusTSDBCmd = &cobra.Command{
+	Use:   "prometheus-tsdb <data-dir>",
+	Short: "Import a Prometheus TSDB data directory",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		token, _ := cmd.Flags().GetString("token")
+		if token == "" {
+			return errors.New("missing Warp 10 write token")
+		}
+
+		pipeline, err := core.NewPipeline("import")
+		if err != nil {
+			return err
+		}
+
+		importer := &catalyser.TSDBImport{
+			Dir:      args[0],
+			Token:    token,
+			Pipeline: pipeline,
+		}
+
+		start, _ := cmd.Flags().GetString("start")
+		if importer.MinTime, err = parseImportTime(start); err != nil {
+			return err
+		}
+
+		end, _ := cmd.Flags().GetString("end")
+		if importer.MaxTime, err = parseImportTime(end); err != nil {
+			return err
+		}
+
+		matchers, _ := cmd.Flags().GetStringArray("match")
+		for _, m := range matchers {
+			matcher, err := catalyser.ParseTSDBMatcher(m)
+			if err != nil {
+				return err
+			}
+			importer.Matchers = append(importer.Matchers, matcher)
+		}
+
+		importer.BatchSize, _ = cmd.Flags().GetInt("batch")
+		importer.StateFile, _ = cmd.Flags().GetString("state")
+		importer.Head, _ = cmd.Flags().GetBool("head")
+
+		log.WithFields(log.Fields{
+			"dir":      importer.Dir,
+			"matchers": labels.Selector(importer.Matchers),
+		}).Info("Importing Prometheus TSDB")
+
+		dps, err := importer.Run()
+		if err != nil {
+			return err
+		}
+
+		log.WithFields(log.Fields{
+			"datapoints": dps,
+		}).Info("Prometheus TSDB imported")
+		return nil
+	},
+}
+
+var importInfluxDBCmd = &cobra.Command{
+	Use:   "influxdb <file>",
+	Short: "Import an influx_inspect export file (use - for stdin)",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		importer, err := newFileImport(cmd)
+		if err != nil {
+			return err
+		}
+
+		importer.DatabaseLabel, _ = cmd.Flags().GetString("db-label")
+		importer.RetentionPolicyLabel, _ = cmd.Flags().GetString("rp-label")
+		importer.Precision, _ = cmd.Flags().GetString("precision")
+		if importer.Mapping, err = catalyser.NewInfluxDBMapping("import"); err != nil {
+			return err
+		}
+
+		return runFileImport(args[0], importer.InfluxDB)
+	},
+}
+
+var importOpenTSDBCmd = &cobra.Command{
+	Use:   "opentsdb <file>",
+	Short: "Import an OpenTSDB tsdb scan --import file (use - for stdin)",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		importer, err := newFileImport(cmd)
+		if err != nil {
+			return err
+		}
+
+		return runFileImport(args[0], importer.OpenTSDB)
+	},
+}
+
+func newFileImport(cmd *cobra.Command) (*catalyser.FileImport, error) {
+	token, _ := cmd.Flags().GetString("token")
+	if token == "" {
+		return nil, errors.New("missing Warp 10 write token")
+	}
+
+	pipeline, err := core.NewPipeline("import")
+	if err != nil {
+		return nil, err
+	}
+
+	importer := &catalyser.FileImport{
+		Token:    token,
+		Pipeline: pipeline,
+	}
+	importer.Rate, _ = cmd.Flags().GetInt("rate")
+	importer.BatchSize, _ = cmd.Flags().GetInt("batch")
+
+	return importer, nil
+}
+
+func runFileImport(path string, run func(io.Reader) (int, error)) error {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := f.Close(); err != nil {
+				log.WithError(err).Warn("Cannot close the imported file")
+			}
+		}()
+		r = f
+	}
+
+	log.WithFields(log.Fields{
+		"file": path,
+	}).Info("Importing file")
+
+	dps, err := run(r)
+	log.WithFields(log.Fields{
+		"datapoints": dps,
+	}).Info("File imported")
+
+	return err
+}
+
+// parseImportTime parse a RFC3339 date or an unix timestamp in milliseconds
+func parseImportTime(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return ms, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, errors.New("invalid time, expecting RFC3339 or unix milliseconds: " + s)
+	}
+
+	return t.UnixNano() / int64(time.Millisecond), nil
+}
@@ -50,10 +50,23 @@ func initConfig() {
 	viper.SetDefault("warp.connection.keep-alive.timeout", time.Second*30)
 	viper.SetDefault("warp.connection.dial.timeout", 10*time.Second)
 	viper.SetDefault("warp.connection.tls.timeout", 5*time.Second)
+	viper.SetDefault("warp.time_unit", "us")
 	viper.SetDefault("metrics.listen", "127.0.0.1:9105")
 	viper.SetDefault("bannishment.duration", 3000)
 	viper.SetDefault("graphite.listen", ":2003")
 	viper.SetDefault("graphite.parse", true)
+	viper.SetDefault("graphite.events.class", "graphite.events")
+	viper.SetDefault("opentsdb.annotation.class", "opentsdb.annotation")
+	viper.SetDefault("reserved_labels.policy", "reject")
+	viper.SetDefault("reserved_labels.rename_prefix", "_")
+	viper.SetDefault("cardinality.mode", "exact")
+	viper.SetDefault("cardinality.max_tokens", 10000)
+	viper.SetDefault("special_values.sentinel", 0)
+	viper.SetDefault("special_values.staleness_suffix", ".stale")
+	viper.SetDefault("prometheus.histograms.series", 100000)
+	viper.SetDefault("prometheus.metadata.families", 10000)
+	viper.SetDefault("meta.cache.size", 100000)
+	viper.SetDefault("meta.cache.ttl", time.Hour)
 
 	hostname, err := os.Hostname()
 	if err != nil {
@@ -91,6 +104,12 @@ func initConfig() {
 	}
 
 	log.SetLevel(log.AllLevels[viper.GetInt("log-level")])
+
+	timeUnit, err := core.ParseTimeUnit(viper.GetString("warp.time_unit"))
+	if err != nil {
+		log.WithError(err).Fatal("Invalid warp.time_unit")
+	}
+	core.SetTimeUnit(timeUnit)
 }
 
 // RootCmd launch the aggregator agent.
@@ -113,14 +132,39 @@ var RootCmd = &cobra.Command{
 		router.Use(middlewares.Bannishment(viper.GetDuration("bannishment.duration") * time.Millisecond))
 
 		// Build catalysers
-		openTSDB := core.NewHandler("opentsdb", []string{"POST"}, catalyser.OpenTSDB, nil)
-		prometheus := core.NewHandler("prometheus", []string{"POST", "PUT"}, catalyser.Prometheus, nil)
-		prometheusRemote := core.NewHandler("prometheus_remote_write", []string{"POST", "PUT"}, catalyser.HandleRemoteWrite, nil)
-		influxdb := core.NewHandler("influxdb", []string{"POST"}, catalyser.InfluxDB, nil)
-		graphite := core.NewHandler("graphite", []string{"POST"}, catalyser.GraphiteHTTP, nil)
-		warp := core.NewHandler("warp", []string{"POST"}, catalyser.Warp, catalyser.WarpError)
-
-		graphiteTCP := catalyser.NewGraphite(viper.GetString("graphite.listen"), viper.GetBool("graphite.parse"))
+		openTSDB := core.NewHandler("opentsdb", []string{"POST"}, core.CatalyserFunc(catalyser.OpenTSDB), nil)
+		openTSDBRollup := core.NewHandler("opentsdb_rollup", []string{"POST"}, core.CatalyserFunc(catalyser.OpenTSDBRollup), nil)
+		openTSDBHistogram := core.NewHandler("opentsdb_histogram", []string{"POST"}, core.CatalyserFunc(catalyser.OpenTSDBHistogram), nil)
+		openTSDBAnnotation := core.NewHandler("opentsdb_annotation", []string{"POST", "PUT"}, core.CatalyserFunc(catalyser.OpenTSDBAnnotation), nil)
+		promHistograms, err := catalyser.NewPromHistogramMapping()
+		if err != nil {
+			log.WithError(err).Fatal("Invalid Prometheus histograms configuration")
+		}
+		prometheus := core.NewHandler("prometheus", []string{"POST", "PUT"}, catalyser.NewPrometheus(promHistograms), nil)
+		prometheusRemote := core.NewHandler("prometheus_remote_write", []string{"POST", "PUT"}, catalyser.NewRemoteWrite(promHistograms), nil)
+		influxDBMapping, err := catalyser.NewInfluxDBMapping("influxdb")
+		if err != nil {
+			log.WithError(err).Fatal("Invalid influxdb.mapping configuration")
+		}
+		influxdb := core.NewHandler("influxdb", []string{"POST"}, catalyser.NewInfluxDB(influxDBMapping), catalyser.InfluxDBError)
+		// The HTTP sink uses the templates of the TCP listener unless set
+		graphiteTemplates, err := catalyser.NewGraphiteTemplates(viper.GetStringSlice("graphite.templates"))
+		if err != nil {
+			log.WithError(err).Fatal("Invalid graphite.templates configuration")
+		}
+		graphiteHTTPTemplates := graphiteTemplates
+		if viper.IsSet("graphite.http.templates") {
+			graphiteHTTPTemplates, err = catalyser.NewGraphiteTemplates(viper.GetStringSlice("graphite.http.templates"))
+			if err != nil {
+				log.WithError(err).Fatal("Invalid graphite.http.templates configuration")
+			}
+		}
+
+		graphite := core.NewHandler("graphite", []string{"POST"}, catalyser.NewGraphiteHTTP(graphiteHTTPTemplates), nil)
+		graphiteEvents := core.NewHandler("graphite_events", []string{"POST"}, core.CatalyserFunc(catalyser.GraphiteEvents), nil)
+		warp := core.NewHandler("warp", []string{"POST"}, core.CatalyserFunc(catalyser.Warp), catalyser.WarpError)
+
+		graphiteTCP := catalyser.NewGraphite(viper.GetString("graphite.listen"), viper.GetBool("graphite.parse"), graphiteTemplates)
 		go graphiteTCP.OpenTCPServer()
 
 		// Support legacy
@@ -130,11 +174,28 @@ var RootCmd = &cobra.Command{
 		router.Any("/influxdb", influxdb.Handle)
 		router.Any("/graphite/api/v1/sink", graphite.Handle)
 
+		router.Any("/graphite/render*", catalyser.GraphiteRender)
+		router.Any("/graphite/metrics/find*", catalyser.GraphiteFind)
+		router.POST("/graphite/events*", graphiteEvents.Handle)
+		router.GET("/graphite/events*", catalyser.GraphiteEventsGet)
+
+		router.Any("/opentsdb/api/query", catalyser.OpenTSDBQuery)
+		router.Any("/opentsdb/api/suggest", catalyser.OpenTSDBSuggest)
+		router.Any("/opentsdb/api/rollup", openTSDBRollup.Handle)
+		router.Any("/opentsdb/api/histogram", openTSDBHistogram.Handle)
+		router.Any("/opentsdb/api/annotation", openTSDBAnnotation.Handle)
+		router.Any("/opentsdb/api/annotation/bulk", openTSDBAnnotation.Handle)
 		router.Any("/opentsdb/*", openTSDB.Handle)
 		router.Any("/prometheus/remote_write*", prometheusRemote.Handle)
+		router.Any("/prometheus/api/v1/query", catalyser.PrometheusQuery)
+		router.Any("/prometheus/api/v1/query_range", catalyser.PrometheusQueryRange)
+		router.Any("/prometheus/api/v1/series", catalyser.PrometheusSeries)
+		router.Any("/prometheus/api/v1/labels", catalyser.PrometheusLabels)
+		router.Any("/prometheus/api/v1/label/:name/values", catalyser.PrometheusLabelValues)
 		router.Any("/prometheus/*", prometheus.Handle)
 		router.Any("/influxdb/write*", influxdb.Handle)
 		router.Any("/influxdb/ping*", catalyser.HandlePing)
+		router.Any("/influxdb/query*", catalyser.InfluxDBQuery)
 		router.Any("/warp/api/v0/update*", warp.Handle)
 		router.Any("/warp/api/v0/delete*", middlewares.ReverseWithConfig(middlewares.ReverseConfig{
 			URL:  viper.GetString("warp_endpoint_delete") + "/api/v0",
@@ -2,8 +2,10 @@ package core
 
 import (
 	"compress/gzip"
+	"crypto/sha256"
 	"encoding/base64"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"strings"
@@ -61,6 +63,21 @@ func GetToken(r *http.Request) (string, error) {
 	}
 }
 
+// GetInfluxDBQueryToken grep token from an InfluxDB query request, InfluxDB clients sending the credentials as
+// the p parameter when there is no Authorization header
+func GetInfluxDBQueryToken(r *http.Request) (string, error) {
+	t, err := GetToken(r)
+	if err == nil {
+		return t, nil
+	}
+
+	_ = r.ParseForm()
+	if t = r.FormValue("p"); t != "" {
+		return t, nil
+	}
+	return "", err
+}
+
 // handleGzip check if body is plain text or Gzip return a plain text reader
 func handleGzip(r *http.Request) (io.Reader, error) {
 
@@ -74,3 +91,8 @@ func handleGzip(r *http.Request) (io.Reader, error) {
 	}
 	return r.Body, nil
 }
+
+// tokenHash returns a short hash identifying a token in the metrics without disclosing it
+func tokenHash(token string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(token)))[:16]
+}
@@ -0,0 +1,352 @@
+package core
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+var (
+	cardinalitySeries = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "catalyst",
+		Subsystem: "cardinality",
+		Name:      "series",
+		Help:      "Number of series tracked for a token.",
+	}, []string{"token_hash"})
+	cardinalityNewSeries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "catalyst",
+		Subsystem: "cardinality",
+		Name:      "new_series",
+		Help:      "Number of new series accepted for a token.",
+	}, []string{"token_hash"})
+	cardinalityRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "catalyst",
+		Subsystem: "cardinality",
+		Name:      "rejected",
+		Help:      "Number of new series refused as a token exceeded its series budget.",
+	}, []string{"token_hash"})
+
+	cardinality     *cardinalityLimiter
+	cardinalityOnce sync.Once
+	cardinalityErr  error
+)
+
+func init() {
+	prometheus.MustRegister(cardinalitySeries)
+	prometheus.MustRegister(cardinalityNewSeries)
+	prometheus.MustRegister(cardinalityRejected)
+}
+
+// CardinalityExceeded is returned when a token would exceed its series budget
+type CardinalityExceeded struct {
+	Class string
+	Limit int
+}
+
+func (e CardinalityExceeded) Error() string {
+	return fmt.Sprintf("Series budget of %d exceeded, refusing new series %s", e.Limit, e.Class)
+}
+
+// seriesSet track the series seen for a token
+type seriesSet interface {
+	contains(h uint64) bool
+	insert(h uint64)
+	len() int
+}
+
+// exactSet is an exact set of series hashes, bounded by the budget
+type exactSet map[uint64]struct{}
+
+func (s exactSet) contains(h uint64) bool {
+	_, ok := s[h]
+	return ok
+}
+
+func (s exactSet) insert(h uint64) {
+	s[h] = struct{}{}
+}
+
+func (s exactSet) len() int {
+	return len(s)
+}
+
+// filterSet is a bloom filter sized for the budget with a 1% false positive rate, a false positive letting
+// a new series through as an already known one
+type filterSet struct {
+	bits []uint64
+	m    uint64
+	k    uint64
+	n    int
+}
+
+func newFilterSet(budget int) *filterSet {
+	m := uint64(math.Ceil(-float64(budget) * math.Log(0.01) / (math.Ln2 * math.Ln2)))
+	if m < 64 {
+		m = 64
+	}
+	return &filterSet{
+		bits: make([]uint64, (m+63)/64),
+		m:    m,
+		k:    7,
+	}
+}
+
+// indexes returns the bits of a hash using double hashing
+func (f *filterSet) indexes(h uint64) []uint64 {
+	h2 := (h >> 32) | (h << 32) | 1
+	idx := make([]uint64, f.k)
+	for i := uint64(0); i < f.k; i++ {
+		idx[i] = (h + i*h2) % f.m
+	}
+	return idx
+}
+
+func (f *filterSet) contains(h uint64) bool {
+	for _, i := range f.indexes(h) {
+		if f.bits[i/64]&(1<<(i%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *filterSet) insert(h uint64) {
+	for _, i := range f.indexes(h) {
+		f.bits[i/64] |= 1 << (i % 64)
+	}
+	f.n++
+}
+
+func (f *filterSet) len() int {
+	return f.n
+}
+
+// seriesTracker is the series set of a token
+type seriesTracker struct {
+	mutex  sync.Mutex
+	set    seriesSet
+	budget int
+	since  time.Time
+	// reserved counts the new series of the requests in flight
+	reserved int
+	removed  bool
+	hash     string
+}
+
+// reservedSeries are the new series of a request, counted in the budget of its token once stored by Warp 10
+type reservedSeries struct {
+	limiter *cardinalityLimiter
+	token   string
+	tracker *seriesTracker
+	series  map[uint64]struct{}
+}
+
+// cardinalityLimiter track the series of each token and refuse new series beyond their budget. The trackers of
+// the `cardinality.max_tokens` tokens last used are kept.
+type cardinalityLimiter struct {
+	mode    string
+	budget  int
+	tokens  map[string]int
+	period  time.Duration
+	mutex   sync.Mutex
+	tracked *LRU
+}
+
+// getCardinalityLimiter returns the limiter shared by all the routes as budgets are per token, nil without budgets
+func getCardinalityLimiter() (*cardinalityLimiter, error) {
+	cardinalityOnce.Do(func() {
+		cardinality, cardinalityErr = newCardinalityLimiter()
+	})
+
+	return cardinality, cardinalityErr
+}
+
+// newCardinalityLimiter build a limiter from the `cardinality` configuration, it returns nil without budgets
+func newCardinalityLimiter() (*cardinalityLimiter, error) {
+	c := &cardinalityLimiter{
+		mode:    viper.GetString("cardinality.mode"),
+		budget:  viper.GetInt("cardinality.max_series"),
+		tokens:  map[string]int{},
+		period:  viper.GetDuration("cardinality.period"),
+		tracked: NewLRU(viper.GetInt("cardinality.max_tokens")),
+	}
+	c.tracked.OnEvict = func(_, value interface{}) {
+		c.remove(value.(*seriesTracker))
+	}
+
+	if c.mode != "exact" && c.mode != "filter" {
+		return nil, fmt.Errorf("cardinality: invalid mode '%s'", c.mode)
+	}
+
+	err := ParseTokens("cardinality", func(token string, conf map[string]interface{}) error {
+		c.tokens[token] = cast.ToInt(conf["max_series"])
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if c.budget <= 0 && len(c.tokens) == 0 {
+		return nil, nil
+	}
+
+	return c, nil
+}
+
+// tracker returns the series tracker of a token locked, nil without budget
+func (c *cardinalityLimiter) tracker(token string) *seriesTracker {
+	budget, ok := c.tokens[token]
+	if !ok {
+		budget = c.budget
+	}
+	if budget <= 0 {
+		return nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if v, ok := c.tracked.Get(token); ok {
+		t := v.(*seriesTracker)
+		t.mutex.Lock()
+		return t
+	}
+
+	t := &seriesTracker{budget: budget, hash: tokenHash(token)}
+	t.mutex.Lock()
+	c.tracked.Add(token, t)
+	return t
+}
+
+// remove the metrics of a tracker no more used, its requests in flight reserving series in vain
+func (c *cardinalityLimiter) remove(t *seriesTracker) {
+	t.mutex.Lock()
+	t.removed = true
+	t.mutex.Unlock()
+	cardinalitySeries.Delete(prometheus.Labels{"token_hash": t.hash})
+}
+
+// Process a datapoint, reserving its series when new
+func (c *cardinalityLimiter) Process(in *Ingest, gts *GTS, next Emit) error {
+	r := in.reserved
+	var t *seriesTracker
+	if r != nil {
+		t = r.tracker
+		t.mutex.Lock()
+	} else if t = c.tracker(in.Token); t == nil {
+		return next(gts)
+	}
+
+	h := seriesHash(gts)
+
+	if t.set == nil || (c.period > 0 && time.Since(t.since) > c.period) {
+		if c.mode == "filter" {
+			t.set = newFilterSet(t.budget)
+		} else {
+			t.set = exactSet{}
+		}
+		t.since = time.Now()
+	}
+
+	if r != nil {
+		if _, ok := r.series[h]; ok {
+			t.mutex.Unlock()
+			return next(gts)
+		}
+	}
+
+	if !t.set.contains(h) {
+		if t.set.len()+t.reserved >= t.budget {
+			t.mutex.Unlock()
+			cardinalityRejected.With(prometheus.Labels{"token_hash": t.hash}).Inc()
+			return CardinalityExceeded{Class: gts.Name, Limit: t.budget}
+		}
+
+		t.reserved++
+		if r == nil {
+			r = &reservedSeries{limiter: c, token: in.Token, tracker: t, series: map[uint64]struct{}{}}
+			in.reserved = r
+		}
+		r.series[h] = struct{}{}
+	}
+	t.mutex.Unlock()
+
+	return next(gts)
+}
+
+// Commit counts the new series of the datapoints Warp 10 stored in the budget of the token
+func (in *Ingest) Commit() {
+	r := in.reserved
+	if r == nil {
+		return
+	}
+	in.reserved = nil
+
+	t := r.tracker
+	t.mutex.Lock()
+	t.reserved -= len(r.series)
+	added := 0
+	for h := range r.series {
+		if !t.set.contains(h) {
+			t.set.insert(h)
+			added++
+		}
+	}
+	size, removed := t.set.len(), t.removed
+	t.mutex.Unlock()
+
+	if !removed {
+		cardinalityNewSeries.With(prometheus.Labels{"token_hash": t.hash}).Add(float64(added))
+		cardinalitySeries.With(prometheus.Labels{"token_hash": t.hash}).Set(float64(size))
+	}
+}
+
+// Rollback releases the new series of the datapoints Warp 10 did not store, forgetting the tokens without
+// series such as invalid ones
+func (in *Ingest) Rollback() {
+	r := in.reserved
+	if r == nil {
+		return
+	}
+	in.reserved = nil
+
+	c, t := r.limiter, r.tracker
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	t.mutex.Lock()
+	t.reserved -= len(r.series)
+	unused := t.reserved == 0 && t.set.len() == 0 && !t.removed
+	t.mutex.Unlock()
+
+	if unused {
+		c.tracked.Remove(r.token)
+		c.remove(t)
+	}
+}
+
+// seriesHash returns the hash of the class and labels of a datapoint
+func seriesHash(gts *GTS) uint64 {
+	names := make([]string, 0, len(gts.Labels))
+	for name := range gts.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(gts.Name))
+	for _, name := range names {
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(name))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(gts.Labels[name]))
+	}
+	return h.Sum64()
+}
@@ -0,0 +1,179 @@
+package core
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var (
+	execCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "catalyst",
+		Subsystem: "exec",
+		Name:      "request",
+		Help:      "Number of WarpScript executed.",
+	}, []string{"protocol"})
+
+	execErrCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "catalyst",
+		Subsystem: "exec",
+		Name:      "error",
+		Help:      "Number of WarpScript in error.",
+	}, []string{"protocol"})
+)
+
+func init() {
+	prometheus.MustRegister(execCounter)
+	prometheus.MustRegister(execErrCounter)
+}
+
+// WarpScriptError is an error raised during a WarpScript execution
+type WarpScriptError struct {
+	Line    string
+	Message string
+}
+
+func (e WarpScriptError) Error() string {
+	return fmt.Sprintf("WarpScript error at line %s: %s", e.Line, e.Message)
+}
+
+// ExecGTS is the JSON representation of a GTS returned by /exec
+type ExecGTS struct {
+	Class      string            `json:"c"`
+	Labels     map[string]string `json:"l"`
+	Attributes map[string]string `json:"a"`
+	Values     [][]interface{}   `json:"v"`
+}
+
+// Point returns the timestamp and value of the i-th datapoint, skipping the optional location and elevation
+func (gts *ExecGTS) Point(i int) (int64, interface{}) {
+	v := gts.Values[i]
+	ts, _ := v[0].(float64)
+	return int64(ts), v[len(v)-1]
+}
+
+// Sort order the datapoints by ascending timestamp
+func (gts *ExecGTS) Sort() {
+	sort.SliceStable(gts.Values, func(i, j int) bool {
+		ti, _ := gts.Values[i][0].(float64)
+		tj, _ := gts.Values[j][0].(float64)
+		return ti < tj
+	})
+}
+
+// Exec run a WarpScript on the Warp 10 /exec endpoint and returns the JSON stack
+func Exec(protocol, token, txn, script string) ([]byte, error) {
+	httpClientSingleton.Do(initWarp)
+	execCounter.With(prometheus.Labels{"protocol": protocol}).Inc()
+
+	endpoint := warpEndpoint
+	if viper.IsSet("warp_endpoint_exec") {
+		endpoint = viper.GetString("warp_endpoint_exec")
+	}
+
+	// Scripts hold the read token, only their size and hash are logged
+	log.WithFields(log.Fields{
+		"txn":      txn,
+		"protocol": protocol,
+		"size":     len(script),
+		"hash":     fmt.Sprintf("%x", sha256.Sum256([]byte(script)))[:16],
+	}).Debug("Execute WarpScript")
+
+	req, err := http.NewRequest("POST", endpoint+"/api/v0/exec", strings.NewReader(script))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("Txn", txn)
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		execErrCounter.With(prometheus.Labels{"protocol": protocol}).Inc()
+		return nil, err
+	}
+	defer func() {
+		if err := res.Body.Close(); err != nil {
+			log.WithError(err).Error("Cannot close response body")
+		}
+	}()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		execErrCounter.With(prometheus.Labels{"protocol": protocol}).Inc()
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		execErrCounter.With(prometheus.Labels{"protocol": protocol}).Inc()
+
+		msg := res.Header.Get("X-Warp10-Error-Message")
+		if msg == "" {
+			return nil, fmt.Errorf("status %v - %v", res.StatusCode, string(body))
+		}
+
+		// Map token errors
+		w := &Warp{token: token}
+		if err := w.HandleError(errors.New("io.warp10.script.WarpScriptException: " + msg)); err != nil {
+			switch err.(type) {
+			case WarpInvalidToken, WarpExpiredToken, WarpRevokedToken:
+				return nil, err
+			}
+		}
+
+		return nil, WarpScriptError{
+			Line:    res.Header.Get("X-Warp10-Error-Line"),
+			Message: msg,
+		}
+	}
+
+	return body, nil
+}
+
+// ExecStatus returns the http status code matching an Exec error
+func ExecStatus(err error) int {
+	switch err.(type) {
+	case WarpInvalidToken, WarpExpiredToken, WarpRevokedToken:
+		return http.StatusUnauthorized
+	case WarpScriptError:
+		return http.StatusBadRequest
+	}
+
+	return http.StatusBadGateway
+}
+
+// WarpScriptString returns a WarpScript string literal, WarpScript strings being URL decoded
+func WarpScriptString(s string) string {
+	return "'" + strings.NewReplacer(
+		"%", "%25",
+		"\\", "%5C",
+		"'", "%27",
+		"\n", "%0A",
+		"\r", "%0D",
+	).Replace(s) + "'"
+}
+
+// WarpScriptLabels returns a WarpScript map of label selectors
+func WarpScriptLabels(selectors map[string]string) string {
+	keys := make([]string, 0, len(selectors))
+	for k := range selectors {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString("{")
+	for _, k := range keys {
+		b.WriteString(" " + WarpScriptString(k) + " " + WarpScriptString(selectors[k]))
+	}
+	b.WriteString(" }")
+
+	return b.String()
+}
@@ -12,6 +12,7 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 	"unsafe"
 
 	"github.com/golang/snappy"
@@ -53,11 +54,22 @@ func NewParsingError(msg, row string) ParsingError {
 	}
 }
 
+// Reply is the answer of a catalyser to the client, such as a summary of the stored datapoints. A zero code
+// answers 200 without body. The reply of a failed catalyser is ignored, its error being mapped to the answer.
+type Reply struct {
+	Code        int
+	ContentType string
+	Body        string
+	// Timeout bounds the wait for Warp 10 to store the datapoints, 0 waiting for the connection timeout
+	Timeout time.Duration
+}
+
 // Handler struct
 type Handler struct {
 	protocol     string
 	methods      string
-	handler      func(*url.URL, *http.Header, io.Reader, func([]byte) error, prometheus.Counter) (int, int, error)
+	catalyser    Catalyser
+	pipeline     *Pipeline
 	errorHandler func(error) error
 
 	reqCounter prometheus.Counter
@@ -65,8 +77,13 @@ type Handler struct {
 	dpCounter  prometheus.Counter
 }
 
-// NewHandler initialise a new api endpoint handler
-func NewHandler(protocol string, methods []string, handler func(*url.URL, *http.Header, io.Reader, func([]byte) error, prometheus.Counter) (int, int, error), errorHandler func(error) error) *Handler {
+// NewHandler initialise a new api endpoint handler, its datapoints going through the pipeline of the protocol
+func NewHandler(protocol string, methods []string, catalyser Catalyser, errorHandler func(error) error) *Handler {
+	pipeline, err := NewPipeline(protocol)
+	if err != nil {
+		log.WithError(err).Fatal("Invalid pipeline configuration")
+	}
+
 	// metrics
 	reqCounter := prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace:   "catalyst",
@@ -98,7 +115,8 @@ func NewHandler(protocol string, methods []string, handler func(*url.URL, *http.
 	return &Handler{
 		protocol:     protocol,
 		methods:      strings.Join(methods, ":"),
-		handler:      handler,
+		catalyser:    catalyser,
+		pipeline:     pipeline,
 		errorHandler: errorHandler,
 
 		reqCounter: reqCounter,
@@ -113,13 +131,14 @@ func (h *Handler) Handle(c echo.Context) error {
 	datapoints := 0
 	code := 0
 	msg := ""
+	contentType := echo.MIMETextPlainCharsetUTF8
 	req := c.Request()
 
 	defer func() {
 		if code == 0 {
 			code = http.StatusOK
 		}
-		if err := c.String(code, msg); err != nil {
+		if err := c.Blob(code, contentType, []byte(msg)); err != nil {
 			log.WithError(err).Warn("Failed to answer client request")
 		}
 
@@ -180,25 +199,62 @@ func (h *Handler) Handle(c echo.Context) error {
 			return nil
 		}
 
-		// handle request
-		datapoints, code, err = h.handler(req.URL, &req.Header, r, warp.Send, h.dpCounter)
+		// handle request, counting the datapoints reaching Warp 10
+		now, _ := strconv.ParseInt(req.Header.Get("X-Warp10-Now"), 10, 64)
+		in := &Ingest{
+			Route: h.protocol,
+			Token: token,
+			Txn:   c.Get("txn").(string),
+			Now:   now,
+		}
+		in.Meta = NewMeta(in)
+		emit := h.pipeline.Emitter(in, SinkFunc(func(b []byte) error {
+			if err := warp.Send(b); err != nil {
+				return err
+			}
+			h.dpCounter.Inc()
+			datapoints++
+			return nil
+		}))
+		reply, err := h.catalyser.Catalyse(req.URL, &req.Header, r, emit)
 
 		if err != nil {
 			if h.errorHandler != nil {
 				err = h.errorHandler(err)
 			}
 			code, msg = h.handleErr(req, err, c.Get("txn").(string))
+		} else {
+			code, msg = reply.Code, reply.Body
+			if reply.ContentType != "" {
+				contentType = reply.ContentType
+			}
 		}
 
-		if err = warp.Close(); err != nil {
+		if err = warp.CloseTimeout(reply.Timeout); err != nil {
+			// Warp 10 may still store the datapoints after a timeout, their series staying counted
+			if _, ok := err.(WarpTimeout); ok {
+				in.Commit()
+			} else {
+				in.Rollback()
+			}
 			if h.errorHandler != nil {
 				err = h.errorHandler(err)
 			}
 			code, msg = h.handleErr(req, err, c.Get("txn").(string))
+			contentType = echo.MIMETextPlainCharsetUTF8
 			log.WithError(err).WithFields(log.Fields{
 				"txn":  c.Get("txn").(string),
 				"code": code,
 			}).Warn("Fail to close connection")
+			return nil
+		}
+
+		in.Commit()
+		if err := in.Meta.Send(); err != nil {
+			// The datapoints are stored, the attributes being sent again with the next datapoints
+			log.WithError(err).WithFields(log.Fields{
+				"txn": c.Get("txn").(string),
+			}).Warn("Fail to send series attributes")
 		}
 
 	}
@@ -296,6 +352,20 @@ func (h *Handler) handleErr(req *http.Request, err error, txn string) (int, stri
 		return code, ierr.Error()
 	}
 
+	if terr, ok := err.(WarpTimeout); ok {
+		code = http.StatusGatewayTimeout
+		log.WithFields(log.Fields{
+			"txn":     txn,
+			"timeout": terr.Timeout,
+			"code":    code,
+		}).Warn(terr)
+		h.errCounter.With(prometheus.Labels{
+			"status": strconv.Itoa(code),
+		}).Inc()
+
+		return code, terr.Error()
+	}
+
 	if ierr, ok := err.(WarpGoneError); ok {
 		code = http.StatusGone
 		log.WithFields(log.Fields{
@@ -311,6 +381,33 @@ func (h *Handler) handleErr(req *http.Request, err error, txn string) (int, stri
 		return code, ierr.Error()
 	}
 
+	if cerr, ok := err.(CardinalityExceeded); ok {
+		code = http.StatusTooManyRequests
+		log.WithFields(log.Fields{
+			"txn":   txn,
+			"limit": cerr.Limit,
+			"code":  code,
+		}).Warn(cerr)
+		h.errCounter.With(prometheus.Labels{
+			"status": strconv.Itoa(code),
+		}).Inc()
+
+		return code, cerr.Error()
+	}
+
+	if Rejected(err) {
+		code = http.StatusBadRequest
+		log.WithFields(log.Fields{
+			"txn":  txn,
+			"code": code,
+		}).Warn(err)
+		h.errCounter.With(prometheus.Labels{
+			"status": strconv.Itoa(code),
+		}).Inc()
+
+		return code, err.Error()
+	}
+
 	if ierr, ok := err.(InfluxDBParseError); ok {
 		code = http.StatusBadRequest
 		log.WithFields(log.Fields{
@@ -324,7 +421,7 @@ func (h *Handler) handleErr(req *http.Request, err error, txn string) (int, stri
 		}).Inc()
 
 		err, _ := json.Marshal(ierr)
-		return code, fmt.Sprintf("{\"error\":\"%s\"", err)
+		return code, string(err)
 	}
 
 	if perr, ok := err.(ParsingError); ok {
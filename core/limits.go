@@ -0,0 +1,257 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// limitHashLength is the number of hexadecimal characters of the hash appended by the hash action
+const limitHashLength = 8
+
+var limitCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "catalyst",
+	Subsystem: "pipeline",
+	Name:      "limit_violations",
+	Help:      "Number of series limits violations.",
+}, []string{"route", "violation", "action"})
+
+func init() {
+	prometheus.MustRegister(limitCounter)
+}
+
+// SeriesLimitError is returned when a datapoint exceeds a series limit with the reject action
+type SeriesLimitError struct {
+	Class     string
+	Violation string
+	Limit     int
+}
+
+func (e SeriesLimitError) Error() string {
+	return fmt.Sprintf("Series limit exceeded on %s: %s (limit %d)", e.Class, e.Violation, e.Limit)
+}
+
+// seriesLimits are the limits of a series, 0 being unlimited
+type seriesLimits struct {
+	maxLabels           int
+	maxLabelNameLength  int
+	maxLabelValueLength int
+	maxClassLength      int
+	maxLineSize         int
+	action              string
+	overflowLabel       string
+}
+
+// parseSeriesLimits read the limits of conf, unset ones defaulting to def
+func parseSeriesLimits(conf map[string]interface{}, def seriesLimits) (seriesLimits, error) {
+	l := def
+	for key, limit := range map[string]*int{
+		"max_labels":             &l.maxLabels,
+		"max_label_name_length":  &l.maxLabelNameLength,
+		"max_label_value_length": &l.maxLabelValueLength,
+		"max_class_length":       &l.maxClassLength,
+		"max_line_size":          &l.maxLineSize,
+	} {
+		if v, ok := conf[key]; ok {
+			*limit = cast.ToInt(v)
+		}
+	}
+	if v, ok := conf["action"]; ok {
+		l.action = cast.ToString(v)
+	}
+	if v, ok := conf["overflow_label"]; ok {
+		l.overflowLabel = cast.ToString(v)
+	}
+
+	switch l.action {
+	case "truncate", "drop", "reject":
+	case "hash":
+		for _, limit := range []int{l.maxLabelNameLength, l.maxLabelValueLength, l.maxClassLength} {
+			if limit > 0 && limit <= limitHashLength {
+				return l, fmt.Errorf("lengths must be greater than %d with the hash action", limitHashLength)
+			}
+		}
+	default:
+		return l, fmt.Errorf("invalid action '%s'", l.action)
+	}
+
+	return l, nil
+}
+
+// enabled returns whether a limit is set
+func (l *seriesLimits) enabled() bool {
+	return l.maxLabels > 0 || l.maxLabelNameLength > 0 || l.maxLabelValueLength > 0 || l.maxClassLength > 0 || l.maxLineSize > 0
+}
+
+// limitsStage enforce the global and token series limits
+type limitsStage struct {
+	global seriesLimits
+	tokens map[string]seriesLimits
+}
+
+// newLimitsStage build the series limits stage from the `limits` configuration, it returns nil without limits
+func newLimitsStage() (Stage, error) {
+	global, err := parseSeriesLimits(cast.ToStringMap(viper.Get("limits")), seriesLimits{
+		action:        "reject",
+		overflowLabel: "_overflow",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("limits: %v", err)
+	}
+
+	tokens := map[string]seriesLimits{}
+	err = ParseTokens("limits", func(token string, conf map[string]interface{}) (err error) {
+		tokens[token], err = parseSeriesLimits(conf, global)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !global.enabled() && len(tokens) == 0 {
+		return nil, nil
+	}
+
+	return &limitsStage{global: global, tokens: tokens}, nil
+}
+
+// Process a datapoint
+func (s *limitsStage) Process(in *Ingest, gts *GTS, next Emit) error {
+	l, ok := s.tokens[in.Token]
+	if !ok {
+		l = s.global
+	}
+
+	// violation handle a violated limit, it returns whether the datapoint can be updated
+	var err error
+	violation := func(kind string, limit int) bool {
+		limitCounter.With(prometheus.Labels{"route": in.Route, "violation": kind, "action": l.action}).Inc()
+		switch l.action {
+		case "reject":
+			err = SeriesLimitError{Class: gts.Name, Violation: kind, Limit: limit}
+		case "drop":
+			err = errLimitDropped
+		}
+		return err == nil
+	}
+
+	labels := gts.Labels
+	updated := false
+
+	if l.maxClassLength > 0 && len(gts.Name) > l.maxClassLength && violation("class_length", l.maxClassLength) {
+		gts.Name = l.shorten(gts.Name, l.maxClassLength)
+	}
+
+	if l.maxLabelNameLength > 0 || l.maxLabelValueLength > 0 {
+		for name, value := range gts.Labels {
+			if err != nil {
+				break
+			}
+
+			k, v := name, value
+			if l.maxLabelNameLength > 0 && len(k) > l.maxLabelNameLength && violation("label_name_length", l.maxLabelNameLength) {
+				k = l.shorten(k, l.maxLabelNameLength)
+			}
+			if l.maxLabelValueLength > 0 && len(v) > l.maxLabelValueLength && violation("label_value_length", l.maxLabelValueLength) {
+				v = l.shorten(v, l.maxLabelValueLength)
+			}
+
+			if err == nil && (k != name || v != value) {
+				if !updated {
+					labels = copyLabels(gts.Labels)
+					updated = true
+				}
+				delete(labels, name)
+				labels[k] = v
+			}
+		}
+	}
+
+	if err == nil && l.maxLabels > 0 && len(labels) > l.maxLabels && violation("labels", l.maxLabels) {
+		labels = l.truncateLabels(labels)
+		updated = true
+	}
+
+	if err == errLimitDropped {
+		Dropped(in, "limits")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if updated {
+		gts.Labels = labels
+	}
+
+	if l.maxLineSize > 0 && gts.Size() > l.maxLineSize {
+		// A line can not be shortened, it is dropped unless rejected
+		limitCounter.With(prometheus.Labels{"route": in.Route, "violation": "line_size", "action": l.action}).Inc()
+		if l.action == "reject" {
+			return SeriesLimitError{Class: gts.Name, Violation: "line_size", Limit: l.maxLineSize}
+		}
+		Dropped(in, "limits")
+		return nil
+	}
+
+	return next(gts)
+}
+
+var errLimitDropped = errors.New("dropped by the series limits")
+
+// shorten truncate s to max bytes, ending with a hash of s with the hash action so that values stay distinct
+func (l *seriesLimits) shorten(s string, max int) string {
+	if l.action != "hash" {
+		return truncateUTF8(s, max)
+	}
+
+	sum := sha256.Sum256([]byte(s))
+	return truncateUTF8(s, max-limitHashLength) + hex.EncodeToString(sum[:])[:limitHashLength]
+}
+
+// truncateLabels keep the first labels by name, the others being replaced by the overflow label with the hash action
+func (l *seriesLimits) truncateLabels(labels map[string]string) map[string]string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	keep := l.maxLabels
+	if l.action == "hash" {
+		keep--
+	}
+
+	truncated := make(map[string]string, l.maxLabels)
+	for _, name := range names[:keep] {
+		truncated[name] = labels[name]
+	}
+
+	if l.action == "hash" {
+		h := sha256.New()
+		for _, name := range names[keep:] {
+			fmt.Fprintf(h, "%s=%s,", name, labels[name])
+		}
+		truncated[l.overflowLabel] = hex.EncodeToString(h.Sum(nil))[:limitHashLength]
+	}
+
+	return truncated
+}
+
+// truncateUTF8 truncate s to at most max bytes without splitting a rune
+func truncateUTF8(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max]
+}
@@ -0,0 +1,70 @@
+package core
+
+import "container/list"
+
+// LRU holds up to size entries, the least recently used one being evicted to add a new one. A size of 0 or
+// less does not bound the entries. LRU is not safe for concurrent use.
+type LRU struct {
+	size    int
+	entries map[interface{}]*list.Element
+	order   *list.List
+	// OnEvict is called with the entries evicted to add new ones
+	OnEvict func(key, value interface{})
+}
+
+type lruEntry struct {
+	key   interface{}
+	value interface{}
+}
+
+// NewLRU returns an empty LRU of size entries
+func NewLRU(size int) *LRU {
+	return &LRU{
+		size:    size,
+		entries: map[interface{}]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+// Get returns the value of a key, marking it as recently used
+func (c *LRU) Get(key interface{}) (interface{}, bool) {
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*lruEntry).value, true
+}
+
+// Add set the value of a key, evicting the least recently used entry when full
+func (c *LRU) Add(key, value interface{}) {
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*lruEntry).value = value
+		c.order.MoveToFront(e)
+		return
+	}
+
+	if c.size > 0 && c.order.Len() >= c.size {
+		oldest := c.order.Back()
+		entry := oldest.Value.(*lruEntry)
+		c.order.Remove(oldest)
+		delete(c.entries, entry.key)
+		if c.OnEvict != nil {
+			c.OnEvict(entry.key, entry.value)
+		}
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, value: value})
+}
+
+// Remove a key
+func (c *LRU) Remove(key interface{}) {
+	if e, ok := c.entries[key]; ok {
+		c.order.Remove(e)
+		delete(c.entries, key)
+	}
+}
+
+// Len returns the number of entries
+func (c *LRU) Len() int {
+	return c.order.Len()
+}
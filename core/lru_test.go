@@ -0,0 +1,42 @@
+package core
+
+import "testing"
+
+func TestLRU(t *testing.T) {
+	var evicted []interface{}
+	c := NewLRU(2)
+	c.OnEvict = func(key, _ interface{}) {
+		evicted = append(evicted, key)
+	}
+
+	c.Add("a", 1)
+	c.Add("b", 2)
+	if v, ok := c.Get("a"); !ok || v != 1 {
+		t.Fatalf("got %v, %v", v, ok)
+	}
+
+	// b is the least recently used entry
+	c.Add("c", 3)
+	if _, ok := c.Get("b"); ok || len(evicted) != 1 || evicted[0] != "b" {
+		t.Errorf("got evicted %v", evicted)
+	}
+
+	// Updating an entry does not evict
+	c.Add("a", 4)
+	if v, _ := c.Get("a"); v != 4 || c.Len() != 2 || len(evicted) != 1 {
+		t.Errorf("got %v, %d entries, evicted %v", v, c.Len(), evicted)
+	}
+
+	c.Remove("a")
+	if _, ok := c.Get("a"); ok || c.Len() != 1 {
+		t.Errorf("got %d entries after removing a", c.Len())
+	}
+
+	unbounded := NewLRU(0)
+	for i := 0; i < 100; i++ {
+		unbounded.Add(i, i)
+	}
+	if unbounded.Len() != 100 {
+		t.Errorf("got %d entries without size", unbounded.Len())
+	}
+}
@@ -0,0 +1,201 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var (
+	metaCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "catalyst",
+		Subsystem: "meta",
+		Name:      "series",
+		Help:      "Number of series attributes sent, unchanged or in error.",
+	}, []string{"route", "result"})
+
+	metaSent     *metaCache
+	metaSentOnce sync.Once
+)
+
+func init() {
+	prometheus.MustRegister(metaCounter)
+}
+
+// metaKey identifies a series of a token
+type metaKey struct {
+	token  string
+	series uint64
+}
+
+// metaEntry is the hash of the last attributes sent for a series
+type metaEntry struct {
+	attributes uint64
+	expire     time.Time
+}
+
+// metaCache remember the attributes sent to Warp 10 for the series last written, a series being sent again once
+// its attributes change, its entry expire or is evicted
+type metaCache struct {
+	ttl     time.Duration
+	entries *LRU
+	mutex   sync.Mutex
+}
+
+// initMetaCache build the cache from the `meta.cache` configuration
+func initMetaCache() {
+	metaSent = &metaCache{
+		ttl:     viper.GetDuration("meta.cache.ttl"),
+		entries: NewLRU(viper.GetInt("meta.cache.size")),
+	}
+}
+
+// unchanged returns whether the attributes of a series were already sent
+func (c *metaCache) unchanged(key metaKey, attributes uint64) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	v, ok := c.entries.Get(key)
+	if !ok {
+		return false
+	}
+	e := v.(metaEntry)
+	return e.attributes == attributes && (c.ttl <= 0 || time.Now().Before(e.expire))
+}
+
+// insert remember the attributes sent for a series, the least recently written series being evicted when the
+// cache is full
+func (c *metaCache) insert(key metaKey, attributes uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.entries.Add(key, metaEntry{attributes: attributes, expire: time.Now().Add(c.ttl)})
+}
+
+// Meta collects the Warp 10 attributes of the series of a request, see GTS.Attributes. The attributes that
+// changed are sent to the meta endpoint once the datapoints are stored, Warp 10 ignoring unknown series.
+type Meta struct {
+	in      *Ingest
+	lines   []byte
+	pending map[metaKey]uint64
+}
+
+// NewMeta returns the attributes collector of a request
+func NewMeta(in *Ingest) *Meta {
+	metaSentOnce.Do(initMetaCache)
+	return &Meta{in: in, pending: map[metaKey]uint64{}}
+}
+
+// add the attributes of a datapoint if they changed since they were last sent
+func (m *Meta) add(gts *GTS) {
+	key := metaKey{token: m.in.Token, series: seriesHash(gts)}
+	attributes := attributesHash(gts.Attributes)
+
+	if h, ok := m.pending[key]; ok && h == attributes {
+		return
+	}
+	if metaSent.unchanged(key, attributes) {
+		metaCounter.With(prometheus.Labels{"route": m.in.Route, "result": "unchanged"}).Inc()
+		return
+	}
+	m.pending[key] = attributes
+
+	labels := make([]string, 0, 2*len(gts.Labels))
+	for k, v := range gts.Labels {
+		labels = append(labels, k, v)
+	}
+	sortLabelPairs(labels)
+	m.lines = appendPrefix(m.lines, gts.Name, labels)
+
+	attrs := make([]string, 0, 2*len(gts.Attributes))
+	for k, v := range gts.Attributes {
+		attrs = append(attrs, k, v)
+	}
+	sortLabelPairs(attrs)
+	m.lines = appendPrefix(m.lines, "", attrs)
+	m.lines = append(m.lines, '\r', '\n')
+}
+
+// Send the changed attributes to the Warp 10 meta endpoint, `warp_endpoint_meta` defaulting to `warp_endpoint`
+func (m *Meta) Send() error {
+	if len(m.pending) == 0 {
+		return nil
+	}
+	httpClientSingleton.Do(initWarp)
+
+	endpoint := warpEndpoint
+	if viper.IsSet("warp_endpoint_meta") {
+		endpoint = viper.GetString("warp_endpoint_meta")
+	}
+
+	err := m.post(endpoint + "/api/v0/meta")
+	result := "sent"
+	if err != nil {
+		result = "error"
+	}
+	metaCounter.With(prometheus.Labels{"route": m.in.Route, "result": result}).Add(float64(len(m.pending)))
+	if err != nil {
+		return err
+	}
+
+	for key, attributes := range m.pending {
+		metaSent.insert(key, attributes)
+	}
+	return nil
+}
+
+func (m *Meta) post(url string) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(m.lines))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Warp10-Token", m.in.Token)
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("Txn", m.in.Txn)
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := res.Body.Close(); err != nil {
+			log.WithError(err).Error("Cannot close response body")
+		}
+	}()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %v - %v", res.StatusCode, string(body))
+	}
+	return nil
+}
+
+// attributesHash returns the hash of a set of attributes
+func attributesHash(attributes map[string]string) uint64 {
+	names := make([]string, 0, len(attributes))
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := fnv.New64a()
+	for _, name := range names {
+		_, _ = h.Write([]byte(name))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(attributes[name]))
+		_, _ = h.Write([]byte{0})
+	}
+	return h.Sum64()
+}
@@ -0,0 +1,245 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+var droppedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "catalyst",
+	Subsystem: "pipeline",
+	Name:      "dropped_datapoints",
+	Help:      "Number of datapoints dropped by a pipeline stage.",
+}, []string{"route", "stage"})
+
+func init() {
+	prometheus.MustRegister(droppedCounter)
+}
+
+// encodePool holds the buffers the datapoints are encoded into before being sent
+var encodePool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 256)
+		return &b
+	},
+}
+
+// Emit push a datapoint into a pipeline
+type Emit func(*GTS) error
+
+// Ingest describe the request the datapoints of a pipeline come from
+type Ingest struct {
+	// Route is the name of the pipeline, such as influxdb or graphite_tcp
+	Route string
+	Token string
+	Txn   string
+	// Now is the reference time of the timestamps in platform time units, such as the X-Warp10-Now header,
+	// 0 meaning the server clock
+	Now int64
+	// Meta collects the attributes of the emitted series, nil ignoring them
+	Meta *Meta
+
+	// reserved are the new series of the request, see Commit and Rollback
+	reserved *reservedSeries
+}
+
+// Catalyser parse a protocol payload into datapoints, it returns the reply to answer once they are stored
+type Catalyser interface {
+	Catalyse(u *url.URL, header *http.Header, r io.Reader, emit Emit) (Reply, error)
+}
+
+// CatalyserFunc is a function implementing Catalyser
+type CatalyserFunc func(*url.URL, *http.Header, io.Reader, Emit) (Reply, error)
+
+// Catalyse calls f
+func (f CatalyserFunc) Catalyse(u *url.URL, header *http.Header, r io.Reader, emit Emit) (Reply, error) {
+	return f(u, header, r, emit)
+}
+
+// Stage process the datapoints of a pipeline. A filter drops a datapoint by not calling next,
+// a validator rejects the request by returning an error.
+type Stage interface {
+	Process(in *Ingest, gts *GTS, next Emit) error
+}
+
+// StageFunc is a function implementing Stage
+type StageFunc func(in *Ingest, gts *GTS, next Emit) error
+
+// Process calls f
+func (f StageFunc) Process(in *Ingest, gts *GTS, next Emit) error {
+	return f(in, gts, next)
+}
+
+// StageFactory build a stage from its configuration
+type StageFactory func(conf map[string]interface{}) (Stage, error)
+
+var stageFactories = map[string]StageFactory{}
+
+// RegisterStage register a stage type usable in the pipelines configuration
+func RegisterStage(name string, factory StageFactory) {
+	stageFactories[name] = factory
+}
+
+// Encoder turn the datapoints of a payload into the bytes of a sink, it may rely on the previous datapoints
+type Encoder interface {
+	// Encode append a datapoint to dst
+	Encode(dst []byte, gts *GTS) []byte
+	// Reset forget the previous datapoints, the next one starting a new payload
+	Reset()
+}
+
+// EncoderFactory returns the encoder of a new payload
+type EncoderFactory func() Encoder
+
+// Sink receive the encoded datapoints, such as a Warp 10 connection. The bytes are only valid during the call.
+type Sink interface {
+	Send(b []byte) error
+}
+
+// SinkFunc is a function implementing Sink
+type SinkFunc func(b []byte) error
+
+// Send calls f
+func (f SinkFunc) Send(b []byte) error {
+	return f(b)
+}
+
+// Pipeline chains the stages of a route then encode the datapoints for the sink
+type Pipeline struct {
+	Route   string
+	Stages  []Stage
+	Encoder EncoderFactory
+}
+
+// NewPipeline build the pipeline of a route from the `relabel`, `pipelines.<route>`, `reserved_labels`, `limits` and `cardinality` configuration
+func NewPipeline(route string) (*Pipeline, error) {
+	p := &Pipeline{
+		Route:   route,
+		Encoder: NewSensisionEncoder,
+	}
+
+	// Timestamps are checked first, they are not changed by the other stages
+	timestamps, err := newTimestampsStage(route)
+	if err != nil {
+		return nil, fmt.Errorf("pipeline %s: %v", route, err)
+	}
+	if timestamps != nil {
+		p.Stages = append(p.Stages, timestamps)
+	}
+
+	special, err := newSpecialValuesStage(route)
+	if err != nil {
+		return nil, fmt.Errorf("pipeline %s: %v", route, err)
+	}
+	p.Stages = append(p.Stages, special)
+
+	// The relabeling rules of the route come next
+	relabel, err := newRouteRelabelStage(route)
+	if err != nil {
+		return nil, fmt.Errorf("pipeline %s: %v", route, err)
+	}
+	if relabel != nil {
+		p.Stages = append(p.Stages, relabel)
+	}
+
+	for i, raw := range cast.ToSlice(viper.Get("pipelines." + route)) {
+		conf := cast.ToStringMap(raw)
+		kind := cast.ToString(conf["type"])
+
+		factory, ok := stageFactories[kind]
+		if !ok {
+			return nil, fmt.Errorf("pipeline %s: unknown stage type '%s'", route, kind)
+		}
+
+		stage, err := factory(conf)
+		if err != nil {
+			return nil, fmt.Errorf("pipeline %s: stage %d (%s): %v", route, i, kind, err)
+		}
+		p.Stages = append(p.Stages, stage)
+	}
+
+	// Reserved labels are checked last, once labels can no more change
+	reserved, err := newReservedStage(route)
+	if err != nil {
+		return nil, fmt.Errorf("pipeline %s: %v", route, err)
+	}
+	p.Stages = append(p.Stages, reserved)
+
+	limits, err := newLimitsStage()
+	if err != nil {
+		return nil, fmt.Errorf("pipeline %s: %v", route, err)
+	}
+	if limits != nil {
+		p.Stages = append(p.Stages, limits)
+	}
+
+	// Series are counted once final, the cardinality being shared by all the routes of a token
+	cardinality, err := getCardinalityLimiter()
+	if err != nil {
+		return nil, fmt.Errorf("pipeline %s: %v", route, err)
+	}
+	if cardinality != nil {
+		p.Stages = append(p.Stages, cardinality)
+	}
+
+	return p, nil
+}
+
+// Emitter returns the entry point of the pipeline for a request, sending the encoded datapoints to the sink.
+// The datapoints are encoded as a single payload, a sink splitting it must use a new emitter for each part.
+func (p *Pipeline) Emitter(in *Ingest, sink Sink) Emit {
+	factory := p.Encoder
+	if factory == nil {
+		factory = NewSensisionEncoder
+	}
+	encoder := factory()
+
+	emit := func(gts *GTS) error {
+		buf := encodePool.Get().(*[]byte)
+		*buf = encoder.Encode((*buf)[:0], gts)
+		err := sink.Send(*buf)
+		encodePool.Put(buf)
+
+		// The sink may not have received the datapoint, the next one must not continue its series
+		if err != nil {
+			encoder.Reset()
+			return err
+		}
+
+		// Attributes are collected once the stages set the final class and labels of the series
+		if in.Meta != nil && len(gts.Attributes) > 0 {
+			in.Meta.add(gts)
+		}
+		return nil
+	}
+
+	for i := len(p.Stages) - 1; i >= 0; i-- {
+		stage, next := p.Stages[i], emit
+		emit = func(gts *GTS) error {
+			return stage.Process(in, gts, next)
+		}
+	}
+
+	return emit
+}
+
+// Dropped count a datapoint dropped by a stage
+func Dropped(in *Ingest, stage string) {
+	droppedCounter.With(prometheus.Labels{"route": in.Route, "stage": stage}).Inc()
+}
+
+// Rejected returns whether an error is a datapoint rejected by a pipeline stage
+func Rejected(err error) bool {
+	switch err.(type) {
+	case ReservedLabelError, SeriesLimitError, TimestampError:
+		return true
+	}
+	return false
+}
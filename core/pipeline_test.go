@@ -0,0 +1,490 @@
+package core
+
+import (
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/value"
+	"github.com/spf13/viper"
+)
+
+func TestPipeline(t *testing.T) {
+	filter, err := newFilterStage(map[string]interface{}{
+		"action": "drop",
+		"class":  `debug\..*`,
+		"labels": map[string]interface{}{"env": "dev|test"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Pipeline{
+		Route:  "test",
+		Stages: []Stage{filter, validateStage{}},
+	}
+
+	var sent []string
+	emit := p.Emitter(&Ingest{Route: "test"}, SinkFunc(func(b []byte) error {
+		sent = append(sent, string(b))
+		return nil
+	}))
+
+	for _, gts := range []*GTS{
+		{Ts: 1, Name: "debug.cpu", Labels: map[string]string{"env": "dev"}, Value: int64(1)},
+		{Ts: 2, Name: "debug.cpu", Labels: map[string]string{"env": "prod"}, Value: int64(2)},
+		{Ts: 3, Name: "cpu", Labels: map[string]string{"env": "dev"}, Value: true},
+	} {
+		if err := emit(gts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []string{
+		"2// debug.cpu{env=prod} 2\r\n",
+		"3// cpu{env=dev} T\r\n",
+	}
+	if !reflect.DeepEqual(sent, expected) {
+		t.Errorf("got %q, expected %q", sent, expected)
+	}
+
+	if err := emit(&GTS{Ts: 4, Labels: map[string]string{}, Value: int64(4)}); err == nil {
+		t.Error("expected a validation error for a datapoint without class")
+	}
+}
+
+func TestParseSensision(t *testing.T) {
+	tests := []struct {
+		line     string
+		ts       int64
+		position string
+		name     string
+		labels   map[string]string
+		value    interface{}
+	}{
+		{"1000// cpu{host=a,dc=b} 42", 1000, "/", "cpu", map[string]string{"host": "a", "dc": "b"}, int64(42)},
+		{"// cpu%7Bx%7D{} 'it%27s%20ok'", NoTimestamp, "/", "cpu{x}", map[string]string{}, "it's ok"},
+		{"1000/48.8:2.3/100 gps{} T", 1000, "48.8:2.3/100", "gps", map[string]string{}, true},
+		{"1000/-33.5:-70.25/ gps{} T", 1000, "-33.5:-70.25/", "gps", map[string]string{}, true},
+		{"1000//-5 gps{} T", 1000, "/-5", "gps", map[string]string{}, true},
+		{"1000// cpu{} 3.14", 1000, "/", "cpu", map[string]string{}, RawValue("3.14")},
+		{"1000// cpu{} [ 1 2 ]", 1000, "/", "cpu", map[string]string{}, RawValue("[ 1 2 ]")},
+		{"=2000// 43", 2000, "/", "cpu", map[string]string{"host": "a"}, int64(43)},
+	}
+
+	previous := &GTS{Name: "cpu", Labels: map[string]string{"host": "a"}}
+	for _, test := range tests {
+		gts, err := ParseSensision(test.line, previous)
+		if err != nil {
+			t.Errorf("%s: %v", test.line, err)
+			continue
+		}
+
+		if gts.Ts != test.ts {
+			t.Errorf("%s: got timestamp %v, expected %v", test.line, gts.Ts, test.ts)
+		}
+		if position := string(appendPosition(nil, gts))[1:]; position != test.position || gts.Name != test.name || !reflect.DeepEqual(gts.Labels, test.labels) || gts.Value != test.value {
+			t.Errorf("%s: got %+v", test.line, gts)
+		}
+		if test.position != "/" && string(gts.Encode()) != test.line+"\r\n" {
+			t.Errorf("%s: encoded as %q", test.line, gts.Encode())
+		}
+	}
+
+	// Attributes are carried to the meta endpoint
+	gts, err := ParseSensision("1000// cpu{host=a}{owner=ops%20team} 1", nil)
+	if err != nil || !reflect.DeepEqual(gts.Labels, map[string]string{"host": "a"}) || !reflect.DeepEqual(gts.Attributes, map[string]string{"owner": "ops team"}) || gts.Value != int64(1) {
+		t.Errorf("got %+v, %v with attributes", gts, err)
+	}
+
+	// Special values are read as floats for the special values stage
+	for line, kind := range map[string]string{"1000// cpu{} NaN": "nan", "1000// cpu{} Infinity": "inf", "1000// cpu{} -Infinity": "inf"} {
+		gts, err := ParseSensision(line, nil)
+		if err != nil || specialKind(gts.Value) != kind {
+			t.Errorf("%s: got %v, %v", line, gts, err)
+			continue
+		}
+		if string(gts.Encode()) != line+"\r\n" {
+			t.Errorf("%s: encoded as %q", line, gts.Encode())
+		}
+	}
+
+	for _, line := range []string{"1000// cpu{}", "cpu{} 1", "1000// {} 1", "=1000// 1", "1000/91:0/ cpu{} 1", "1000/1/ cpu{} 1", "1000//1.5 cpu{} 1", "1000// cpu{}{owner 1", "1000// cpu{}{owner} 1"} {
+		if _, err := ParseSensision(line, nil); err == nil {
+			t.Errorf("%s: expected an error", line)
+		}
+	}
+}
+
+func TestReservedLabels(t *testing.T) {
+	viper.Set("reserved_labels.prefixes", []string{"__"})
+	viper.Set("reserved_labels.rename_prefix", "_")
+	defer viper.Reset()
+
+	tests := []struct {
+		policy   string
+		expected map[string]string
+	}{
+		{"reject", nil},
+		{"strip", map[string]string{"host": "a"}},
+		{"rename", map[string]string{"host": "a", "_app": "spoof", "_x": "y"}},
+	}
+
+	for _, test := range tests {
+		viper.Set("reserved_labels.policy", test.policy)
+		stage, err := newReservedStage("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		labels := map[string]string{"host": "a", ".app": "spoof", "__x": "y"}
+		var got map[string]string
+		err = stage.Process(&Ingest{Route: "test"}, &GTS{Name: "cpu", Labels: labels, Value: int64(1)}, func(gts *GTS) error {
+			got = gts.Labels
+			return nil
+		})
+
+		if test.expected == nil {
+			if _, ok := err.(ReservedLabelError); !ok {
+				t.Errorf("%s: expected a reserved label error, got %v", test.policy, err)
+			}
+			continue
+		}
+
+		if err != nil || !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%s: got %v (%v), expected %v", test.policy, got, err, test.expected)
+		}
+		if len(labels) != 3 {
+			t.Errorf("%s: the datapoint labels have been updated in place", test.policy)
+		}
+	}
+
+	viper.Set("reserved_labels.policy", "rename")
+	viper.Set("reserved_labels.rename_prefix", ".")
+	if _, err := newReservedStage("test"); err == nil {
+		t.Error("expected an error for a reserved rename prefix")
+	}
+}
+
+func TestSeriesLimits(t *testing.T) {
+	long := strings.Repeat("é", 10)
+	tests := []struct {
+		action string
+		name   string
+		labels map[string]string
+		err    bool
+	}{
+		{"truncate", "cpu.user.tot", map[string]string{"a": "1", "b": "éééééééé"}, false},
+		{"hash", "cpu.724834ff", map[string]string{"_overflow": "dd50a9bc", "a": "1"}, false},
+		{"drop", "", nil, false},
+		{"reject", "", nil, true},
+	}
+
+	for _, test := range tests {
+		l, err := parseSeriesLimits(map[string]interface{}{
+			"max_labels":             2,
+			"max_label_value_length": 16,
+			"max_class_length":       12,
+			"action":                 test.action,
+		}, seriesLimits{overflowLabel: "_overflow"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got *GTS
+		stage := &limitsStage{global: l}
+		err = stage.Process(&Ingest{Route: "test"}, &GTS{
+			Name:   "cpu.user.total.time",
+			Labels: map[string]string{"a": "1", "b": long + long, "c": "3"},
+			Value:  int64(1),
+		}, func(gts *GTS) error {
+			got = gts
+			return nil
+		})
+
+		if _, ok := err.(SeriesLimitError); ok != test.err {
+			t.Errorf("%s: got error %v", test.action, err)
+		}
+		if test.labels == nil {
+			if got != nil {
+				t.Errorf("%s: expected the datapoint to be dropped", test.action)
+			}
+			continue
+		}
+
+		if got == nil || got.Name != test.name || !reflect.DeepEqual(got.Labels, test.labels) {
+			t.Errorf("%s: got %+v", test.action, got)
+		}
+	}
+}
+
+func TestTimestampWindow(t *testing.T) {
+	now := Timestamp(time.Now())
+	day := Units(24 * time.Hour)
+
+	tests := []struct {
+		action string
+		ts     int64
+		// expected is the timestamp of the emitted datapoint, NoTimestamp when dropped
+		expected int64
+		err      bool
+	}{
+		{"reject", now - day, now - day, false},
+		{"reject", NoTimestamp, NoTimestamp, false},
+		{"accept", now - 400*day, now - 400*day, false},
+		{"clamp", now - 400*day, now, false},
+		{"clamp", now + 2*day, now, false},
+		{"drop", now + 2*day, NoTimestamp, false},
+		{"reject", 0, NoTimestamp, true},
+	}
+
+	for _, test := range tests {
+		w, err := parseTimestampWindow(map[string]interface{}{
+			"past":   "8760h",
+			"future": "1h",
+			"action": test.action,
+		}, timestampWindow{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		emitted := false
+		got := NoTimestamp
+		stage := &timestampsStage{global: w}
+		err = stage.Process(&Ingest{Route: "test", Now: now}, &GTS{Ts: test.ts, Name: "cpu", Value: int64(1)}, func(gts *GTS) error {
+			emitted = true
+			got = gts.Ts
+			return nil
+		})
+
+		if _, ok := err.(TimestampError); ok != test.err || ok != Rejected(err) {
+			t.Errorf("%s %d: got error %v", test.action, test.ts, err)
+		}
+		if test.expected == NoTimestamp && test.ts != NoTimestamp {
+			if emitted {
+				t.Errorf("%s %d: expected the datapoint to be dropped", test.action, test.ts)
+			}
+			continue
+		}
+		if got != test.expected {
+			t.Errorf("%s %d: got timestamp %d, expected %d", test.action, test.ts, got, test.expected)
+		}
+	}
+
+	// Imports are only checked with their own window
+	viper.Set("timestamps.past", "1h")
+	defer viper.Reset()
+	for route, enabled := range map[string]bool{"influxdb": true, "import": false} {
+		if stage, err := newTimestampsStage(route); err != nil || (stage != nil) != enabled {
+			t.Errorf("%s: got %v, %v", route, stage, err)
+		}
+	}
+	viper.Set("timestamps.routes.import.past", "8760h")
+	if stage, err := newTimestampsStage("import"); err != nil || stage == nil {
+		t.Errorf("import: got %v, %v with a route window", stage, err)
+	}
+
+	for _, invalid := range []map[string]interface{}{
+		{"action": "ignore"},
+		{"past": "-1h"},
+		{"future": "soon"},
+	} {
+		if _, err := parseTimestampWindow(invalid, timestampWindow{action: "reject"}); err == nil {
+			t.Errorf("%v: expected an error", invalid)
+		}
+	}
+}
+
+func TestSpecialValues(t *testing.T) {
+	defer viper.Reset()
+	viper.Set("special_values.sentinel", -1)
+	viper.Set("special_values.staleness_suffix", ".stale")
+
+	stale := math.Float64frombits(value.StaleNaN)
+	tests := []struct {
+		policy string
+		value  float64
+		// expected is the encoded datapoint, empty when dropped
+		expected string
+	}{
+		{"drop", 1.5, "1// cpu{} 1.5\r\n"},
+		{"drop", math.NaN(), ""},
+		{"drop", stale, ""},
+		{"keep", math.Inf(-1), "1// cpu{} -Infinity\r\n"},
+		{"keep", stale, "1// cpu{} NaN\r\n"},
+		{"sentinel", math.Inf(1), "1// cpu{} -1.0\r\n"},
+		{"staleness", math.NaN(), "1// cpu{} NaN\r\n"},
+		{"staleness", stale, "1// cpu.stale{} T\r\n"},
+	}
+
+	for _, test := range tests {
+		viper.Set("special_values.policy", test.policy)
+		stage, err := newSpecialValuesStage("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := ""
+		err = stage.Process(&Ingest{Route: "test"}, &GTS{Ts: 1, Name: "cpu", Labels: map[string]string{}, Value: test.value}, func(gts *GTS) error {
+			got = string(gts.Encode())
+			return nil
+		})
+		if err != nil || got != test.expected {
+			t.Errorf("%s %v: got %q, %v", test.policy, test.value, got, err)
+		}
+	}
+
+	// Without policy, every route keeps the special values
+	viper.Set("special_values.policy", "")
+	for _, route := range []string{"graphite", "opentsdb", "prometheus_remote_write"} {
+		if stage, err := newSpecialValuesStage(route); err != nil || stage.(*specialValuesStage).policy != "keep" {
+			t.Errorf("%s: got %+v, %v", route, stage, err)
+		}
+	}
+
+	// Route policies override the global one
+	viper.Set("special_values.policy", "drop")
+	viper.Set("special_values.routes", map[string]interface{}{"prometheus_remote_write": map[string]interface{}{"policy": "sentinel"}})
+	for route, expected := range map[string]string{"graphite": "drop", "prometheus_remote_write": "sentinel"} {
+		if stage, err := newSpecialValuesStage(route); err != nil || stage.(*specialValuesStage).policy != expected {
+			t.Errorf("%s: got %+v, %v", route, stage, err)
+		}
+	}
+
+	viper.Set("special_values.policy", "zero")
+	if _, err := newSpecialValuesStage("test"); err == nil {
+		t.Error("zero: expected an error")
+	}
+}
+
+func TestCardinalityLimiter(t *testing.T) {
+	viper.Set("cardinality.max_series", 2)
+	viper.Set("cardinality.tokens", []interface{}{map[string]interface{}{"token": "big", "max_series": 3}})
+	defer viper.Reset()
+
+	for _, mode := range []string{"exact", "filter"} {
+		viper.Set("cardinality.mode", mode)
+		c, err := newCardinalityLimiter()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for token, budget := range map[string]int{"small": 2, "big": 3} {
+			in := &Ingest{Route: "test", Token: token}
+			for i := 0; i < 5; i++ {
+				gts := &GTS{Name: "cpu", Labels: map[string]string{"host": string(rune('a' + i))}, Value: int64(1)}
+				for _, retry := range []bool{false, true} {
+					err := c.Process(in, gts, func(*GTS) error { return nil })
+					if _, exceeded := err.(CardinalityExceeded); exceeded != (i >= budget) {
+						t.Errorf("%s %s: series %d (retry %v): got error %v", mode, token, i, retry, err)
+					}
+				}
+			}
+		}
+	}
+
+	// Series count once stored, the tokens without series being forgotten
+	viper.Set("cardinality.mode", "exact")
+	viper.Set("cardinality.max_tokens", 2)
+	c, err := newCardinalityLimiter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	process := func(in *Ingest, host string) error {
+		return c.Process(in, &GTS{Name: "cpu", Labels: map[string]string{"host": host}, Value: int64(1)}, func(*GTS) error { return nil })
+	}
+
+	failed := &Ingest{Route: "test", Token: "small"}
+	if err := process(failed, "a"); err != nil {
+		t.Fatal(err)
+	}
+	stored := &Ingest{Route: "test", Token: "small"}
+	if err := process(stored, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := process(&Ingest{Route: "test", Token: "small"}, "c"); err == nil {
+		t.Error("expected the reserved series to count in the budget")
+	}
+	failed.Rollback()
+	stored.Commit()
+	if err := process(&Ingest{Route: "test", Token: "small"}, "c"); err != nil {
+		t.Errorf("got %v once the failed series released", err)
+	}
+	if err := process(&Ingest{Route: "test", Token: "small"}, "b"); err != nil {
+		t.Errorf("got %v for a stored series", err)
+	}
+
+	invalid := &Ingest{Route: "test", Token: "invalid"}
+	if err := process(invalid, "a"); err != nil {
+		t.Fatal(err)
+	}
+	invalid.Rollback()
+	if c.tracked.Len() != 1 {
+		t.Errorf("got %d tokens tracked after a failed write", c.tracked.Len())
+	}
+	for _, token := range []string{"big", "other"} {
+		in := &Ingest{Route: "test", Token: token}
+		if err := process(in, "a"); err != nil {
+			t.Fatal(err)
+		}
+		in.Commit()
+	}
+	if _, ok := c.tracked.Get("small"); ok || c.tracked.Len() != 2 {
+		t.Errorf("got %d tokens tracked, the least recently used one being kept %v", c.tracked.Len(), ok)
+	}
+
+	viper.Set("cardinality.mode", "unknown")
+	if _, err := newCardinalityLimiter(); err == nil {
+		t.Error("expected an invalid mode error")
+	}
+}
+
+func TestMeta(t *testing.T) {
+	var bodies []string
+	warp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v0/meta" || r.Header.Get("X-Warp10-Token") != "token" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+	}))
+	defer warp.Close()
+
+	viper.Set("warp_endpoint_meta", warp.URL)
+	defer viper.Reset()
+
+	p := &Pipeline{Route: "test"}
+	in := &Ingest{Route: "test", Token: "token"}
+	send := func(attributes ...map[string]string) {
+		in.Meta = NewMeta(in)
+		emit := p.Emitter(in, SinkFunc(func(b []byte) error { return nil }))
+		for i, attrs := range attributes {
+			gts := &GTS{Ts: int64(i), Name: "up", Labels: map[string]string{"job": "a b"}, Value: 1.0, Attributes: attrs}
+			if err := emit(gts); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := in.Meta.Send(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	help := map[string]string{"help": "Whether the target is up", "type": "gauge"}
+	send(help, help, nil)
+	send(help)
+	send(map[string]string{"type": "gauge"})
+
+	expected := []string{
+		"up{job=a%20b}{help=Whether%20the%20target%20is%20up,type=gauge}\r\n",
+		"up{job=a%20b}{type=gauge}\r\n",
+	}
+	if !reflect.DeepEqual(bodies, expected) {
+		t.Errorf("got %q", bodies)
+	}
+}
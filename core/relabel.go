@@ -0,0 +1,239 @@
+package core
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// relabelName is the label holding the class during relabeling
+const relabelName = "__name__"
+
+func init() {
+	RegisterStage("relabel", newRelabelStage)
+}
+
+// RelabelConfig is a relabeling rule using the Prometheus relabel_configs semantics
+type RelabelConfig struct {
+	SourceLabels []string
+	Separator    string
+	Regex        *regexp.Regexp
+	Modulus      uint64
+	TargetLabel  string
+	Replacement  string
+	Action       string
+}
+
+// ParseRelabelConfigs parse a list of relabeling rules
+func ParseRelabelConfigs(raw interface{}) ([]*RelabelConfig, error) {
+	configs := []*RelabelConfig{}
+	for i, r := range cast.ToSlice(raw) {
+		conf := cast.ToStringMap(r)
+
+		c := &RelabelConfig{
+			SourceLabels: cast.ToStringSlice(conf["source_labels"]),
+			Separator:    ";",
+			Modulus:      cast.ToUint64(conf["modulus"]),
+			TargetLabel:  cast.ToString(conf["target_label"]),
+			Replacement:  "$1",
+			Action:       "replace",
+		}
+
+		if v, ok := conf["separator"]; ok {
+			c.Separator = cast.ToString(v)
+		}
+		if v, ok := conf["replacement"]; ok {
+			c.Replacement = cast.ToString(v)
+		}
+		if v, ok := conf["action"]; ok {
+			c.Action = strings.ToLower(cast.ToString(v))
+		}
+
+		regex := "(.*)"
+		if v, ok := conf["regex"]; ok {
+			regex = cast.ToString(v)
+		}
+		re, err := regexp.Compile("^(?:" + regex + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("relabel config %d: %v", i, err)
+		}
+		c.Regex = re
+
+		switch c.Action {
+		case "replace", "lowercase":
+			if c.TargetLabel == "" {
+				return nil, fmt.Errorf("relabel config %d: %s requires a target_label", i, c.Action)
+			}
+		case "hashmod":
+			if c.TargetLabel == "" || c.Modulus == 0 {
+				return nil, fmt.Errorf("relabel config %d: hashmod requires a target_label and a modulus", i)
+			}
+		case "keep", "drop":
+			if len(c.SourceLabels) == 0 {
+				return nil, fmt.Errorf("relabel config %d: %s requires source_labels", i, c.Action)
+			}
+		case "labelmap", "labeldrop", "labelkeep":
+		default:
+			return nil, fmt.Errorf("relabel config %d: unknown action '%s'", i, c.Action)
+		}
+
+		configs = append(configs, c)
+	}
+
+	return configs, nil
+}
+
+// Relabel apply the rules on labels, the class being the __name__ label. It returns false when the datapoint is dropped.
+func Relabel(labels map[string]string, configs []*RelabelConfig) bool {
+	for _, c := range configs {
+		values := make([]string, len(c.SourceLabels))
+		for i, name := range c.SourceLabels {
+			values[i] = labels[name]
+		}
+		value := strings.Join(values, c.Separator)
+
+		switch c.Action {
+		case "replace":
+			indexes := c.Regex.FindStringSubmatchIndex(value)
+			if indexes == nil {
+				continue
+			}
+			target := string(c.Regex.ExpandString(nil, c.TargetLabel, value, indexes))
+			if target == "" {
+				continue
+			}
+			if v := string(c.Regex.ExpandString(nil, c.Replacement, value, indexes)); v != "" {
+				labels[target] = v
+			} else {
+				delete(labels, target)
+			}
+
+		case "lowercase":
+			labels[c.TargetLabel] = strings.ToLower(value)
+
+		case "keep":
+			if !c.Regex.MatchString(value) {
+				return false
+			}
+
+		case "drop":
+			if c.Regex.MatchString(value) {
+				return false
+			}
+
+		case "hashmod":
+			sum := md5.Sum([]byte(value))
+			labels[c.TargetLabel] = fmt.Sprint(binary.BigEndian.Uint64(sum[8:]) % c.Modulus)
+
+		case "labelmap":
+			mapped := map[string]string{}
+			for name, v := range labels {
+				if indexes := c.Regex.FindStringSubmatchIndex(name); indexes != nil {
+					mapped[string(c.Regex.ExpandString(nil, c.Replacement, name, indexes))] = v
+				}
+			}
+			for name, v := range mapped {
+				labels[name] = v
+			}
+
+		case "labeldrop":
+			for name := range labels {
+				if name != relabelName && c.Regex.MatchString(name) {
+					delete(labels, name)
+				}
+			}
+
+		case "labelkeep":
+			for name := range labels {
+				if name != relabelName && !c.Regex.MatchString(name) {
+					delete(labels, name)
+				}
+			}
+		}
+	}
+
+	return true
+}
+
+// relabelStage apply the global, route and token relabeling rules
+type relabelStage struct {
+	configs []*RelabelConfig
+	tokens  map[string][]*RelabelConfig
+}
+
+// newRelabelStage build a relabel stage from its relabel_configs
+func newRelabelStage(conf map[string]interface{}) (Stage, error) {
+	configs, err := ParseRelabelConfigs(conf["relabel_configs"])
+	if err != nil {
+		return nil, err
+	}
+	if len(configs) == 0 {
+		return nil, errors.New("relabel_configs are required")
+	}
+
+	return &relabelStage{configs: configs}, nil
+}
+
+// newRouteRelabelStage build the relabel stage of a route from the `relabel` configuration,
+// it returns nil without rules for the route
+func newRouteRelabelStage(route string) (Stage, error) {
+	global, err := ParseRelabelConfigs(viper.Get("relabel.global"))
+	if err != nil {
+		return nil, fmt.Errorf("relabel.global: %v", err)
+	}
+
+	routes, err := ParseRelabelConfigs(RouteConfig("relabel", route))
+	if err != nil {
+		return nil, fmt.Errorf("relabel.routes.%s: %v", route, err)
+	}
+
+	tokens := map[string][]*RelabelConfig{}
+	err = ParseTokens("relabel", func(token string, conf map[string]interface{}) error {
+		configs, err := ParseRelabelConfigs(conf["relabel_configs"])
+		tokens[token] = append(tokens[token], configs...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	configs := append(global, routes...)
+	if len(configs) == 0 && len(tokens) == 0 {
+		return nil, nil
+	}
+
+	return &relabelStage{configs: configs, tokens: tokens}, nil
+}
+
+// Process a datapoint
+func (r *relabelStage) Process(in *Ingest, gts *GTS, next Emit) error {
+	tokenConfigs := r.tokens[in.Token]
+	if len(r.configs) == 0 && len(tokenConfigs) == 0 {
+		return next(gts)
+	}
+
+	labels := copyLabels(gts.Labels)
+	labels[relabelName] = gts.Name
+
+	if !Relabel(labels, r.configs) || !Relabel(labels, tokenConfigs) || labels[relabelName] == "" {
+		Dropped(in, "relabel")
+		return nil
+	}
+
+	gts.Name = labels[relabelName]
+	for name := range labels {
+		// Labels starting with __ are temporary labels
+		if strings.HasPrefix(name, "__") {
+			delete(labels, name)
+		}
+	}
+	gts.Labels = labels
+
+	return next(gts)
+}
@@ -0,0 +1,117 @@
+package core
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRelabel(t *testing.T) {
+	tests := []struct {
+		name     string
+		configs  []interface{}
+		labels   map[string]string
+		expected map[string]string
+	}{
+		{
+			name: "replace",
+			configs: []interface{}{map[string]interface{}{
+				"source_labels": []interface{}{"host", "dc"},
+				"regex":         "(web)-(.*);(.*)",
+				"target_label":  "instance",
+				"replacement":   "$2.$3",
+			}},
+			labels:   map[string]string{"__name__": "cpu", "host": "web-01", "dc": "gra"},
+			expected: map[string]string{"__name__": "cpu", "host": "web-01", "dc": "gra", "instance": "01.gra"},
+		},
+		{
+			name: "rename class",
+			configs: []interface{}{map[string]interface{}{
+				"source_labels": []interface{}{"__name__"},
+				"regex":         "node_(.*)",
+				"target_label":  "__name__",
+				"replacement":   "os.$1",
+			}},
+			labels:   map[string]string{"__name__": "node_load1"},
+			expected: map[string]string{"__name__": "os.load1"},
+		},
+		{
+			name: "replace with empty value",
+			configs: []interface{}{map[string]interface{}{
+				"source_labels": []interface{}{"missing"},
+				"target_label":  "host",
+			}},
+			labels:   map[string]string{"__name__": "cpu", "host": "a"},
+			expected: map[string]string{"__name__": "cpu"},
+		},
+		{
+			name: "keep",
+			configs: []interface{}{map[string]interface{}{
+				"source_labels": []interface{}{"env"},
+				"regex":         "prod",
+				"action":        "keep",
+			}},
+			labels:   map[string]string{"__name__": "cpu", "env": "dev"},
+			expected: nil,
+		},
+		{
+			name: "drop",
+			configs: []interface{}{map[string]interface{}{
+				"source_labels": []interface{}{"__name__"},
+				"regex":         "go_.*",
+				"action":        "drop",
+			}},
+			labels:   map[string]string{"__name__": "go_gc"},
+			expected: nil,
+		},
+		{
+			name: "labelmap, labeldrop and labelkeep",
+			configs: []interface{}{
+				map[string]interface{}{"regex": "k8s_(.*)", "action": "labelmap"},
+				map[string]interface{}{"regex": "k8s_.*", "action": "labeldrop"},
+				map[string]interface{}{"regex": "pod|namespace", "action": "labelkeep"},
+			},
+			labels:   map[string]string{"__name__": "cpu", "k8s_pod": "p", "k8s_namespace": "n", "uid": "x"},
+			expected: map[string]string{"__name__": "cpu", "pod": "p", "namespace": "n"},
+		},
+		{
+			name: "hashmod and lowercase",
+			configs: []interface{}{
+				map[string]interface{}{"source_labels": []interface{}{"host"}, "modulus": 8, "target_label": "shard", "action": "hashmod"},
+				map[string]interface{}{"source_labels": []interface{}{"host"}, "target_label": "host", "action": "lowercase"},
+			},
+			labels:   map[string]string{"__name__": "cpu", "host": "WEB-01"},
+			expected: map[string]string{"__name__": "cpu", "host": "web-01", "shard": "7"},
+		},
+	}
+
+	for _, test := range tests {
+		configs, err := ParseRelabelConfigs(test.configs)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		kept := Relabel(test.labels, configs)
+		if test.expected == nil {
+			if kept {
+				t.Errorf("%s: expected the datapoint to be dropped", test.name)
+			}
+			continue
+		}
+
+		if !kept || !reflect.DeepEqual(test.labels, test.expected) {
+			t.Errorf("%s: got %v (kept %v), expected %v", test.name, test.labels, kept, test.expected)
+		}
+	}
+
+	for _, invalid := range []interface{}{
+		[]interface{}{map[string]interface{}{"action": "unknown"}},
+		[]interface{}{map[string]interface{}{"action": "replace"}},
+		[]interface{}{map[string]interface{}{"action": "hashmod", "target_label": "shard"}},
+		[]interface{}{map[string]interface{}{"regex": "(", "target_label": "x"}},
+	} {
+		if _, err := ParseRelabelConfigs(invalid); err == nil {
+			t.Errorf("%v: expected an error", invalid)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// ReservedLabelError is returned when a datapoint holds a reserved label with the reject policy
+type ReservedLabelError struct {
+	Class string
+	Label string
+}
+
+func (e ReservedLabelError) Error() string {
+	return fmt.Sprintf("Reserved label '%s' on %s", e.Label, e.Class)
+}
+
+// reservedStage reject, strip or rename the labels using a reserved prefix, such as the Warp 10 .app or .owner labels
+type reservedStage struct {
+	prefixes []string
+	policy   string
+	rename   string
+}
+
+// newReservedStage build the reserved labels stage of a route from the `reserved_labels` configuration
+func newReservedStage(route string) (Stage, error) {
+	r := &reservedStage{
+		prefixes: []string{"."},
+		policy:   viper.GetString("reserved_labels.policy"),
+		rename:   viper.GetString("reserved_labels.rename_prefix"),
+	}
+
+	if policy := viper.GetString("reserved_labels.routes." + route + ".policy"); policy != "" {
+		r.policy = policy
+	}
+
+	for _, prefix := range cast.ToStringSlice(viper.Get("reserved_labels.prefixes")) {
+		if prefix != "" && prefix != "." {
+			r.prefixes = append(r.prefixes, prefix)
+		}
+	}
+
+	switch r.policy {
+	case "reject", "strip":
+	case "rename":
+		if r.reserved(r.rename) {
+			return nil, fmt.Errorf("reserved_labels: rename_prefix '%s' is reserved", r.rename)
+		}
+	default:
+		return nil, fmt.Errorf("reserved_labels: invalid policy '%s'", r.policy)
+	}
+
+	return r, nil
+}
+
+// reserved returns whether a label name starts with a reserved prefix
+func (r *reservedStage) reserved(name string) bool {
+	for _, prefix := range r.prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Process a datapoint
+func (r *reservedStage) Process(in *Ingest, gts *GTS, next Emit) error {
+	var labels map[string]string
+	for name, value := range gts.Labels {
+		if !r.reserved(name) {
+			continue
+		}
+
+		if r.policy == "reject" {
+			return ReservedLabelError{Class: gts.Name, Label: name}
+		}
+
+		if labels == nil {
+			labels = copyLabels(gts.Labels)
+		}
+
+		delete(labels, name)
+		if r.policy == "rename" {
+			for _, prefix := range r.prefixes {
+				if strings.HasPrefix(name, prefix) {
+					labels[r.rename+strings.TrimPrefix(name, prefix)] = value
+					break
+				}
+			}
+		}
+	}
+
+	if labels != nil {
+		gts.Labels = labels
+	}
+
+	return next(gts)
+}
@@ -0,0 +1,40 @@
+package core
+
+import (
+	"fmt"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// RouteConfig returns the configuration of a route under `<key>.routes.<route>`
+func RouteConfig(key, route string) interface{} {
+	return viper.Get(key + ".routes." + route)
+}
+
+// ParseTokens calls parse with the configuration of each token under `<key>.tokens`, the errors being prefixed
+// by the position of the token. Tokens are set as values, configuration keys being case insensitive.
+func ParseTokens(key string, parse func(token string, conf map[string]interface{}) error) error {
+	for i, raw := range cast.ToSlice(viper.Get(key + ".tokens")) {
+		conf := cast.ToStringMap(raw)
+		token := cast.ToString(conf["token"])
+		if token == "" {
+			return fmt.Errorf("%s.tokens %d: missing token", key, i)
+		}
+
+		if err := parse(token, conf); err != nil {
+			return fmt.Errorf("%s.tokens %d: %v", key, i, err)
+		}
+	}
+	return nil
+}
+
+// copyLabels returns a copy of the labels of a datapoint for a stage to update them, catalysers sharing labels
+// between datapoints
+func copyLabels(labels map[string]string) map[string]string {
+	c := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		c[k] = v
+	}
+	return c
+}
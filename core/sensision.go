@@ -0,0 +1,421 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// RawValue is a value already in the Sensision format, such as a multivalue or a binary value
+type RawValue string
+
+// SensisionEncoder encode the datapoints of a payload using the Warp 10 ingestion format, labels being sorted by
+// name. The `class{labels}` prefix of the last series is kept, the following datapoints of that series being
+// written as continuation lines `=TS/LAT:LON/ELEV value`.
+type SensisionEncoder struct {
+	name   string
+	labels []string
+	prefix []byte
+	valid  bool
+}
+
+// NewSensisionEncoder returns an encoder for a new payload
+func NewSensisionEncoder() Encoder {
+	return &SensisionEncoder{}
+}
+
+// Encode append a datapoint to dst
+func (e *SensisionEncoder) Encode(dst []byte, gts *GTS) []byte {
+	if e.valid && e.sameSeries(gts) {
+		dst = append(dst, '=')
+		dst = appendTimestamp(dst, gts)
+		dst = append(dst, ' ')
+		dst = appendValue(dst, gts.Value)
+		return append(dst, '\r', '\n')
+	}
+
+	// Keep the sorted labels of the series to detect the following datapoints, the map of the datapoint
+	// may be reused by the catalyser
+	e.name = gts.Name
+	e.labels = e.labels[:0]
+	for k, v := range gts.Labels {
+		e.labels = append(e.labels, k, v)
+	}
+	sortLabelPairs(e.labels)
+	e.prefix = appendPrefix(e.prefix[:0], gts.Name, e.labels)
+	e.valid = true
+
+	dst = appendTimestamp(dst, gts)
+	dst = append(dst, ' ')
+	dst = append(dst, e.prefix...)
+	dst = append(dst, ' ')
+	dst = appendValue(dst, gts.Value)
+	return append(dst, '\r', '\n')
+}
+
+// Reset forget the last series, the next datapoint starting a new payload
+func (e *SensisionEncoder) Reset() {
+	e.valid = false
+}
+
+// sameSeries returns whether a datapoint belongs to the last encoded series
+func (e *SensisionEncoder) sameSeries(gts *GTS) bool {
+	if gts.Name != e.name || len(gts.Labels)*2 != len(e.labels) {
+		return false
+	}
+	for i := 0; i < len(e.labels); i += 2 {
+		if v, ok := gts.Labels[e.labels[i]]; !ok || v != e.labels[i+1] {
+			return false
+		}
+	}
+	return true
+}
+
+// sortLabelPairs sort name, value pairs by name using an insertion sort, series having a few labels
+func sortLabelPairs(pairs []string) {
+	for i := 2; i < len(pairs); i += 2 {
+		for j := i; j > 0 && pairs[j] < pairs[j-2]; j -= 2 {
+			pairs[j], pairs[j+1], pairs[j-2], pairs[j-1] = pairs[j-2], pairs[j-1], pairs[j], pairs[j+1]
+		}
+	}
+}
+
+// Encode a GTS to the Sensision format
+// TS/LAT:LON/ELEV NAME{LABELS} VALUE
+func (gts *GTS) Encode() []byte {
+	e := SensisionEncoder{}
+	return e.Encode(nil, gts)
+}
+
+// Size returns the length of the encoded datapoint without encoding it
+func (gts *GTS) Size() int {
+	var buf [96]byte
+	size := len(appendTimestamp(buf[:0], gts)) + len(" {} \r\n") + escapedLen(gts.Name)
+	for k, v := range gts.Labels {
+		size += escapedLen(k) + len("=") + escapedLen(v)
+	}
+	if len(gts.Labels) > 1 {
+		size += len(gts.Labels) - 1
+	}
+
+	switch v := gts.Value.(type) {
+	case string:
+		size += escapedLen(v) + len("''")
+	case RawValue:
+		size += len(v)
+	default:
+		size += len(appendValue(buf[:0], v))
+	}
+	return size
+}
+
+func appendTimestamp(dst []byte, gts *GTS) []byte {
+	if gts.Ts != NoTimestamp {
+		dst = strconv.AppendInt(dst, gts.Ts, 10)
+	}
+	return appendPosition(dst, gts)
+}
+
+// appendPosition append `/LAT:LON/ELEV`, unknown parts being left empty
+func appendPosition(dst []byte, gts *GTS) []byte {
+	dst = append(dst, '/')
+	if gts.Location != nil {
+		dst = strconv.AppendFloat(dst, gts.Location.Lat, 'f', -1, 64)
+		dst = append(dst, ':')
+		dst = strconv.AppendFloat(dst, gts.Location.Lon, 'f', -1, 64)
+	}
+	dst = append(dst, '/')
+	if gts.Elevation != nil {
+		dst = strconv.AppendInt(dst, *gts.Elevation, 10)
+	}
+	return dst
+}
+
+// appendPrefix append the escaped `class{labels}` of a series
+func appendPrefix(dst []byte, name string, labels []string) []byte {
+	dst = appendEscaped(dst, name)
+	dst = append(dst, '{')
+	for i := 0; i < len(labels); i += 2 {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		dst = appendEscaped(dst, labels[i])
+		dst = append(dst, '=')
+		dst = appendEscaped(dst, labels[i+1])
+	}
+	return append(dst, '}')
+}
+
+// appendEscaped append s URL encoded, spaces being encoded as %20 since Warp 10 2.3.0 does not convert "+" anymore
+func appendEscaped(dst []byte, s string) []byte {
+	const hex = "0123456789ABCDEF"
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			dst = append(dst, c)
+			continue
+		}
+		dst = append(dst, '%', hex[c>>4], hex[c&15])
+	}
+	return dst
+}
+
+// escapedLen returns the length of s once escaped, see appendEscaped
+func escapedLen(s string) int {
+	n := len(s)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~') {
+			n += 2
+		}
+	}
+	return n
+}
+
+// appendFloat append the shortest representation of f read back as the same double, holding a decimal point
+// or an exponent so that Warp 10 does not read it as a long
+func appendFloat(dst []byte, f float64, bitSize int) []byte {
+	switch {
+	case math.IsNaN(f):
+		return append(dst, "NaN"...)
+	case math.IsInf(f, 1):
+		return append(dst, "Infinity"...)
+	case math.IsInf(f, -1):
+		return append(dst, "-Infinity"...)
+	}
+
+	start := len(dst)
+	dst = strconv.AppendFloat(dst, f, 'g', -1, bitSize)
+	for _, c := range dst[start:] {
+		if c == '.' || c == 'e' {
+			return dst
+		}
+	}
+	return append(dst, '.', '0')
+}
+
+// EncodeValue encode a value to the Sensision format
+func EncodeValue(v interface{}) string {
+	return string(appendValue(nil, v))
+}
+
+func appendValue(dst []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case bool:
+		if v {
+			return append(dst, 'T')
+		}
+		return append(dst, 'F')
+
+	case float64:
+		return appendFloat(dst, v, 64)
+
+	case int64:
+		return strconv.AppendInt(dst, v, 10)
+
+	case float32:
+		return appendFloat(dst, float64(v), 32)
+
+	case int:
+		return strconv.AppendInt(dst, int64(v), 10)
+
+	case uint64:
+		// Warp 10 longs are signed, larger values are stored as doubles
+		if v > math.MaxInt64 {
+			return appendFloat(dst, float64(v), 64)
+		}
+		return strconv.AppendUint(dst, v, 10)
+
+	case string:
+		return append(appendEscaped(append(dst, '\''), v), '\'')
+
+	case RawValue:
+		return append(dst, v...)
+
+	default:
+		// Other types: just output their default format
+		return append(dst, url.QueryEscape(fmt.Sprintf("%v", v))...)
+	}
+}
+
+// ParseSensision parse a datapoint using the Warp 10 ingestion format, `TS/LAT:LON/ELEV class{labels}{attributes}
+// value`, attributes being optional. Continuation lines `=TS/LAT:LON/ELEV value` reuse the class and labels of the
+// previous datapoint.
+func ParseSensision(line string, previous *GTS) (*GTS, error) {
+	sp := strings.IndexByte(line, ' ')
+	if sp < 0 {
+		return nil, errors.New("missing value")
+	}
+	prefix, rest := line[:sp], strings.TrimLeft(line[sp+1:], " ")
+
+	gts := &GTS{
+		Ts: NoTimestamp,
+	}
+
+	if strings.HasPrefix(prefix, "=") {
+		if previous == nil {
+			return nil, errors.New("continuation line without a previous datapoint")
+		}
+		prefix = prefix[1:]
+		gts.Name = previous.Name
+		gts.Labels = make(map[string]string, len(previous.Labels))
+		for k, v := range previous.Labels {
+			gts.Labels[k] = v
+		}
+	} else {
+		open := strings.IndexByte(rest, '{')
+		end := strings.IndexByte(rest, '}')
+		if open <= 0 || end < open {
+			return nil, errors.New("invalid class")
+		}
+
+		name, err := url.PathUnescape(rest[:open])
+		if err != nil {
+			return nil, errors.New("invalid class")
+		}
+		gts.Name = name
+
+		if gts.Labels, err = parseSensisionLabels(rest[open+1 : end]); err != nil {
+			return nil, err
+		}
+
+		// Attributes of the series follow its labels
+		rest = strings.TrimLeft(rest[end+1:], " ")
+		if strings.HasPrefix(rest, "{") {
+			end = strings.IndexByte(rest, '}')
+			if end < 0 {
+				return nil, errors.New("invalid attributes")
+			}
+			if gts.Attributes, err = parseSensisionLabels(rest[1:end]); err != nil {
+				return nil, err
+			}
+			rest = rest[end+1:]
+		}
+	}
+
+	parts := strings.SplitN(prefix, "/", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("invalid timestamp")
+	}
+
+	if parts[0] != "" {
+		ts, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			return nil, errors.New("invalid timestamp")
+		}
+		gts.Ts = ts
+	}
+
+	if err := parsePosition(gts, parts[1]); err != nil {
+		return nil, err
+	}
+
+	rest = strings.TrimSpace(rest)
+	if rest == "" {
+		return nil, errors.New("missing value")
+	}
+	gts.Value = parseSensisionValue(rest)
+
+	return gts, nil
+}
+
+// parseSensisionLabels parse the comma separated `name=value` pairs of labels or attributes
+func parseSensisionLabels(s string) (map[string]string, error) {
+	labels := map[string]string{}
+	if s == "" {
+		return labels, nil
+	}
+
+	for _, label := range strings.Split(s, ",") {
+		kv := strings.SplitN(label, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("invalid label: " + label)
+		}
+
+		k, err := url.PathUnescape(kv[0])
+		if err != nil {
+			return nil, errors.New("invalid label: " + label)
+		}
+		v, err := url.PathUnescape(kv[1])
+		if err != nil {
+			return nil, errors.New("invalid label: " + label)
+		}
+		labels[k] = v
+	}
+	return labels, nil
+}
+
+// parsePosition parse the `LAT:LON/ELEV` of a datapoint, both parts being optional
+func parsePosition(gts *GTS, position string) error {
+	slash := strings.IndexByte(position, '/')
+	if slash < 0 {
+		return errors.New("invalid position")
+	}
+	location, elevation := position[:slash], position[slash+1:]
+
+	if location != "" {
+		colon := strings.IndexByte(location, ':')
+		if colon < 0 {
+			return errors.New("invalid location")
+		}
+		lat, err := strconv.ParseFloat(location[:colon], 64)
+		if err != nil {
+			return errors.New("invalid latitude")
+		}
+		lon, err := strconv.ParseFloat(location[colon+1:], 64)
+		if err != nil {
+			return errors.New("invalid longitude")
+		}
+
+		gts.Location = &Location{Lat: lat, Lon: lon}
+		if !gts.Location.Valid() {
+			return errors.New("location out of range")
+		}
+	}
+
+	if elevation != "" {
+		elev, err := strconv.ParseInt(elevation, 10, 64)
+		if err != nil {
+			return errors.New("invalid elevation")
+		}
+		gts.Elevation = &elev
+	}
+
+	return nil
+}
+
+// parseSensisionValue returns the value as a bool, an int64, a string or a NaN or infinite float64 when lossless,
+// as a RawValue otherwise
+func parseSensisionValue(s string) interface{} {
+	switch s {
+	case "T", "true":
+		return true
+	case "F", "false":
+		return false
+	}
+
+	if len(s) >= 2 && (s[0] == '\'' || s[0] == '"') && s[len(s)-1] == s[0] {
+		if v, err := url.PathUnescape(s[1 : len(s)-1]); err == nil {
+			return v
+		}
+	}
+
+	if v, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return v
+	}
+
+	// Special values are read so that the pipeline handles them, they are written back as is
+	switch s {
+	case "NaN":
+		return math.NaN()
+	case "Infinity":
+		return math.Inf(1)
+	case "-Infinity":
+		return math.Inf(-1)
+	}
+
+	return RawValue(s)
+}
@@ -0,0 +1,239 @@
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// roundTrip encode a value then parse it back from the Sensision line
+func roundTrip(t *testing.T, v interface{}) interface{} {
+	line := strings.TrimSuffix(string((&GTS{Ts: 1, Name: "c", Labels: map[string]string{}, Value: v}).Encode()), "\r\n")
+
+	gts, err := ParseSensision(line, nil)
+	if err != nil {
+		t.Fatalf("%v: %v", v, err)
+	}
+	return gts.Value
+}
+
+func TestEncodeFloatRoundTrip(t *testing.T) {
+	f, err := os.Open("testdata/floats.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	corpus := []float64{math.MaxFloat64, math.SmallestNonzeroFloat64, math.Nextafter(1, 2)}
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		if line := scan.Text(); line != "" && !strings.HasPrefix(line, "#") {
+			v, err := strconv.ParseFloat(line, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			corpus = append(corpus, v)
+		}
+	}
+
+	r := rand.New(rand.NewSource(42))
+	for len(corpus) < 10000 {
+		if v := math.Float64frombits(r.Uint64()); !math.IsNaN(v) && !math.IsInf(v, 0) {
+			corpus = append(corpus, v)
+		}
+	}
+
+	for _, v := range corpus {
+		// Doubles are kept raw by the parser, they must not be read as longs by Warp 10
+		raw, ok := roundTrip(t, v).(RawValue)
+		if !ok || !strings.ContainsAny(string(raw), ".e") {
+			t.Errorf("%v: not encoded as a double: %v", v, raw)
+			continue
+		}
+
+		got, err := strconv.ParseFloat(string(raw), 64)
+		if err != nil || math.Float64bits(got) != math.Float64bits(v) {
+			t.Errorf("%v: got %s", v, raw)
+		}
+	}
+
+	for _, v := range []float32{0.1, 1e-9, 3.4028235e38, 16777217} {
+		raw, _ := roundTrip(t, v).(RawValue)
+		if got, err := strconv.ParseFloat(string(raw), 32); err != nil || float32(got) != v {
+			t.Errorf("%v: got %s", v, raw)
+		}
+	}
+}
+
+func TestEncodeIntegerRoundTrip(t *testing.T) {
+	for v, expected := range map[interface{}]int64{
+		int64(0):              0,
+		int64(-1):             -1,
+		int64(math.MaxInt64):  math.MaxInt64,
+		int64(math.MinInt64):  math.MinInt64,
+		42:                    42,
+		uint64(math.MaxInt64): math.MaxInt64,
+	} {
+		if got := roundTrip(t, v); got != expected {
+			t.Errorf("%v: got %v", v, got)
+		}
+	}
+
+	// Warp 10 longs are signed, larger unsigned values are stored as doubles
+	raw, _ := roundTrip(t, uint64(math.MaxUint64)).(RawValue)
+	if got, err := strconv.ParseFloat(string(raw), 64); err != nil || got != float64(uint64(math.MaxUint64)) {
+		t.Errorf("%d: got %s", uint64(math.MaxUint64), raw)
+	}
+}
+
+func TestSensisionEncoder(t *testing.T) {
+	labels := map[string]string{"host": "web 01", "dc": "gra", "a": "x,y"}
+	e := NewSensisionEncoder()
+
+	var payload []byte
+	for i, gts := range []*GTS{
+		{Ts: 1, Name: "cpu{user}", Labels: labels, Value: 1.5},
+		{Ts: 2, Name: "cpu{user}", Labels: map[string]string{"a": "x,y", "dc": "gra", "host": "web 01"}, Value: int64(2)},
+		{Ts: 3, Location: &Location{Lat: 48.8, Lon: 2.3}, Name: "cpu{user}", Labels: labels, Value: "ok"},
+		{Ts: 4, Name: "cpu{user}", Labels: map[string]string{"dc": "gra"}, Value: true},
+	} {
+		payload = e.Encode(payload, gts)
+
+		// A reused map must not be taken as the previous series once changed
+		if i == 2 {
+			labels["dc"] = "rbx"
+		}
+	}
+	payload = e.Encode(payload, &GTS{Ts: 5, Name: "cpu{user}", Labels: labels, Value: int64(5)})
+
+	expected := "1// cpu%7Buser%7D{a=x%2Cy,dc=gra,host=web%2001} 1.5\r\n" +
+		"=2// 2\r\n" +
+		"=3/48.8:2.3/ 'ok'\r\n" +
+		"4// cpu%7Buser%7D{dc=gra} T\r\n" +
+		"5// cpu%7Buser%7D{a=x%2Cy,dc=rbx,host=web%2001} 5\r\n"
+	if string(payload) != expected {
+		t.Errorf("got %q, expected %q", payload, expected)
+	}
+
+	// Parsing the payload back gives the datapoints
+	var previous *GTS
+	for _, line := range strings.Split(strings.TrimSuffix(string(payload), "\r\n"), "\r\n") {
+		gts, err := ParseSensision(line, previous)
+		if err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+		if gts.Name != "cpu{user}" {
+			t.Errorf("%s: got class %s", line, gts.Name)
+		}
+		previous = gts
+	}
+
+	// A reset encoder starts a new payload
+	e.Reset()
+	if line := string(e.Encode(nil, &GTS{Ts: 6, Name: "cpu{user}", Labels: labels, Value: int64(6)})); strings.HasPrefix(line, "=") {
+		t.Errorf("got %q after a reset", line)
+	}
+}
+
+// legacyEncode is the encoder replaced by SensisionEncoder, kept to benchmark against
+func legacyEncode(gts *GTS) []byte {
+	sensision := ""
+	if gts.Ts != NoTimestamp {
+		sensision += fmt.Sprintf("%d", gts.Ts)
+	}
+	sensision += "//"
+	sensision += fmt.Sprintf(" %s{", strings.ReplaceAll(url.QueryEscape(gts.Name), "+", "%20"))
+	sep := ""
+	for k, v := range gts.Labels {
+		sensision += sep + strings.ReplaceAll(url.QueryEscape(k)+"="+url.QueryEscape(v), "+", "%20")
+		sep = ","
+	}
+	sensision += "} "
+	switch v := gts.Value.(type) {
+	case float64:
+		sensision += fmt.Sprintf("%f", v)
+	case int64:
+		sensision += fmt.Sprintf("%d", v)
+	}
+	sensision += "\r\n"
+	return []byte(sensision)
+}
+
+// benchmarkSeries returns the datapoints of a remote write series, sharing its labels
+func benchmarkSeries(samples int) []*GTS {
+	labels := map[string]string{
+		"instance": "web-01.gra.example.com:9100",
+		"job":      "node",
+		"cpu":      "3",
+		"mode":     "user",
+		"dc":       "gra",
+		"env":      "production",
+	}
+
+	series := make([]*GTS, samples)
+	for i := range series {
+		series[i] = &GTS{Ts: int64(1546420308000000 + i*15000000), Name: "node_cpu_seconds_total", Labels: labels, Value: float64(i) * 1.25}
+	}
+	return series
+}
+
+func BenchmarkLegacyEncode(b *testing.B) {
+	series := benchmarkSeries(100)
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		for _, gts := range series {
+			_ = legacyEncode(gts)
+		}
+	}
+}
+
+func BenchmarkSensisionEncoder(b *testing.B) {
+	series := benchmarkSeries(100)
+	e := NewSensisionEncoder()
+	var buf []byte
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		e.Reset()
+		for _, gts := range series {
+			buf = e.Encode(buf[:0], gts)
+		}
+	}
+}
+
+func BenchmarkSensisionEncoderDistinctSeries(b *testing.B) {
+	series := benchmarkSeries(100)
+	for i, gts := range series {
+		gts.Labels = copyLabels(gts.Labels)
+		gts.Labels["cpu"] = strconv.Itoa(i)
+	}
+	e := NewSensisionEncoder()
+	var buf []byte
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		for _, gts := range series {
+			buf = e.Encode(buf[:0], gts)
+		}
+	}
+}
+
+func TestGTSSize(t *testing.T) {
+	elevation := int64(-12)
+	for _, gts := range []*GTS{
+		{Ts: NoTimestamp, Name: "c", Value: int64(1)},
+		{Ts: 1, Name: "cpu{user}", Labels: map[string]string{"host": "web 01", "dc": "gra", "a": "x,y"}, Value: 1.5},
+		{Ts: 2, Location: &Location{Lat: 48.8, Lon: 2.3}, Elevation: &elevation, Name: "c", Labels: map[string]string{"a": "b"}, Value: "d'é"},
+		{Ts: 3, Name: "c", Labels: map[string]string{}, Value: RawValue("[ 1 2 ]")},
+		{Ts: 4, Name: "c", Value: math.NaN()},
+		{Ts: 5, Name: "c", Value: []int{1}},
+	} {
+		if size, encoded := gts.Size(), gts.Encode(); size != len(encoded) {
+			t.Errorf("%q: got size %d", encoded, size)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package core
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/pkg/value"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+var specialValuesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "catalyst",
+	Subsystem: "pipeline",
+	Name:      "special_values",
+	Help:      "Number of NaN, infinite and staleness marker values.",
+}, []string{"route", "kind", "policy"})
+
+func init() {
+	prometheus.MustRegister(specialValuesCounter)
+}
+
+// specialValuesStage handle the NaN, ±Inf and Prometheus staleness marker values
+type specialValuesStage struct {
+	policy   string
+	sentinel float64
+	suffix   string
+}
+
+// newSpecialValuesStage build the special values stage of a route from the `special_values` configuration, the
+// values being kept by default
+func newSpecialValuesStage(route string) (Stage, error) {
+	s := &specialValuesStage{
+		policy: cast.ToString(cast.ToStringMap(RouteConfig("special_values", route))["policy"]),
+		suffix: viper.GetString("special_values.staleness_suffix"),
+	}
+
+	if s.policy == "" {
+		s.policy = viper.GetString("special_values.policy")
+	}
+	if s.policy == "" {
+		s.policy = "keep"
+	}
+
+	sentinel, err := cast.ToFloat64E(viper.Get("special_values.sentinel"))
+	if err != nil {
+		return nil, fmt.Errorf("special_values: invalid sentinel '%v'", viper.Get("special_values.sentinel"))
+	}
+	s.sentinel = sentinel
+
+	switch s.policy {
+	case "drop", "keep", "sentinel":
+	case "staleness":
+		if s.suffix == "" {
+			return nil, fmt.Errorf("special_values: staleness_suffix is required with the staleness policy")
+		}
+	default:
+		return nil, fmt.Errorf("special_values: invalid policy '%s'", s.policy)
+	}
+
+	return s, nil
+}
+
+// specialKind returns whether a value is a staleness marker, NaN or infinite, an empty kind for other values
+func specialKind(v interface{}) string {
+	var f float64
+	switch v := v.(type) {
+	case float64:
+		f = v
+	case float32:
+		f = float64(v)
+	default:
+		return ""
+	}
+
+	switch {
+	case value.IsStaleNaN(f):
+		return "stale"
+	case math.IsNaN(f):
+		return "nan"
+	case math.IsInf(f, 0):
+		return "inf"
+	}
+	return ""
+}
+
+// Process a datapoint
+func (s *specialValuesStage) Process(in *Ingest, gts *GTS, next Emit) error {
+	kind := specialKind(gts.Value)
+	if kind == "" {
+		return next(gts)
+	}
+
+	specialValuesCounter.With(prometheus.Labels{"route": in.Route, "kind": kind, "policy": s.policy}).Inc()
+	switch s.policy {
+	case "drop":
+		Dropped(in, "special_values")
+		return nil
+
+	case "sentinel":
+		gts.Value = s.sentinel
+
+	case "staleness":
+		// NaN and infinite values are kept, staleness markers being stored in the event series of the series
+		if kind == "stale" {
+			return next(&GTS{
+				Ts:        gts.Ts,
+				Location:  gts.Location,
+				Elevation: gts.Elevation,
+				Name:      gts.Name + s.suffix,
+				Labels:    gts.Labels,
+				Value:     true,
+			})
+		}
+	}
+
+	return next(gts)
+}
@@ -0,0 +1,114 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/spf13/cast"
+)
+
+func init() {
+	RegisterStage("filter", newFilterStage)
+	RegisterStage("validate", newValidateStage)
+}
+
+// filterStage keep or drop the datapoints whose class and labels match
+type filterStage struct {
+	class  *regexp.Regexp
+	labels map[string]*regexp.Regexp
+	drop   bool
+}
+
+// newFilterStage build a filter stage from its action (keep or drop), class and labels anchored regexps,
+// a missing label matching as an empty value
+func newFilterStage(conf map[string]interface{}) (Stage, error) {
+	f := &filterStage{
+		labels: map[string]*regexp.Regexp{},
+	}
+
+	switch action := cast.ToString(conf["action"]); action {
+	case "", "keep":
+	case "drop":
+		f.drop = true
+	default:
+		return nil, fmt.Errorf("invalid action '%s'", action)
+	}
+
+	if class := cast.ToString(conf["class"]); class != "" {
+		re, err := regexp.Compile("^(?:" + class + ")$")
+		if err != nil {
+			return nil, err
+		}
+		f.class = re
+	}
+
+	for name, expr := range cast.ToStringMapString(conf["labels"]) {
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, err
+		}
+		f.labels[name] = re
+	}
+
+	if f.class == nil && len(f.labels) == 0 {
+		return nil, errors.New("a class or labels matcher is required")
+	}
+
+	return f, nil
+}
+
+// Process a datapoint
+func (f *filterStage) Process(in *Ingest, gts *GTS, next Emit) error {
+	if f.match(gts) == f.drop {
+		Dropped(in, "filter")
+		return nil
+	}
+	return next(gts)
+}
+
+func (f *filterStage) match(gts *GTS) bool {
+	if f.class != nil && !f.class.MatchString(gts.Name) {
+		return false
+	}
+
+	for name, re := range f.labels {
+		if !re.MatchString(gts.Labels[name]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// validateStage reject the requests holding a datapoint Warp 10 would refuse
+type validateStage struct{}
+
+func newValidateStage(conf map[string]interface{}) (Stage, error) {
+	return validateStage{}, nil
+}
+
+// Process a datapoint
+func (validateStage) Process(in *Ingest, gts *GTS, next Emit) error {
+	if gts.Name == "" {
+		return NewParsingError("Invalid datapoint", "missing class")
+	}
+
+	for name := range gts.Labels {
+		if name == "" {
+			return NewParsingError("Invalid datapoint", fmt.Sprintf("empty label name on %s", gts.Name))
+		}
+	}
+
+	if gts.Location != nil && !gts.Location.Valid() {
+		return NewParsingError("Invalid datapoint", fmt.Sprintf("location out of range on %s", gts.Name))
+	}
+
+	switch gts.Value.(type) {
+	case bool, float64, float32, int64, int, uint64, string, RawValue:
+	default:
+		return NewParsingError("Invalid datapoint", fmt.Sprintf("unsupported value %v on %s", gts.Value, gts.Name))
+	}
+
+	return next(gts)
+}
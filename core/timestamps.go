@@ -0,0 +1,156 @@
+package core
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+var outOfWindowCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "catalyst",
+	Subsystem: "timestamps",
+	Name:      "out_of_window",
+	Help:      "Number of datapoints whose timestamp is out of the acceptance window.",
+}, []string{"route", "token_hash", "window", "action"})
+
+func init() {
+	prometheus.MustRegister(outOfWindowCounter)
+}
+
+// TimestampError is returned when a datapoint is out of the timestamp window with the reject action
+type TimestampError struct {
+	Class  string
+	Ts     int64
+	Window string
+}
+
+func (e TimestampError) Error() string {
+	return fmt.Sprintf("Timestamp %d of %s is too far in the %s", e.Ts, e.Class, e.Window)
+}
+
+// timestampWindow is the accepted range of timestamps around the reference time, 0 being unlimited
+type timestampWindow struct {
+	past   time.Duration
+	future time.Duration
+	action string
+}
+
+// parseTimestampWindow read the window of conf, unset settings defaulting to def
+func parseTimestampWindow(conf map[string]interface{}, def timestampWindow) (timestampWindow, error) {
+	w := def
+	for key, setting := range map[string]*time.Duration{
+		"past":   &w.past,
+		"future": &w.future,
+	} {
+		if v, ok := conf[key]; ok {
+			d, err := cast.ToDurationE(v)
+			if err != nil || d < 0 {
+				return w, fmt.Errorf("invalid %s '%v'", key, v)
+			}
+			*setting = d
+		}
+	}
+	if v, ok := conf["action"]; ok {
+		w.action = cast.ToString(v)
+	}
+
+	switch w.action {
+	case "accept", "clamp", "drop", "reject":
+	default:
+		return w, fmt.Errorf("invalid action '%s'", w.action)
+	}
+
+	return w, nil
+}
+
+// enabled returns whether a bound is set
+func (w *timestampWindow) enabled() bool {
+	return w.past > 0 || w.future > 0
+}
+
+// timestampsStage classify the timestamps against the reference time of the ingestion
+type timestampsStage struct {
+	global timestampWindow
+	tokens map[string]timestampWindow
+}
+
+// newTimestampsStage build the timestamp window stage of a route from the `timestamps` configuration, it returns
+// nil without window. Imports backfilling history, the import route is only checked with its own settings.
+func newTimestampsStage(route string) (Stage, error) {
+	routeConf := cast.ToStringMap(RouteConfig("timestamps", route))
+	if route == "import" && len(routeConf) == 0 {
+		return nil, nil
+	}
+
+	global, err := parseTimestampWindow(cast.ToStringMap(viper.Get("timestamps")), timestampWindow{action: "reject"})
+	if err != nil {
+		return nil, fmt.Errorf("timestamps: %v", err)
+	}
+
+	if global, err = parseTimestampWindow(routeConf, global); err != nil {
+		return nil, fmt.Errorf("timestamps.routes.%s: %v", route, err)
+	}
+
+	tokens := map[string]timestampWindow{}
+	err = ParseTokens("timestamps", func(token string, conf map[string]interface{}) (err error) {
+		tokens[token], err = parseTimestampWindow(conf, global)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	enabled := global.enabled()
+	for _, w := range tokens {
+		enabled = enabled || w.enabled()
+	}
+	if !enabled {
+		return nil, nil
+	}
+
+	return &timestampsStage{global: global, tokens: tokens}, nil
+}
+
+// Process a datapoint
+func (s *timestampsStage) Process(in *Ingest, gts *GTS, next Emit) error {
+	// Datapoints without timestamp are stored at the ingestion time
+	if gts.Ts == NoTimestamp {
+		return next(gts)
+	}
+
+	w, ok := s.tokens[in.Token]
+	if !ok {
+		w = s.global
+	}
+
+	now := in.Now
+	if now == 0 {
+		now = Timestamp(time.Now())
+	}
+
+	window := ""
+	switch {
+	case w.past > 0 && gts.Ts < now-Units(w.past):
+		window = "past"
+	case w.future > 0 && gts.Ts > now+Units(w.future):
+		window = "future"
+	default:
+		return next(gts)
+	}
+
+	outOfWindowCounter.With(prometheus.Labels{"route": in.Route, "token_hash": tokenHash(in.Token), "window": window, "action": w.action}).Inc()
+	switch w.action {
+	case "clamp":
+		gts.Ts = now
+	case "drop":
+		Dropped(in, "timestamps")
+		return nil
+	case "reject":
+		return TimestampError{Class: gts.Name, Ts: gts.Ts, Window: window}
+	}
+
+	return next(gts)
+}
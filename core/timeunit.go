@@ -0,0 +1,71 @@
+package core
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// TimeUnit is the time unit of the Warp 10 platform, as a number of nanoseconds
+type TimeUnit int64
+
+// Warp 10 time units
+const (
+	Nanoseconds  TimeUnit = 1
+	Microseconds TimeUnit = 1000
+	Milliseconds TimeUnit = 1000000
+)
+
+// NoTimestamp is the timestamp of a datapoint stored at its ingestion time by Warp 10
+const NoTimestamp int64 = math.MinInt64
+
+var timeUnit = Microseconds
+
+// ParseTimeUnit parse a `warp.time_unit` setting: ns, us or ms
+func ParseTimeUnit(s string) (TimeUnit, error) {
+	switch s {
+	case "ns":
+		return Nanoseconds, nil
+	case "us", "µs":
+		return Microseconds, nil
+	case "ms":
+		return Milliseconds, nil
+	}
+	return 0, fmt.Errorf("invalid time unit '%s', expected ns, us or ms", s)
+}
+
+// SetTimeUnit set the time unit of the timestamps sent to and read from Warp 10
+func SetTimeUnit(unit TimeUnit) {
+	timeUnit = unit
+}
+
+// UnitsPerSecond returns the number of platform time units in a second
+func UnitsPerSecond() int64 {
+	return int64(time.Second) / int64(timeUnit)
+}
+
+// Units returns a duration in platform time units
+func Units(d time.Duration) int64 {
+	return int64(d) / int64(timeUnit)
+}
+
+// Timestamp returns a time in platform time units
+func Timestamp(t time.Time) int64 {
+	return t.Unix()*UnitsPerSecond() + int64(t.Nanosecond())/int64(timeUnit)
+}
+
+// Time returns the time of a timestamp in platform time units
+func Time(ts int64) time.Time {
+	ups := UnitsPerSecond()
+	sec, frac := ts/ups, ts%ups
+	if frac < 0 {
+		sec, frac = sec-1, frac+ups
+	}
+	return time.Unix(sec, frac*int64(timeUnit))
+}
+
+// SecondsTimestamp returns a timestamp in seconds, such as 1546420308.5, in platform time units
+func SecondsTimestamp(s float64) int64 {
+	sec, frac := math.Modf(s)
+	return int64(sec)*UnitsPerSecond() + int64(math.Round(frac*float64(UnitsPerSecond())))
+}
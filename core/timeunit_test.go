@@ -0,0 +1,44 @@
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeUnit(t *testing.T) {
+	defer SetTimeUnit(Microseconds)
+
+	at := time.Unix(1546420308, 123456789)
+	for _, test := range []struct {
+		unit      string
+		timestamp int64
+		seconds   int64
+	}{
+		{"ns", 1546420308123456789, 1546420308500000000},
+		{"us", 1546420308123456, 1546420308500000},
+		{"ms", 1546420308123, 1546420308500},
+	} {
+		unit, err := ParseTimeUnit(test.unit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		SetTimeUnit(unit)
+
+		if ts := Timestamp(at); ts != test.timestamp {
+			t.Errorf("%s: got timestamp %d, expected %d", test.unit, ts, test.timestamp)
+		}
+		if ts := SecondsTimestamp(1546420308.5); ts != test.seconds {
+			t.Errorf("%s: got %d from seconds, expected %d", test.unit, ts, test.seconds)
+		}
+		if back := Time(test.timestamp); !back.Equal(at.Truncate(time.Duration(unit))) {
+			t.Errorf("%s: got time %v", test.unit, back)
+		}
+		if ts := Timestamp(time.Unix(-1, 0)); Time(ts).Unix() != -1 {
+			t.Errorf("%s: got %d before the epoch", test.unit, ts)
+		}
+	}
+
+	if _, err := ParseTimeUnit("s"); err == nil {
+		t.Error("s: expected an error")
+	}
+}
@@ -5,13 +5,12 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"math"
 	"net"
 	"net/http"
-	"net/url"
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
@@ -38,10 +37,27 @@ type Warp struct {
 
 // GTS struct
 type GTS struct {
-	Ts     float64
-	Name   string
-	Labels map[string]string
-	Value  interface{}
+	// Ts is in platform time units, see SetTimeUnit
+	Ts int64
+	// Location and Elevation, in millimeters, are optional
+	Location  *Location
+	Elevation *int64
+	Name      string
+	Labels    map[string]string
+	Value     interface{}
+	// Attributes are the Warp 10 attributes of the series, such as its description, sent when they change
+	Attributes map[string]string
+}
+
+// Location of a datapoint, in degrees
+type Location struct {
+	Lat float64
+	Lon float64
+}
+
+// Valid returns whether the latitude and the longitude are in range
+func (l *Location) Valid() bool {
+	return l.Lat >= -90 && l.Lat <= 90 && l.Lon >= -180 && l.Lon <= 180
 }
 
 // WarpInvalidToken invalid warp token error
@@ -105,6 +121,15 @@ type WarpGoneError struct {
 	Body string
 }
 
+// WarpTimeout timeout waiting for Warp 10 to store the datapoints
+type WarpTimeout struct {
+	Timeout time.Duration
+}
+
+func (e WarpTimeout) Error() string {
+	return fmt.Sprintf("Timeout waiting for the datapoints to be stored: %v", e.Timeout)
+}
+
 func (e WarpInputError) Error() string {
 	return fmt.Sprintf("Invalid input: %v", e.Str)
 }
@@ -127,50 +152,53 @@ func preparePostRequest(warpEndpoint, token, txn, now string, body io.Reader) (*
 	return req, err
 }
 
-// NewWarp returns a Warp connection.
-func NewWarp(token, txn, now string) (*Warp, error) {
-	httpClientSingleton.Do(func() {
-		httpClient = &http.Client{
-			Timeout: viper.GetDuration("warp.connection.timeout"),
-			Transport: &http.Transport{
-				DisableKeepAlives: false,
-				Dial: (&net.Dialer{
-					Timeout:   viper.GetDuration("warp.connection.dial.timeout"),
-					KeepAlive: viper.GetDuration("warp.connection.keep-alive.timeout"),
-				}).Dial,
-				TLSHandshakeTimeout: viper.GetDuration("warp.connection.tls.timeout"),
-				MaxIdleConnsPerHost: viper.GetInt("warp.connection.idle.max"),
-				IdleConnTimeout:     viper.GetDuration("warp.connection.keep-alive.timeout"),
-			},
-		}
+// initWarp initialise the shared Warp 10 http client and metrics
+func initWarp() {
+	httpClient = &http.Client{
+		Timeout: viper.GetDuration("warp.connection.timeout"),
+		Transport: &http.Transport{
+			DisableKeepAlives: false,
+			Dial: (&net.Dialer{
+				Timeout:   viper.GetDuration("warp.connection.dial.timeout"),
+				KeepAlive: viper.GetDuration("warp.connection.keep-alive.timeout"),
+			}).Dial,
+			TLSHandshakeTimeout: viper.GetDuration("warp.connection.tls.timeout"),
+			MaxIdleConnsPerHost: viper.GetInt("warp.connection.idle.max"),
+			IdleConnTimeout:     viper.GetDuration("warp.connection.keep-alive.timeout"),
+		},
+	}
 
-		warpEndpoint = viper.GetString("warp_endpoint")
-
-		// Declare Prom metrics
-		mads = prometheus.NewCounterVec(prometheus.CounterOpts{
-			Namespace: "catalyst",
-			Subsystem: "error",
-			Name:      "mads",
-			Help:      "Mads errors.",
-		}, []string{"app"})
-		prometheus.MustRegister(mads)
-
-		ddp = prometheus.NewCounterVec(prometheus.CounterOpts{
-			Namespace: "catalyst",
-			Subsystem: "error",
-			Name:      "ddp",
-			Help:      "DDP errors.",
-		}, []string{"app"})
-		prometheus.MustRegister(ddp)
-
-		brokenPipe = prometheus.NewCounter(prometheus.CounterOpts{
-			Namespace: "catalyst",
-			Subsystem: "error",
-			Name:      "broken_pipe",
-			Help:      "Warp broken pipes errors",
-		})
-		prometheus.MustRegister(brokenPipe)
+	warpEndpoint = viper.GetString("warp_endpoint")
+
+	// Declare Prom metrics
+	mads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "catalyst",
+		Subsystem: "error",
+		Name:      "mads",
+		Help:      "Mads errors.",
+	}, []string{"app"})
+	prometheus.MustRegister(mads)
+
+	ddp = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "catalyst",
+		Subsystem: "error",
+		Name:      "ddp",
+		Help:      "DDP errors.",
+	}, []string{"app"})
+	prometheus.MustRegister(ddp)
+
+	brokenPipe = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "catalyst",
+		Subsystem: "error",
+		Name:      "broken_pipe",
+		Help:      "Warp broken pipes errors",
 	})
+	prometheus.MustRegister(brokenPipe)
+}
+
+// NewWarp returns a Warp connection.
+func NewWarp(token, txn, now string) (*Warp, error) {
+	httpClientSingleton.Do(initWarp)
 	pr, pw := io.Pipe()
 
 	w := &Warp{
@@ -276,6 +304,26 @@ func (w *Warp) Close() error {
 	return w.HandleError(w.err)
 }
 
+// CloseTimeout close the connection, waiting at most timeout for Warp 10 to store the datapoints.
+// A zero timeout waits for the connection timeout.
+func (w *Warp) CloseTimeout(timeout time.Duration) error {
+	if timeout <= 0 {
+		return w.Close()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- w.Close()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return WarpTimeout{Timeout: timeout}
+	}
+}
+
 // HandleError read http error body and return a corresponding error
 func (w *Warp) HandleError(e error) error {
 	if e == nil {
@@ -419,60 +467,3 @@ func (w *Warp) HandleError(e error) error {
 
 	return e
 }
-
-// Encode a GTS to the Sensision format
-// TS/LAT:LON/ELEV NAME{LABELS} VALUE
-func (gts *GTS) Encode() []byte {
-	sensision := ""
-
-	// Timestamp
-	if !math.IsNaN(gts.Ts) {
-		sensision += fmt.Sprintf("%d", int(gts.Ts))
-	}
-
-	// Class
-	// In case of an URLENCODED string, "+" are not converted anymore to spaces since Warp10 2.3.0
-	sensision += fmt.Sprintf("// %s{", strings.ReplaceAll(url.QueryEscape(gts.Name), "+", "%20"))
-
-	sep := ""
-	for k, v := range gts.Labels {
-
-		// In case of an URLENCODED labels, "+" are not converted anymore to spaces since Warp10 2.3.0
-		sensision += sep + strings.ReplaceAll(url.QueryEscape(k)+"="+url.QueryEscape(v), "+", "%20")
-		sep = ","
-	}
-	sensision += "} "
-
-	// value
-	switch gts.Value.(type) {
-	case bool:
-		if gts.Value.(bool) {
-			sensision += "T"
-		} else {
-			sensision += "F"
-		}
-
-	case float64:
-		sensision += fmt.Sprintf("%f", gts.Value.(float64))
-
-	case int64:
-		sensision += fmt.Sprintf("%d", gts.Value.(int64))
-
-	case float32:
-		sensision += fmt.Sprintf("%f", gts.Value.(float32))
-
-	case int:
-		sensision += fmt.Sprintf("%d", gts.Value.(int))
-
-	case string:
-		sensision += fmt.Sprintf("'%s'", url.QueryEscape(gts.Value.(string)))
-
-	default:
-		// Other types: just output their default format
-		strVal := fmt.Sprintf("%v", gts.Value)
-		sensision += url.QueryEscape(strVal)
-	}
-	sensision += "\r\n"
-
-	return []byte(sensision)
-}
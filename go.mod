@@ -11,11 +11,12 @@ require (
 	github.com/gogo/protobuf v1.1.1 // indirect
 	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b // indirect
 	github.com/golang/protobuf v1.3.2
-	github.com/golang/snappy v0.0.0-20180518054509-2e65f85255db
+	github.com/golang/snappy v0.0.1
 	github.com/grpc-ecosystem/grpc-gateway v0.0.0-20180530041449-a5b66c16bab6 // indirect
 	github.com/hashicorp/hcl v0.0.0-20180404174102-ef8a98b0bbce // indirect
 	github.com/inconshreveable/mousetrap v1.0.0 // indirect
 	github.com/influxdata/influxdb v0.0.0-20180601211651-5ec7b901bbcb
+	github.com/influxdata/influxql v0.0.0-20180330235437-145e0677ff64
 	github.com/labstack/echo v0.0.0-20180501135122-d36ff729613d
 	github.com/labstack/gommon v0.0.0-20180506140623-0a22a0df01a7 // indirect
 	github.com/magiconair/properties v1.8.0 // indirect
@@ -29,9 +30,10 @@ require (
 	github.com/prometheus/client_model v0.1.0
 	github.com/prometheus/common v0.7.0
 	github.com/prometheus/prometheus v0.0.0-20180601142307-9dc763cc0341
+	github.com/prometheus/tsdb v0.10.0
 	github.com/sirupsen/logrus v1.4.2
 	github.com/spf13/afero v1.1.1 // indirect
-	github.com/spf13/cast v1.2.0 // indirect
+	github.com/spf13/cast v1.2.0
 	github.com/spf13/cobra v0.0.0-20180531180338-1e58aa3361fd
 	github.com/spf13/jwalterweatherman v0.0.0-20180109140146-7c0cea34c8ec // indirect
 	github.com/spf13/pflag v0.0.0-20180601132542-3ebe029320b2 // indirect
@@ -2,6 +2,7 @@ package middlewares
 
 import (
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/labstack/echo"
@@ -30,7 +31,12 @@ func init() {
 func Bannishment(duration time.Duration) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(ctx echo.Context) error {
-			token, err := core.GetToken(ctx.Request())
+			getToken := core.GetToken
+			if strings.HasPrefix(ctx.Request().URL.Path, "/influxdb/query") {
+				getToken = core.GetInfluxDBQueryToken
+			}
+
+			token, err := getToken(ctx.Request())
 			if err != nil {
 				log.WithError(err).WithFields(log.Fields{
 					"txn": ctx.Get("txn"),
@@ -3,6 +3,7 @@ package middlewares
 import (
 	"crypto/sha256"
 	"fmt"
+	"net/url"
 	"strconv"
 	"time"
 
@@ -79,7 +80,7 @@ func logger(c echo.Context, next echo.HandlerFunc) error {
 	log.WithFields(log.Fields{
 		"remote":     c.RealIP(),
 		"host":       req.Host,
-		"uri":        req.RequestURI,
+		"uri":        redactURI(req.RequestURI),
 		"method":     req.Method,
 		"path":       path,
 		"referer":    req.Referer(),
@@ -114,3 +115,19 @@ func Logger() echo.MiddlewareFunc {
 		}
 	}
 }
+
+// redactURI hides the token that InfluxDB clients may send as the p parameter
+func redactURI(uri string) string {
+	u, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return uri
+	}
+
+	q := u.Query()
+	if _, ok := q["p"]; !ok {
+		return uri
+	}
+	q.Set("p", "redacted")
+	u.RawQuery = q.Encode()
+	return u.RequestURI()
+}